@@ -1,16 +1,20 @@
 package aof
 
 import (
+	"errors"
 	"go-redis/config"
 	"go-redis/interface/database"
 	"go-redis/lib/logger"
+	atomic2 "go-redis/lib/sync/atomic"
 	"go-redis/lib/utils"
 	"go-redis/resp/connection"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 )
 
 type CmdLine = [][]byte
@@ -30,29 +34,121 @@ type AofHandler struct {
 	aofFile     *os.File
 	aofFilename string
 	currentDB   int
+
+	// INFO persistence 使用 size 文件当前的大小 writeFailed 最近一次写入是否失败
+	size        atomic2.Int64
+	writeFailed atomic2.Boolean
+
+	// closeMu 保证 Close 之后不会再向 aofChan 发送 done 在落盘的协程退出时关闭
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
 }
 
 func NewAOFHandler(db database.Database) (*AofHandler, error) {
 	handler := &AofHandler{}
-	handler.aofFilename = config.Properties.AppendFilename
+	handler.aofFilename = config.AppendFilename()
 	handler.db = db
-	handler.LoadAof()
+	if err := handler.LoadAof(); err != nil {
+		return nil, err
+	}
 	// 追加 创建 读写
 	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
 	handler.aofFile = aofFile
+	if info, err := aofFile.Stat(); err == nil {
+		handler.size.Set(info.Size())
+	}
 	handler.aofChan = make(chan *payload, aofQueueSize)
+	handler.done = make(chan struct{})
 	go func() {
 		handler.handleAof()
 	}()
 	return handler, nil
 }
 
+// MakeAOFHandler 运行时开启 AOF 时使用 不加载文件 只创建缓冲区
+// 调用方先让写指令进入缓冲区 再调用 Start 写入快照并开始落盘
+func MakeAOFHandler(db database.Database, filename string) *AofHandler {
+	return &AofHandler{
+		db:          db,
+		aofFilename: filename,
+		aofChan:     make(chan *payload, aofQueueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start 用 snapshot 生成的命令覆盖 AOF 文件 然后开始落盘缓冲区中的写指令
+// snapshot 期间仍在执行的写指令可能同时出现在快照和缓冲区中 重放时会再执行一次
+func (handler *AofHandler) Start(snapshot func(write func(dbIndex int, cmdLine CmdLine) error) error) error {
+	// 先写临时文件再改名 避免覆盖了原来的文件却没有写完整
+	tmp, err := os.CreateTemp(filepath.Dir(handler.aofFilename), filepath.Base(handler.aofFilename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	currentDB := 0
+	var size int64
+	err = snapshot(func(dbIndex int, cmdLine CmdLine) error {
+		if dbIndex != currentDB {
+			n, err := tmp.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))).ToBytes())
+			size += int64(n)
+			if err != nil {
+				return err
+			}
+			currentDB = dbIndex
+		}
+		n, err := tmp.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+		size += int64(n)
+		return err
+	})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), handler.aofFilename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		handler.abort()
+		return err
+	}
+	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		handler.abort()
+		return err
+	}
+	handler.aofFile = aofFile
+	handler.size.Set(size)
+	handler.currentDB = currentDB
+	go func() {
+		handler.handleAof()
+	}()
+	return nil
+}
+
+// abort Start 失败时丢弃缓冲区 之后的写指令不再进入缓冲区
+func (handler *AofHandler) abort() {
+	// 先取走缓冲区中的内容 让等待发送的写指令释放读锁
+	go func() {
+		for range handler.aofChan {
+		}
+	}()
+	handler.closeMu.Lock()
+	handler.closed = true
+	close(handler.aofChan)
+	handler.closeMu.Unlock()
+}
+
 func (handler *AofHandler) AddAof(dbIndex int, cmdLine CmdLine) {
+	handler.closeMu.RLock()
+	defer handler.closeMu.RUnlock()
 	// handler.aofChan != nil 判断 chan 是否初始化 未初始化报 panic
-	if config.Properties.AppendOnly && handler.aofChan != nil {
+	if config.AppendOnly() && handler.aofChan != nil && !handler.closed {
 		handler.aofChan <- &payload{
 			cmdLine: cmdLine,
 			dbIndex: dbIndex,
@@ -60,14 +156,29 @@ func (handler *AofHandler) AddAof(dbIndex int, cmdLine CmdLine) {
 	}
 }
 
+// Close 不再接收新的写指令 等缓冲区中的写完之后关闭文件
+// 只能在已经开始落盘之后调用
+func (handler *AofHandler) Close() error {
+	handler.closeMu.Lock()
+	if handler.closed {
+		handler.closeMu.Unlock()
+		return nil
+	}
+	handler.closed = true
+	close(handler.aofChan)
+	handler.closeMu.Unlock()
+	<-handler.done
+	return handler.aofFile.Close()
+}
+
 func (handler *AofHandler) handleAof() {
-	handler.currentDB = 0
+	defer close(handler.done)
 	for p := range handler.aofChan {
 		if p.dbIndex != handler.currentDB {
 			// select db
 			// ToBytes() 便于序列化写进文件
 			data := reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
-			_, err := handler.aofFile.Write(data)
+			err := handler.write(data)
 			if err != nil {
 				logger.Warn(err)
 				// 落盘有问题 Redis 业务也不能停
@@ -76,45 +187,71 @@ func (handler *AofHandler) handleAof() {
 			handler.currentDB = p.dbIndex
 		}
 		data := reply.MakeMultiBulkReply(p.cmdLine).ToBytes()
-		_, err := handler.aofFile.Write(data)
+		err := handler.write(data)
 		if err != nil {
 			logger.Warn(err)
 		}
 	}
 }
 
-func (handler *AofHandler) LoadAof() {
+// write 写入文件 记录文件大小和写入状态
+func (handler *AofHandler) write(data []byte) error {
+	n, err := handler.aofFile.Write(data)
+	handler.size.Add(int64(n))
+	handler.writeFailed.Set(err != nil)
+	return err
+}
+
+// Filename 正在写入的 AOF 文件
+func (handler *AofHandler) Filename() string {
+	return handler.aofFilename
+}
+
+// Size AOF 文件当前的大小
+func (handler *AofHandler) Size() int64 {
+	return handler.size.Get()
+}
+
+// LastWriteOK 最近一次写入是否成功
+func (handler *AofHandler) LastWriteOK() bool {
+	return !handler.writeFailed.Get()
+}
+
+// Pending 还在队列中等待写入的命令数量
+func (handler *AofHandler) Pending() int {
+	return len(handler.aofChan)
+}
+
+// LoadAof 启动时重放 AOF 文件 文件不存在时忽略
+// 最后一条命令没有写完整时丢弃它 其他格式错误返回 error 不能跳过损坏的内容继续加载
+func (handler *AofHandler) LoadAof() error {
 	// Open 以只读方式打开一个文件
 	file, err := os.Open(handler.aofFilename)
 	if err != nil {
 		logger.Warn(err)
-		return
+		return nil
 	}
 	defer file.Close()
-	ch := parser.ParseStream(file)
-	fakeConn := &connection.Connection{} // 为了得到 selectedDB
-	for p := range ch {
-		if p.Err != nil {
-			// 文件结束符 EOF
-			if p.Err == io.EOF {
-				break
-			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
+	reader := parser.NewReader(file)
+	reader.DisableInline()
+	// 与客户端使用相同的参数长度限制 否则调大之后写入的长参数无法恢复
+	reader.SetMaxBulkLen(int64(config.ProtoMaxBulkLen()))
+	fakeConn := connection.NewInternalConn() // 为了得到 selectedDB
+	for {
+		cmdLine, err := reader.ReadCommand()
+		if err == io.EOF {
+			return nil
 		}
-		if p.Data == nil {
-			logger.Error("empty payload")
-			continue
+		if err == io.ErrUnexpectedEOF {
+			logger.Warn("aof file " + handler.aofFilename + " is truncated, the last command is discarded")
+			return nil
 		}
-		// 类型断言和强转 差别在类型断言会返回一个 ok
-		r, ok := p.Data.(*reply.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk reply")
-			continue
+		if err != nil {
+			return errors.New("bad file format reading the append only file " + handler.aofFilename + ": " + err.Error())
 		}
-		ret := handler.db.Exec(fakeConn, r.Args)
+		ret := handler.db.Exec(fakeConn, cmdLine)
 		if reply.IsErrorReply(ret) {
-			logger.Error("exec err", err)
+			logger.Error("exec err: " + string(ret.ToBytes()))
 		}
 	}
 }
@@ -4,7 +4,12 @@ import (
 	"context"
 	"errors"
 	pool "github.com/jolestar/go-commons-pool/v2"
+	"go-redis/config"
+	"go-redis/lib/tlsutil"
+	"go-redis/lib/utils"
 	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"strings"
 )
 
 type connectionFactory struct {
@@ -12,14 +17,52 @@ type connectionFactory struct {
 }
 
 func (f connectionFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
-	c, err := client.MakeClient(f.Peer)
+	c, err := makePeerClient(f.Peer)
 	if err != nil {
 		return nil, err
 	}
-	c.Start()
 	return pool.NewPooledObject(c), nil
 }
 
+// peerAuthArgs 连接其他节点时 AUTH 的参数 优先使用 masteruser masterauth 否则所有节点使用相同的 requirepass
+// 不需要认证时返回 nil
+func peerAuthArgs() []string {
+	password := config.MasterAuth()
+	if password == "" {
+		password = config.RequirePass()
+	}
+	if password == "" {
+		return nil
+	}
+	if user := config.MasterUser(); user != "" {
+		return []string{user, password}
+	}
+	return []string{password}
+}
+
+// makePeerClient 连接其他节点 开启 tls-cluster 时使用 TLS 需要认证时连接之后先 AUTH
+// 认证过的连接断开后不会自动重连 标记为 broken 连接池借出时校验失败 重新调用这里创建并认证
+func makePeerClient(peer string) (*client.Client, error) {
+	tlsConfig, err := tlsutil.ClusterClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.MakeTLSClient(peer, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(requestTimeout())
+	c.Start()
+	if authArgs := peerAuthArgs(); authArgs != nil {
+		ret := c.Auth(utils.ToCmdLine(authArgs...))
+		if reply.IsErrorReply(ret) {
+			c.Close()
+			return nil, errors.New("auth " + peer + " failed: " + strings.TrimSpace(string(ret.ToBytes())))
+		}
+	}
+	return c, nil
+}
+
 func (f connectionFactory) DestroyObject(ctx context.Context, object *pool.PooledObject) error {
 	c, ok := object.Object.(*client.Client)
 	if !ok {
@@ -29,8 +72,17 @@ func (f connectionFactory) DestroyObject(ctx context.Context, object *pool.Poole
 	return nil
 }
 
+// ValidateObject 借出之前检查连接是否已经断开 断开的连接会被销毁重建
 func (f connectionFactory) ValidateObject(ctx context.Context, object *pool.PooledObject) bool {
-	return true
+	c, ok := object.Object.(*client.Client)
+	return ok && !c.IsBroken()
+}
+
+// newPeerPool 创建到某个节点的连接池 借出时校验连接
+func newPeerPool(peer string) *pool.ObjectPool {
+	poolConfig := pool.NewDefaultPoolConfig()
+	poolConfig.TestOnBorrow = true
+	return pool.NewObjectPool(context.Background(), &connectionFactory{Peer: peer}, poolConfig)
 }
 
 func (f connectionFactory) ActivateObject(ctx context.Context, object *pool.PooledObject) error {
@@ -0,0 +1,247 @@
+package cluster
+
+import (
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+CLUSTER 指令 让支持集群的客户端拿到槽位分布
+CLUSTER SLOTS / SHARDS / NODES / KEYSLOT / COUNTKEYSINSLOT / GETKEYSINSLOT
+迁移相关 CLUSTER SETSLOT / MIGRATESLOTS / REBALANCE 见 migration.go 节点之间的 CLUSTER REHASH 见 rehash.go
+一致性哈希模式下 CLUSTER DISTRIBUTION 查看每个节点在环上所占的比例
+成员变更 CLUSTER MEET / FORGET 见 membership.go
+故障检测 CLUSTER PING / INFO 见 gossip.go
+只读副本 CLUSTER REPLICAS 见 replica.go
+*/
+
+func execCluster(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(cmdArgs[1]))
+	if subCmd == "keyslot" {
+		if len(cmdArgs) != 3 {
+			return reply.MakeArgNumErrReply("cluster|keyslot")
+		}
+		return reply.MakeIntReply(int64(getSlot(string(cmdArgs[2]))))
+	}
+	switch subCmd {
+	case "meet":
+		return clusterMeet(cluster, cmdArgs)
+	case "forget":
+		return clusterForget(cluster, cmdArgs)
+	case "nodes":
+		return clusterNodes(cluster)
+	case "ping":
+		return clusterPing(cluster, cmdArgs)
+	case "info":
+		return clusterInfo(cluster)
+	case "raft":
+		return clusterRaft(cluster)
+	case "replicas":
+		return clusterReplicas(cluster, cmdArgs)
+	}
+	if cluster.slots == nil {
+		switch subCmd {
+		case "rebalance":
+			return clusterRebalance(cluster)
+		case "rehash":
+			return clusterRehash(cluster, c, cmdArgs)
+		case "distribution":
+			return clusterDistribution(cluster)
+		}
+		return reply.MakeErrReply("ERR This instance has cluster slot mode disabled")
+	}
+	switch subCmd {
+	case "slots":
+		return clusterSlots(cluster)
+	case "shards":
+		return clusterShards(cluster)
+	case "setslot":
+		return clusterSetSlot(cluster, cmdArgs)
+	case "migrateslots":
+		return clusterMigrateSlots(cluster, cmdArgs)
+	case "countkeysinslot":
+		if len(cmdArgs) != 3 {
+			return reply.MakeArgNumErrReply("cluster|countkeysinslot")
+		}
+		slot, errReply := parseSlot(cmdArgs[2])
+		if errReply != nil {
+			return errReply
+		}
+		var count int64
+		cluster.db.ForEach(c.GetDBIndex(), func(key string, entity *database.DataEntity) bool {
+			if getSlot(key) == slot {
+				count++
+			}
+			return true
+		})
+		return reply.MakeIntReply(count)
+	case "getkeysinslot":
+		if len(cmdArgs) != 4 {
+			return reply.MakeArgNumErrReply("cluster|getkeysinslot")
+		}
+		slot, errReply := parseSlot(cmdArgs[2])
+		if errReply != nil {
+			return errReply
+		}
+		count, err := strconv.Atoi(string(cmdArgs[3]))
+		if err != nil || count < 0 {
+			return reply.MakeErrReply("ERR Invalid number of keys")
+		}
+		keys := make([][]byte, 0)
+		cluster.db.ForEach(c.GetDBIndex(), func(key string, entity *database.DataEntity) bool {
+			if len(keys) >= count {
+				return false
+			}
+			if getSlot(key) == slot {
+				keys = append(keys, []byte(key))
+			}
+			return true
+		})
+		return reply.MakeMultiBulkReply(keys)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'")
+}
+
+func parseSlot(arg []byte) (int, resp.Reply) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return 0, reply.MakeErrReply("ERR Invalid slot")
+	}
+	return slot, nil
+}
+
+// splitAddr 把 host:port 拆开 端口解析失败时返回 0
+func splitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// clusterSlots 每段槽位 [start, end, [host, port, id]]
+func clusterSlots(cluster *ClusterDatabase) resp.Reply {
+	ranges := cluster.slots.ranges()
+	replies := make([]resp.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		host, port := splitAddr(r.node)
+		replies = append(replies, reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeIntReply(int64(r.start)),
+			reply.MakeIntReply(int64(r.end)),
+			reply.MakeMultiRawReply([]resp.Reply{
+				reply.MakeBulkReply([]byte(host)),
+				reply.MakeIntReply(int64(port)),
+				reply.MakeBulkReply([]byte(nodeID(r.node))),
+			}),
+		}))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// nodeSlots 按节点归类槽位区间 保持节点的顺序
+func nodeSlots(cluster *ClusterDatabase) map[string][]*slotRange {
+	result := make(map[string][]*slotRange)
+	for _, r := range cluster.slots.ranges() {
+		result[r.node] = append(result[r.node], r)
+	}
+	return result
+}
+
+// clusterShards 每个节点一个分片 ["slots", [...], "nodes", [[...]]]
+func clusterShards(cluster *ClusterDatabase) resp.Reply {
+	slotsOfNode := nodeSlots(cluster)
+	nodes := cluster.getNodes()
+	replies := make([]resp.Reply, 0, len(nodes))
+	for _, node := range nodes {
+		slots := make([]resp.Reply, 0)
+		for _, r := range slotsOfNode[node] {
+			slots = append(slots, reply.MakeIntReply(int64(r.start)), reply.MakeIntReply(int64(r.end)))
+		}
+		host, port := splitAddr(node)
+		// RESP3 的客户端收到的是 map RESP2 下是键值交替的数组
+		nodeInfo := reply.MakeMapReplyFromPairs(
+			reply.MakeBulkReply([]byte("id")), reply.MakeBulkReply([]byte(nodeID(node))),
+			reply.MakeBulkReply([]byte("port")), reply.MakeIntReply(int64(port)),
+			reply.MakeBulkReply([]byte("ip")), reply.MakeBulkReply([]byte(host)),
+			reply.MakeBulkReply([]byte("endpoint")), reply.MakeBulkReply([]byte(host)),
+			reply.MakeBulkReply([]byte("role")), reply.MakeBulkReply([]byte("master")),
+			reply.MakeBulkReply([]byte("replication-offset")), reply.MakeIntReply(0),
+			reply.MakeBulkReply([]byte("health")), reply.MakeBulkReply([]byte("online")),
+		)
+		replies = append(replies, reply.MakeMapReplyFromPairs(
+			reply.MakeBulkReply([]byte("slots")),
+			reply.MakeMultiRawReply(slots),
+			reply.MakeBulkReply([]byte("nodes")),
+			reply.MakeMultiRawReply([]resp.Reply{nodeInfo}),
+		))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// clusterNodes 与 Redis 相同的文本格式 每个节点一行
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+func clusterNodes(cluster *ClusterDatabase) resp.Reply {
+	return reply.MakeBulkReply([]byte(cluster.nodesText()))
+}
+
+func (cluster *ClusterDatabase) nodesText() string {
+	slotsOfNode := make(map[string][]*slotRange)
+	if cluster.slots != nil {
+		slotsOfNode = nodeSlots(cluster)
+	}
+	var builder strings.Builder
+	for _, node := range cluster.getNodes() {
+		host, port := splitAddr(node)
+		flags := "master"
+		var pingSent, pongRecv int64
+		linkState := "connected"
+		if node == cluster.self {
+			flags = "myself,master"
+		} else {
+			h := cluster.health.snapshot(node)
+			if h.fail {
+				flags += ",fail"
+			} else if h.pfail {
+				flags += ",fail?"
+			}
+			if !h.pingSent.IsZero() && h.pongRecv.Before(h.pingSent) {
+				pingSent = h.pingSent.UnixNano() / int64(time.Millisecond)
+			}
+			pongRecv = h.pongRecv.UnixNano() / int64(time.Millisecond)
+			if h.pfail || h.fail {
+				linkState = "disconnected"
+			}
+		}
+		builder.WriteString(nodeID(node) + " " + host + ":" + strconv.Itoa(port) + "@" + strconv.Itoa(port+10000) +
+			" " + flags + " - " + strconv.FormatInt(pingSent, 10) + " " + strconv.FormatInt(pongRecv, 10) +
+			" 0 " + linkState)
+		for _, r := range slotsOfNode[node] {
+			if r.start == r.end {
+				builder.WriteString(" " + strconv.Itoa(r.start))
+			} else {
+				builder.WriteString(" " + strconv.Itoa(r.start) + "-" + strconv.Itoa(r.end))
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// clusterDistribution 每个节点预计分到的 key 的比例 [node, ratio, ...]
+func clusterDistribution(cluster *ClusterDatabase) resp.Reply {
+	distribution := cluster.peerPicker.Distribution()
+	result := make([][]byte, 0, len(distribution)*2)
+	for _, node := range cluster.peerPicker.Nodes() {
+		result = append(result, []byte(node), []byte(strconv.FormatFloat(distribution[node], 'f', 4, 64)))
+	}
+	return reply.MakeMultiBulkReply(result)
+}
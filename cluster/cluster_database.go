@@ -1,44 +1,104 @@
 package cluster
 
 import (
-	"context"
 	pool "github.com/jolestar/go-commons-pool/v2"
 	"go-redis/config"
 	database2 "go-redis/database"
-	"go-redis/interface/database"
+	"go-redis/datastruct/dict"
 	"go-redis/interface/resp"
 	"go-redis/lib/consistenthash"
 	"go-redis/lib/logger"
+	"go-redis/lib/sync/atomic"
 	"go-redis/resp/reply"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ClusterDatabase struct {
-	self           string
+	self string
+
+	// mu 保护 nodes 和 peerConnection 运行时可以通过 CLUSTER MEET / FORGET 修改
+	mu             sync.RWMutex
 	nodes          []string
 	peerPicker     *consistenthash.NodeMap
 	peerConnection map[string]*pool.ObjectPool
-	db             database.Database
+	db             *database2.StandaloneDatabase
+	slots          *slotTable // 槽位模式下不为 nil
+	// rehash 一致性哈希模式下成员变化之后 REBALANCE 完成之前不为 nil 见 rehash.go
+	rehash  *rehashState
+	joining atomic.Boolean // 本节点刚被其他节点 MEET 还不知道变化之前的环
+
+	// saveMu 保证 nodes.conf 同一时刻只有一个协程在写
+	saveMu sync.Mutex
+
+	health    *healthTable // gossip 得到的各节点健康状态
+	closeChan chan struct{}
+
+	transactions *dict.SyncDict // 分布式事务 id -> *Transaction
+
+	raft *raftNode // 开启 cluster-raft 时不为 nil
+
+	replicas      map[string][]string // 节点 -> 它的只读副本 启动后不再修改
+	replicaCursor uint32              // 轮询选择副本
 }
 
 func MakeClusterDatabase() *ClusterDatabase {
 	cluster := &ClusterDatabase{
 		self:           config.Properties.Self,
-		peerPicker:     consistenthash.NewNodeMap(nil),
+		peerPicker:     consistenthash.NewNodeMap(config.Properties.VirtualNodes, nil),
 		peerConnection: make(map[string]*pool.ObjectPool),
 		db:             database2.NewStandaloneDatabase(),
+		health:         makeHealthTable(),
+		transactions:   dict.MakeSyncDict(),
+		closeChan:      make(chan struct{}),
+	}
+	cluster.db.SkipSlowlog()
+	cluster.db.SetClusterInfo(cluster.infoFields)
+	// nodes.conf 存在时以它记录的成员为准 否则使用 redis.conf 中的 peers
+	nodes, owners := loadNodesConf(nodesConfFile())
+	if len(nodes) == 0 {
+		nodes = append(nodes, config.Properties.Peers...)
+	}
+	cluster.addNode(config.Properties.Self)
+	for _, node := range nodes {
+		cluster.addNode(node)
+	}
+	members := make(map[string]bool)
+	for _, node := range cluster.getNodes() {
+		members[node] = true
+	}
+	for _, item := range config.Properties.NodeWeights {
+		pivot := strings.LastIndex(item, "=")
+		if pivot < 0 {
+			continue
+		}
+		// 只能调整已有节点的权重 否则环上会多出一个不存在的节点
+		if !members[item[:pivot]] {
+			logger.Warn("ignore weight of unknown node: " + item)
+			continue
+		}
+		weight, err := strconv.Atoi(item[pivot+1:])
+		if err != nil || weight <= 0 || weight > consistenthash.MaxWeight {
+			logger.Warn("invalid node weight: " + item + ", must be between 1 and " + strconv.Itoa(consistenthash.MaxWeight))
+			continue
+		}
+		cluster.peerPicker.AddNodeWithWeight(item[:pivot], weight)
 	}
-	nodes := make([]string, 0, len(config.Properties.Peers)+1)
-	for _, peer := range config.Properties.Peers {
-		nodes = append(nodes, peer)
+	if config.Properties.ClusterMode == "slot" {
+		if owners != nil {
+			cluster.slots = makeSlotTableFromOwners(owners)
+		} else {
+			cluster.slots = makeSlotTable(cluster.getNodes())
+		}
 	}
-	nodes = append(nodes, config.Properties.Self)
-	cluster.peerPicker.AddNode(nodes...)
-	for _, peer := range config.Properties.Peers {
-		cluster.peerConnection[peer] = pool.NewObjectPoolWithDefaultConfig(
-			context.Background(), &connectionFactory{Peer: peer})
+	cluster.saveNodesConf()
+	cluster.setupReplicas()
+	cluster.startGossip()
+	if config.Properties.ClusterRaft {
+		cluster.startRaft()
 	}
-	cluster.nodes = nodes
 	return cluster
 }
 
@@ -54,18 +114,53 @@ func (cluster *ClusterDatabase) Exec(client resp.Connection, args [][]byte) (res
 		}
 	}()
 	cmdName := strings.ToLower(string(args[0]))
+	if errReply := cluster.db.CheckPermission(client, args); errReply != nil {
+		return errReply
+	}
+	cluster.db.WaitIfPaused(client, cmdName)
+	// 等待 CLIENT PAUSE 的时间不计入 SLOWLOG 转发给其他节点的命令也记录在这里
+	start := time.Now()
+	defer database2.RecordSlowlog(client, args, start)
+	if client.InMultiState() && !isTxControlCmd(cmdName) {
+		return cluster.enqueueCmd(client, args)
+	}
 	cmdFunc, ok := router[cmdName]
+	if !ok && database2.IsCommand(cmdName) {
+		// 没有特殊处理的数据库指令 按 key 转发
+		cmdFunc, ok = defaultFunc, true
+	}
 	if !ok {
-		reply.MakeErrReply("not supported cmd")
+		return reply.MakeErrReply("ERR not supported cmd '" + cmdName + "'")
 	}
 	result = cmdFunc(cluster, client, args)
+	// ASKING 只对紧接着的一条命令有效
+	if cmdName != "asking" {
+		client.SetAsking(false)
+	}
 	return
 }
 
+// pickNode 找到 key 所属的节点 槽位模式按槽位 否则按一致性哈希
+func (cluster *ClusterDatabase) pickNode(key string) string {
+	if cluster.slots != nil {
+		return cluster.slots.owner(getSlot(key))
+	}
+	return cluster.peerPicker.PickNode(key)
+}
+
+// SetClientLister CLIENT 命令只管理本节点的连接
+func (cluster *ClusterDatabase) SetClientLister(lister database2.ClientLister) {
+	cluster.db.SetClientLister(lister)
+}
+
 func (cluster *ClusterDatabase) AfterClientClose(c resp.Connection) {
 	cluster.db.AfterClientClose(c)
 }
 
 func (cluster *ClusterDatabase) Close() {
+	close(cluster.closeChan)
+	if cluster.raft != nil {
+		cluster.raft.stop()
+	}
 	cluster.db.Close()
 }
@@ -3,14 +3,27 @@ package cluster
 import (
 	"context"
 	"errors"
+	"go-redis/config"
 	"go-redis/interface/resp"
 	"go-redis/lib/utils"
 	"go-redis/resp/client"
+	"go-redis/resp/connection"
 	"go-redis/resp/reply"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// requestTimeout 转发 广播和事务请求等待其他节点回复的最长时间 由 cluster-node-timeout 配置
+// 超过这个时间没有回复的节点 gossip 同样会把它标记为疑似下线
+func requestTimeout() time.Duration {
+	return nodeTimeout()
+}
+
 func (cluster *ClusterDatabase) GetPeerClient(peer string) (*client.Client, error) {
-	pool, ok := cluster.peerConnection[peer]
+	pool, ok := cluster.getPeerPool(peer)
 	if !ok {
 		return nil, errors.New("connection not found")
 	}
@@ -26,7 +39,7 @@ func (cluster *ClusterDatabase) GetPeerClient(peer string) (*client.Client, erro
 }
 
 func (cluster *ClusterDatabase) returnPeerClient(peer string, peerClient *client.Client) error {
-	pool, ok := cluster.peerConnection[peer]
+	pool, ok := cluster.getPeerPool(peer)
 	if !ok {
 		return errors.New("connection not found")
 	}
@@ -37,6 +50,19 @@ func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]b
 	if peer == cluster.self {
 		return cluster.db.Exec(c, args)
 	}
+	return cluster.send(peer, c, args)
+}
+
+// relayAsking 迁移状态下让旧节点先在本地查找 没有时由它交给新节点 见 rehash.go
+func (cluster *ClusterDatabase) relayAsking(peer string, c resp.Connection, args [][]byte) resp.Reply {
+	return cluster.send(peer, c, utils.ToCmdLine("ASKING"), args)
+}
+
+// send 借出一个连接 选择客户端当前的 DB 之后依次发送 返回最后一条命令的回复
+func (cluster *ClusterDatabase) send(peer string, c resp.Connection, cmdLines ...[][]byte) resp.Reply {
+	if cluster.health.isFailed(peer) {
+		return makeClusterDownReply(peer)
+	}
 	peerClient, err := cluster.GetPeerClient(peer)
 	if err != nil {
 		return reply.MakeErrReply(err.Error())
@@ -44,15 +70,129 @@ func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]b
 	defer func() {
 		_ = cluster.returnPeerClient(peer, peerClient)
 	}()
-	peerClient.Send(utils.ToCmdLine("SELECT", string(c.GetDBIndex())))
-	return peerClient.Send(args)
+	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex())))
+	var ret resp.Reply
+	for _, cmdLine := range cmdLines {
+		ret = peerClient.Send(cmdLine)
+		if reply.IsErrorReply(ret) {
+			return ret
+		}
+	}
+	return ret
+}
+
+// relayLocal 让节点只在本地执行命令 其他节点收到的是 LOCALEXEC cmd args... 不会再次转发或广播
+func (cluster *ClusterDatabase) relayLocal(peer string, c resp.Connection, args [][]byte) resp.Reply {
+	if peer == cluster.self {
+		return cluster.db.Exec(c, args)
+	}
+	return cluster.relay(peer, c, append(utils.ToCmdLine("LOCALEXEC"), args...))
+}
+
+// broadcastReplies 每个节点的回复 失败或超时的节点是错误回复
+type broadcastReplies map[string]resp.Reply
+
+// broadcast 并发的让所有节点在本地执行命令
+func (cluster *ClusterDatabase) broadcast(c resp.Connection, args [][]byte) broadcastReplies {
+	return cluster.fanOut(cluster.getNodes(), func(node string) resp.Reply {
+		return cluster.relayLocal(node, c, args)
+	})
+}
+
+// fanOut 并发的对每个节点调用 fn 超过 requestTimeout 还没有返回的节点记为超时
+// 慢节点不会拖住其他节点 整体耗时不超过一个超时时间
+func (cluster *ClusterDatabase) fanOut(nodes []string, fn func(node string) resp.Reply) broadcastReplies {
+	type nodeReply struct {
+		node  string
+		reply resp.Reply
+	}
+	ch := make(chan *nodeReply, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			ch <- &nodeReply{node: node, reply: fn(node)}
+		}(node)
+	}
+	replies := make(broadcastReplies, len(nodes))
+	deadline := time.NewTimer(requestTimeout())
+	defer deadline.Stop()
+wait:
+	for len(replies) < len(nodes) {
+		select {
+		case r := <-ch:
+			replies[r.node] = r.reply
+		case <-deadline.C:
+			break wait
+		}
+	}
+	for _, node := range nodes {
+		if _, ok := replies[node]; !ok {
+			replies[node] = reply.MakeErrReply("ERR node " + node + " timeout")
+		}
+	}
+	return replies
+}
+
+// failures 返回失败的节点和原因 全部成功时返回空
+func (replies broadcastReplies) failures() map[string]string {
+	failed := make(map[string]string)
+	for node, r := range replies {
+		if errReply, ok := r.(reply.ErrorReply); ok {
+			failed[node] = errReply.Error()
+		}
+	}
+	return failed
+}
+
+// errReply 有节点失败时返回错误 说明失败的是哪些节点以及原因
+// 例如 ERR 1 of 3 nodes failed: 127.0.0.1:6380 (ERR node 127.0.0.1:6380 timeout)
+func (replies broadcastReplies) errReply() resp.Reply {
+	failed := replies.failures()
+	if len(failed) == 0 {
+		return nil
+	}
+	nodes := make([]string, 0, len(failed))
+	for node := range failed {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	details := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		details = append(details, node+" ("+failed[node]+")")
+	}
+	return reply.MakeErrReply("ERR " + strconv.Itoa(len(failed)) + " of " + strconv.Itoa(len(replies)) +
+		" nodes failed: " + strings.Join(details, ", "))
 }
 
-func (cluster *ClusterDatabase) broadcast(c resp.Connection, args [][]byte) map[string]resp.Reply {
-	results := make(map[string]resp.Reply)
-	for _, node := range cluster.nodes {
-		result := cluster.relay(node, c, args)
-		results[node] = result
+// isPeerConn 连接是否来自集群中的其他节点
+// 配置了 masteruser 时要求以这个用户认证 否则要求对端的 IP 是某个节点的地址
+func (cluster *ClusterDatabase) isPeerConn(c resp.Connection) bool {
+	if c.IsInternal() {
+		return true
+	}
+	if user := config.MasterUser(); user != "" {
+		return c.GetUser() == user
+	}
+	conn, ok := c.(*connection.Connection)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.Addr())
+	if err != nil {
+		return false
+	}
+	// 已经被移除但还没有搬完的节点 仍然会发来 CLUSTER REHASH DONE
+	for _, node := range append(cluster.getNodes(), cluster.pendingNodes()...) {
+		nodeHost, _ := splitAddr(node)
+		// 节点的地址可能写的是主机名
+		addrs, err := net.LookupHost(nodeHost)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr == host {
+				return true
+			}
+		}
 	}
-	return results
+	return false
 }
@@ -2,26 +2,60 @@ package cluster
 
 import (
 	"go-redis/interface/resp"
+	"go-redis/lib/utils"
 	"go-redis/resp/reply"
 )
 
+// Del DEL k1 k2 ...  key 分布在多个节点时通过 TCC 事务保证要么全部删除要么都不删除
 func Del(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
-	replies := cluster.broadcast(c, cmdArgs)
-	var errReply reply.ErrorReply
-	var deleted int64 = 0
-	for _, r := range replies {
-		if reply.IsErrorReply(r) {
-			errReply = r.(reply.ErrorReply)
-			break
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("del")
+	}
+	if cluster.slots != nil {
+		keys := make([]string, 0, len(cmdArgs)-1)
+		for _, arg := range cmdArgs[1:] {
+			keys = append(keys, string(arg))
+		}
+		if errReply := cluster.checkSlot(c, keys...); errReply != nil {
+			return errReply
 		}
-		intReply, ok := r.(*reply.IntReply)
-		if !ok {
-			errReply = reply.MakeErrReply("error")
+		return cluster.db.Exec(c, cmdArgs)
+	}
+
+	// 按节点把 key 分组
+	groups := make(map[string][][]byte)
+	for _, key := range cmdArgs[1:] {
+		peer := cluster.peerPicker.PickNode(string(key))
+		groups[peer] = append(groups[peer], key)
+	}
+	if len(groups) == 1 {
+		for peer, keys := range groups {
+			return cluster.relayToOwner(c, peer, utils.BytesToStrings(keys), utils.ToCmdLine2("DEL", keys...))
 		}
-		deleted += intReply.Code
 	}
+	if errReply := cluster.checkRehash(utils.BytesToStrings(cmdArgs[1:])...); errReply != nil {
+		return errReply
+	}
+
+	txID := cluster.genTxID()
+	peers := make([]string, 0, len(groups))
+	cmdLines := make(map[string][][]byte, len(groups))
+	for peer, keys := range groups {
+		peers = append(peers, peer)
+		cmdLines[peer] = append(utils.ToCmdLine("DEL"), keys...)
+	}
+	if errReply := cluster.requestPrepare(c, txID, cmdLines).errReply(); errReply != nil {
+		return errReply
+	}
+	results, errReply := cluster.requestCommit(c, txID, peers, nil)
 	if errReply != nil {
-		return reply.MakeIntReply(deleted)
+		return errReply
+	}
+	var deleted int64
+	for _, r := range results {
+		if intReply, ok := r.(*reply.IntReply); ok {
+			deleted += intReply.Code
+		}
 	}
-	return reply.MakeErrReply(errReply.Error())
+	return reply.MakeIntReply(deleted)
 }
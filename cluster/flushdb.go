@@ -6,16 +6,13 @@ import (
 )
 
 func flushdb(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
-	replies := cluster.broadcast(c, cmdArgs)
-	var errReply reply.ErrorReply
-	for _, r := range replies {
-		if reply.IsErrorReply(r) {
-			errReply = r.(reply.ErrorReply)
-			break
-		}
+	if cluster.slots != nil {
+		// 槽位模式下每个节点只清空自己的数据
+		return cluster.db.Exec(c, cmdArgs)
 	}
-	if errReply != nil {
-		return reply.MakeOkReply()
+	replies := cluster.broadcast(c, cmdArgs)
+	if errReply := replies.errReply(); errReply != nil {
+		return errReply
 	}
-	return reply.MakeErrReply(errReply.Error())
+	return reply.MakeOkReply()
 }
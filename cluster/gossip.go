@@ -0,0 +1,351 @@
+package cluster
+
+import (
+	"context"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+基于 gossip 的故障检测
+每个节点每秒通过已有的 RESP 连接给其他节点发送 CLUSTER PING sender [node state ...]
+对方回复自己眼中所有节点的状态 双方都把对方的看法记录下来
+超过 cluster-node-timeout 没有收到回复的节点标记为 PFAIL (疑似下线)
+超过半数节点都认为它 PFAIL 时标记为 FAIL 并随着 gossip 传播给所有节点
+属于 FAIL 节点的 key 直接回复 CLUSTERDOWN 不再等待超时
+*/
+
+const (
+	gossipInterval = time.Second
+
+	// 节点状态
+	stateOK    = "ok"
+	statePFail = "pfail"
+	stateFail  = "fail"
+
+	defaultNodeTimeout = 15 * time.Second
+)
+
+// nodeHealth 本节点眼中某个节点的健康状态
+type nodeHealth struct {
+	pingSent    time.Time
+	pongRecv    time.Time
+	pfail       bool
+	fail        bool
+	failReports map[string]time.Time // 认为它 PFAIL 的节点 -> 报告时间
+}
+
+func (h *nodeHealth) state() string {
+	if h.fail {
+		return stateFail
+	}
+	if h.pfail {
+		return statePFail
+	}
+	return stateOK
+}
+
+// healthTable 所有节点的健康状态
+type healthTable struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeHealth
+}
+
+func makeHealthTable() *healthTable {
+	return &healthTable{
+		nodes: make(map[string]*nodeHealth),
+	}
+}
+
+// get 调用方需要持有锁 第一次见到的节点从现在开始计算超时
+func (t *healthTable) get(node string) *nodeHealth {
+	h, ok := t.nodes[node]
+	if !ok {
+		h = &nodeHealth{
+			pongRecv:    time.Now(),
+			failReports: make(map[string]time.Time),
+		}
+		t.nodes[node] = h
+	}
+	return h
+}
+
+func (t *healthTable) remove(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.nodes, node)
+}
+
+// isFailed 节点是否已经被确认下线
+func (t *healthTable) isFailed(node string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.nodes[node]
+	return ok && h.fail
+}
+
+// snapshot 返回节点状态的拷贝 用于展示
+func (t *healthTable) snapshot(node string) nodeHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.get(node)
+}
+
+func nodeTimeout() time.Duration {
+	if config.Properties.ClusterNodeTimeout > 0 {
+		return time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	}
+	return defaultNodeTimeout
+}
+
+// startGossip 定时给其他节点发送 PING
+func (cluster *ClusterDatabase) startGossip() {
+	ticker := time.NewTicker(gossipInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cluster.closeChan:
+				return
+			case <-ticker.C:
+				for _, node := range cluster.getNodes() {
+					if node != cluster.self {
+						go cluster.pingNode(node)
+					}
+				}
+				cluster.checkTimeout()
+			}
+		}
+	}()
+}
+
+// gossipArgs 生成 CLUSTER PING 或 PONG 携带的节点状态
+func (cluster *ClusterDatabase) gossipArgs() [][]byte {
+	nodes := cluster.getNodes()
+	cluster.health.mu.Lock()
+	defer cluster.health.mu.Unlock()
+	args := make([][]byte, 0, len(nodes)*2)
+	for _, node := range nodes {
+		state := stateOK
+		if node != cluster.self {
+			state = cluster.health.get(node).state()
+		}
+		args = append(args, []byte(node), []byte(state))
+	}
+	return args
+}
+
+// pingNode 发送 PING 并处理对方回复的节点状态
+func (cluster *ClusterDatabase) pingNode(node string) {
+	cluster.health.mu.Lock()
+	cluster.health.get(node).pingSent = time.Now()
+	cluster.health.mu.Unlock()
+
+	peerPool, ok := cluster.getPeerPool(node)
+	if !ok {
+		return
+	}
+	object, err := peerPool.BorrowObject(context.Background())
+	if err != nil {
+		return
+	}
+	peerClient := object.(*client.Client)
+	defer func() {
+		_ = peerPool.ReturnObject(context.Background(), peerClient)
+	}()
+	cmdLine := append(utils.ToCmdLine("CLUSTER", "PING", cluster.self), cluster.gossipArgs()...)
+	ret := peerClient.Send(cmdLine)
+	pong, ok := ret.(*reply.MultiBulkReply)
+	if !ok {
+		return
+	}
+
+	cluster.health.mu.Lock()
+	h := cluster.health.get(node)
+	h.pongRecv = time.Now()
+	h.pfail = false
+	if h.fail {
+		h.fail = false
+		logger.Info("cluster node " + node + " is reachable again")
+	}
+	h.failReports = make(map[string]time.Time)
+	cluster.health.mu.Unlock()
+	cluster.processGossip(node, pong.Args)
+}
+
+// checkTimeout 超时未回复的节点标记为 PFAIL 过期的下线报告清除掉
+func (cluster *ClusterDatabase) checkTimeout() {
+	timeout := nodeTimeout()
+	now := time.Now()
+	nodes := cluster.getNodes()
+	cluster.health.mu.Lock()
+	for _, node := range nodes {
+		if node == cluster.self {
+			continue
+		}
+		h := cluster.health.get(node)
+		if !h.pfail && now.Sub(h.pongRecv) > timeout {
+			h.pfail = true
+			logger.Warn("cluster node " + node + " is possibly failing")
+		}
+		for reporter, reportTime := range h.failReports {
+			if now.Sub(reportTime) > 2*timeout {
+				delete(h.failReports, reporter)
+			}
+		}
+	}
+	cluster.health.mu.Unlock()
+	for _, node := range nodes {
+		cluster.tryMarkFail(node)
+	}
+}
+
+// processGossip 记录 reporter 对其他节点状态的看法
+func (cluster *ClusterDatabase) processGossip(reporter string, args [][]byte) {
+	known := make(map[string]bool)
+	for _, node := range cluster.getNodes() {
+		known[node] = true
+	}
+	cluster.health.mu.Lock()
+	updated := make([]string, 0)
+	for i := 0; i+1 < len(args); i += 2 {
+		node := string(args[i])
+		if node == cluster.self || node == reporter || !known[node] {
+			continue
+		}
+		h := cluster.health.get(node)
+		switch string(args[i+1]) {
+		case stateFail:
+			// 自己刚刚还收到过它的回复 说明它已经恢复 不采信
+			if !h.fail && time.Since(h.pongRecv) > nodeTimeout() {
+				h.fail = true
+				logger.Warn("cluster node " + node + " is marked as failed by " + reporter)
+			}
+		case statePFail:
+			h.failReports[reporter] = time.Now()
+			updated = append(updated, node)
+		case stateOK:
+			delete(h.failReports, reporter)
+		}
+	}
+	cluster.health.mu.Unlock()
+	for _, node := range updated {
+		cluster.tryMarkFail(node)
+	}
+}
+
+// tryMarkFail 自己也认为节点 PFAIL 并且超过半数节点同意时 标记为 FAIL
+func (cluster *ClusterDatabase) tryMarkFail(node string) {
+	quorum := len(cluster.getNodes())/2 + 1
+	cluster.health.mu.Lock()
+	defer cluster.health.mu.Unlock()
+	h := cluster.health.get(node)
+	if h.fail || !h.pfail {
+		return
+	}
+	if len(h.failReports)+1 >= quorum {
+		h.fail = true
+		logger.Warn("cluster node " + node + " is marked as failed")
+	}
+}
+
+// clusterPing CLUSTER PING sender [node state ...] 回复本节点看到的状态
+func clusterPing(cluster *ClusterDatabase, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 3 {
+		return reply.MakeArgNumErrReply("cluster|ping")
+	}
+	cluster.processGossip(string(cmdArgs[2]), cmdArgs[3:])
+	return reply.MakeMultiBulkReply(cluster.gossipArgs())
+}
+
+// makeClusterDownReply 节点已经下线 不再转发
+func makeClusterDownReply(node string) resp.Reply {
+	return reply.MakeErrReply("CLUSTERDOWN node " + node + " is down")
+}
+
+// clusterStatus 集群整体状态 CLUSTER INFO 和 INFO cluster 共用
+type clusterStatus struct {
+	state         string
+	slotsAssigned int
+	slotsOK       int
+	slotsPFail    int
+	slotsFail     int
+	knownNodes    int
+	pfailNodes    int
+	failNodes     int
+}
+
+// status 根据 gossip 得到的各节点健康状态计算集群整体状态
+func (cluster *ClusterDatabase) status() *clusterStatus {
+	nodes := cluster.getNodes()
+	st := &clusterStatus{state: stateOK, knownNodes: len(nodes)}
+	failed := make(map[string]bool)
+	pfailed := make(map[string]bool)
+	for _, node := range nodes {
+		if node == cluster.self {
+			continue
+		}
+		h := cluster.health.snapshot(node)
+		failed[node] = h.fail
+		pfailed[node] = h.pfail && !h.fail
+		if failed[node] {
+			st.failNodes++
+		} else if pfailed[node] {
+			st.pfailNodes++
+		}
+	}
+	if cluster.slots != nil {
+		for _, r := range cluster.slots.ranges() {
+			count := r.end - r.start + 1
+			st.slotsAssigned += count
+			switch {
+			case failed[r.node]:
+				st.slotsFail += count
+			case pfailed[r.node]:
+				st.slotsPFail += count
+			default:
+				st.slotsOK += count
+			}
+		}
+		if st.slotsFail > 0 || st.slotsAssigned < SlotCount {
+			st.state = stateFail
+		}
+	} else if st.failNodes > 0 {
+		st.state = stateFail
+	}
+	return st
+}
+
+// clusterInfo CLUSTER INFO 集群整体状态
+func clusterInfo(cluster *ClusterDatabase) resp.Reply {
+	st := cluster.status()
+	lines := []string{
+		"cluster_state:" + st.state,
+		"cluster_slots_assigned:" + strconv.Itoa(st.slotsAssigned),
+		"cluster_slots_ok:" + strconv.Itoa(st.slotsOK),
+		"cluster_slots_pfail:" + strconv.Itoa(st.slotsPFail),
+		"cluster_slots_fail:" + strconv.Itoa(st.slotsFail),
+		"cluster_known_nodes:" + strconv.Itoa(st.knownNodes),
+		"cluster_size:" + strconv.Itoa(st.knownNodes),
+	}
+	return reply.MakeBulkReply([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+}
+
+// infoFields INFO cluster 中 cluster_enabled 之后的字段
+func (cluster *ClusterDatabase) infoFields() []string {
+	st := cluster.status()
+	return []string{
+		"cluster_state:" + st.state,
+		"cluster_known_nodes:" + strconv.Itoa(st.knownNodes),
+		"cluster_pfail_nodes:" + strconv.Itoa(st.pfailNodes),
+		"cluster_fail_nodes:" + strconv.Itoa(st.failNodes),
+	}
+}
@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"math/rand"
+	"strconv"
+)
+
+/*
+一致性哈希模式下 key 分散在所有节点上
+KEYS DBSIZE RANDOMKEY 广播到每个节点后合并结果
+SCAN 使用组合游标 低位记录正在遍历第几个节点 高位记录该节点的本地游标
+槽位模式下客户端会逐个节点遍历 与 Redis Cluster 一样只处理本节点的 key
+*/
+
+// scanNodeBits 组合游标中节点序号占用的位数 最多支持 1024 个节点
+const scanNodeBits = 10
+
+// execKeys KEYS pattern 合并所有节点的结果并去重
+func execKeys(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if cluster.slots != nil {
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	replies := cluster.broadcast(c, cmdArgs)
+	if errReply := replies.errReply(); errReply != nil {
+		return errReply
+	}
+	seen := make(map[string]struct{})
+	keys := make([][]byte, 0)
+	for _, r := range replies {
+		multiBulk, ok := r.(*reply.MultiBulkReply)
+		if !ok {
+			continue
+		}
+		for _, key := range multiBulk.Args {
+			if _, exists := seen[string(key)]; exists {
+				continue
+			}
+			seen[string(key)] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return reply.MakeMultiBulkReply(keys)
+}
+
+// execDBSize DBSIZE 所有节点 key 数量之和
+func execDBSize(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if cluster.slots != nil {
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	replies := cluster.broadcast(c, cmdArgs)
+	if errReply := replies.errReply(); errReply != nil {
+		return errReply
+	}
+	var size int64
+	for _, r := range replies {
+		if intReply, ok := r.(*reply.IntReply); ok {
+			size += intReply.Code
+		}
+	}
+	return reply.MakeIntReply(size)
+}
+
+// execRandomKey RANDOMKEY 从各节点随机返回的 key 中再随机选一个
+func execRandomKey(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if cluster.slots != nil {
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	replies := cluster.broadcast(c, cmdArgs)
+	if errReply := replies.errReply(); errReply != nil {
+		return errReply
+	}
+	keys := make([][]byte, 0, len(replies))
+	for _, r := range replies {
+		if bulk, ok := r.(*reply.BulkReply); ok && bulk.Arg != nil {
+			keys = append(keys, bulk.Arg)
+		}
+	}
+	if len(keys) == 0 {
+		return reply.MakeNullBulkReply()
+	}
+	return reply.MakeBulkReply(keys[rand.Intn(len(keys))])
+}
+
+// execScan SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// 按节点排序后依次遍历 一个节点遍历完成后游标指向下一个节点
+func execScan(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if cluster.slots != nil {
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("scan")
+	}
+	cursor, err := strconv.ParseUint(string(cmdArgs[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	nodes := cluster.peerPicker.Nodes()
+	nodeIndex := int(cursor & (1<<scanNodeBits - 1))
+	localCursor := cursor >> scanNodeBits
+	if nodeIndex >= len(nodes) {
+		return makeScanReply(0, nil)
+	}
+
+	args := make([][]byte, len(cmdArgs))
+	copy(args, cmdArgs)
+	args[1] = []byte(strconv.FormatUint(localCursor, 10))
+	ret := cluster.relayLocal(nodes[nodeIndex], c, args)
+	if reply.IsErrorReply(ret) {
+		return ret
+	}
+	scanReply, ok := ret.(*reply.MultiRawReply)
+	if !ok || len(scanReply.Replies) != 2 {
+		return reply.MakeErrReply("ERR invalid scan reply from " + nodes[nodeIndex])
+	}
+	cursorReply, ok := scanReply.Replies[0].(*reply.BulkReply)
+	if !ok {
+		return reply.MakeErrReply("ERR invalid scan reply from " + nodes[nodeIndex])
+	}
+	nextLocal, err := strconv.ParseUint(string(cursorReply.Arg), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid scan reply from " + nodes[nodeIndex])
+	}
+	var keys [][]byte
+	if multiBulk, ok := scanReply.Replies[1].(*reply.MultiBulkReply); ok {
+		keys = multiBulk.Args
+	}
+
+	var next uint64
+	if nextLocal != 0 {
+		next = nextLocal<<scanNodeBits | uint64(nodeIndex)
+	} else if nodeIndex+1 < len(nodes) {
+		next = uint64(nodeIndex + 1)
+	}
+	return makeScanReply(next, keys)
+}
+
+func makeScanReply(cursor uint64, keys [][]byte) resp.Reply {
+	if keys == nil {
+		keys = [][]byte{}
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
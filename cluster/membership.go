@@ -0,0 +1,264 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	pool "github.com/jolestar/go-commons-pool/v2"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+运行时修改集群成员
+CLUSTER MEET ip port  新节点加入 先通知其他所有节点 再把所有节点告诉新节点 已知的节点直接忽略 所以传播会自然结束
+CLUSTER FORGET node   移除节点 并通知其他节点
+成员和槽位分配保存在 nodes.conf 中 重启后以它为准 redis.conf 中的 peers 只在 nodes.conf 不存在时使用
+一致性哈希模式下成员变化后 需要在各个节点执行 CLUSTER REBALANCE 搬迁数据
+*/
+
+const defaultNodesConfFile = "nodes.conf"
+
+func nodesConfFile() string {
+	if config.Properties.ClusterConfigFile != "" {
+		return config.Properties.ClusterConfigFile
+	}
+	return defaultNodesConfFile
+}
+
+// getNodes 返回当前所有节点的拷贝
+func (cluster *ClusterDatabase) getNodes() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	nodes := make([]string, len(cluster.nodes))
+	copy(nodes, cluster.nodes)
+	return nodes
+}
+
+// addNode 加入节点 为其他节点建立连接池 返回 false 表示节点已经存在
+func (cluster *ClusterDatabase) addNode(node string) bool {
+	if node == "" {
+		return false
+	}
+	cluster.mu.Lock()
+	for _, n := range cluster.nodes {
+		if n == node {
+			cluster.mu.Unlock()
+			return false
+		}
+	}
+	cluster.nodes = append(cluster.nodes, node)
+	if node != cluster.self {
+		cluster.peerConnection[node] = newPeerPool(node)
+	}
+	cluster.mu.Unlock()
+	cluster.peerPicker.AddNode(node)
+	return true
+}
+
+// removeNode 移除节点并关闭连接池 返回 false 表示节点不存在
+func (cluster *ClusterDatabase) removeNode(node string) bool {
+	cluster.mu.Lock()
+	idx := -1
+	for i, n := range cluster.nodes {
+		if n == node {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		cluster.mu.Unlock()
+		return false
+	}
+	cluster.nodes = append(cluster.nodes[:idx], cluster.nodes[idx+1:]...)
+	peerPool := cluster.peerConnection[node]
+	delete(cluster.peerConnection, node)
+	cluster.mu.Unlock()
+
+	cluster.peerPicker.RemoveNode(node)
+	cluster.health.remove(node)
+	if peerPool != nil {
+		peerPool.Close(context.Background())
+	}
+	return true
+}
+
+// getPeerPool 获取其他节点的连接池
+// 已经被移除但还没有搬完数据的节点使用临时的连接池
+func (cluster *ClusterDatabase) getPeerPool(peer string) (*pool.ObjectPool, bool) {
+	cluster.mu.RLock()
+	peerPool, ok := cluster.peerConnection[peer]
+	cluster.mu.RUnlock()
+	if ok {
+		return peerPool, true
+	}
+	return cluster.rehashPool(peer)
+}
+
+// propagate 异步把命令发给除了自己和 except 之外的所有节点
+func (cluster *ClusterDatabase) propagate(except string, cmdLine [][]byte) {
+	nodes := cluster.getNodes()
+	go func() {
+		for _, node := range nodes {
+			if node == cluster.self || node == except {
+				continue
+			}
+			cluster.sendToNode(node, cmdLine)
+		}
+	}()
+}
+
+// sendToNode 发送集群管理命令 失败只记录日志
+func (cluster *ClusterDatabase) sendToNode(node string, cmdLine [][]byte) {
+	ret := cluster.relay(node, connection.NewInternalConn(), cmdLine)
+	if reply.IsErrorReply(ret) {
+		logger.Warn("send " + string(cmdLine[1]) + " to " + node + " failed: " + string(ret.ToBytes()))
+	}
+}
+
+// clusterMeet CLUSTER MEET ip port
+func clusterMeet(cluster *ClusterDatabase, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 4 {
+		return reply.MakeArgNumErrReply("cluster|meet")
+	}
+	if _, err := strconv.Atoi(string(cmdArgs[3])); err != nil {
+		return reply.MakeErrReply("ERR Invalid TCP base port specified: " + string(cmdArgs[3]))
+	}
+	addr := net.JoinHostPort(string(cmdArgs[2]), string(cmdArgs[3]))
+	if cluster.raft != nil {
+		return cluster.raftMeet(addr)
+	}
+	before := cluster.getNodes()
+	prev := cluster.peerPicker.Clone()
+	if !cluster.addNode(addr) {
+		return reply.MakeOkReply()
+	}
+	cluster.rehashAfterMeet(prev, len(before) == 1 && before[0] == cluster.self)
+	cluster.saveNodesConf()
+	logger.Info("cluster meet " + addr)
+
+	// 通知其他节点 同时让新节点认识所有节点
+	cluster.propagate(addr, cmdArgs)
+	nodes := cluster.getNodes()
+	go func() {
+		for _, node := range nodes {
+			if node == addr {
+				continue
+			}
+			host, port := splitAddr(node)
+			cluster.sendToNode(addr, utils.ToCmdLine("CLUSTER", "MEET", host, strconv.Itoa(port)))
+		}
+		// 认识所有节点之后 再告诉新节点变化之前的环
+		if !cluster.joining.Get() {
+			cluster.sendRehash(addr, "begin")
+		}
+	}()
+	return reply.MakeOkReply()
+}
+
+// clusterForget CLUSTER FORGET node-id|addr
+func clusterForget(cluster *ClusterDatabase, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 3 {
+		return reply.MakeArgNumErrReply("cluster|forget")
+	}
+	node, ok := cluster.resolveNode(string(cmdArgs[2]))
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown node " + string(cmdArgs[2]))
+	}
+	if node == cluster.self {
+		return reply.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	if cluster.slots != nil && cluster.slots.nodeOwnsSlots(node) {
+		return reply.MakeErrReply("ERR node " + node + " still owns slots, migrate them first")
+	}
+	if cluster.raft != nil {
+		ret := cluster.proposeMeta("delnode", node)
+		if !reply.IsErrorReply(ret) {
+			go cluster.sendRehash(node, "leave")
+		}
+		return ret
+	}
+	prev := cluster.peerPicker.Clone()
+	if !cluster.removeNode(node) {
+		return reply.MakeOkReply()
+	}
+	cluster.rehashAfterForget(prev)
+	cluster.saveNodesConf()
+	logger.Info("cluster forget " + node)
+	cluster.propagate(node, utils.ToCmdLine("CLUSTER", "FORGET", node))
+	// 被移除的节点还要把自己的 key 搬走
+	go cluster.sendRehash(node, "leave")
+	return reply.MakeOkReply()
+}
+
+// saveNodesConf 把成员和槽位写入 nodes.conf 格式与 CLUSTER NODES 相同
+// 先写临时文件再改名 避免写一半时宕机留下损坏的文件
+func (cluster *ClusterDatabase) saveNodesConf() {
+	cluster.saveMu.Lock()
+	defer cluster.saveMu.Unlock()
+	filename := nodesConfFile()
+	tmpFile := filename + ".tmp"
+	err := os.WriteFile(tmpFile, []byte(cluster.nodesText()), 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, filename)
+	}
+	if err != nil {
+		logger.Warn("save " + filename + " failed: " + err.Error())
+	}
+}
+
+// loadNodesConf 读取 nodes.conf 返回所有节点的地址
+// 文件中记录了槽位时同时返回每个槽位的归属 否则 owners 为 nil
+func loadNodesConf(filename string) (nodes []string, owners []string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		addr := fields[1]
+		if pivot := strings.IndexByte(addr, '@'); pivot >= 0 {
+			addr = addr[:pivot]
+		}
+		nodes = append(nodes, addr)
+		for _, field := range fields[8:] {
+			start, end, ok := parseSlotRange(field)
+			if !ok {
+				continue
+			}
+			if owners == nil {
+				owners = make([]string, SlotCount)
+			}
+			for slot := start; slot <= end; slot++ {
+				owners[slot] = addr
+			}
+		}
+	}
+	return nodes, owners
+}
+
+// parseSlotRange 解析 "1-100" 或 "7" 形式的槽位区间
+func parseSlotRange(field string) (int, int, bool) {
+	startStr, endStr := field, field
+	if pivot := strings.IndexByte(field, '-'); pivot >= 0 {
+		startStr, endStr = field[:pivot], field[pivot+1:]
+	}
+	start, err1 := strconv.Atoi(startStr)
+	end, err2 := strconv.Atoi(endStr)
+	if err1 != nil || err2 != nil || start < 0 || end >= SlotCount || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,254 @@
+package cluster
+
+import (
+	"go-redis/config"
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+在线迁移 不停服务的情况下把数据搬到其他节点
+槽位模式  CLUSTER MIGRATESLOTS 依次把槽位标记为 MIGRATING / IMPORTING 再用 MIGRATE 搬走 key
+         迁移过程中本地没有的 key 回复 ASK 最后用 SETSLOT NODE 通知所有节点新的归属
+一致性哈希模式 CLUSTER REBALANCE 把哈希环上已经不属于本节点的 key 搬到新的节点
+*/
+
+// migrateBatch 每条 MIGRATE 命令携带的 key 数量
+const migrateBatch = 100
+
+// execAsking 下一条命令允许访问正在导入的槽位
+// 一致性哈希模式下表示请求是因为迁移转过来的 本地没有 key 时交给新节点 见 rehash.go
+func execAsking(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	c.SetAsking(true)
+	return reply.MakeOkReply()
+}
+
+// restoreAsking 迁移时目标节点收到的 RESTORE-ASKING 视为带有 ASKING
+func restoreAsking(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	c.SetAsking(true)
+	return defaultFunc(cluster, c, cmdArgs)
+}
+
+// resolveNode 节点参数可以是地址也可以是节点 ID
+func (cluster *ClusterDatabase) resolveNode(arg string) (string, bool) {
+	for _, node := range cluster.getNodes() {
+		if node == arg || nodeID(node) == arg {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// clusterSetSlot CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node / CLUSTER SETSLOT slot STABLE
+func clusterSetSlot(cluster *ClusterDatabase, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 4 {
+		return reply.MakeArgNumErrReply("cluster|setslot")
+	}
+	slot, errReply := parseSlot(cmdArgs[2])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToLower(string(cmdArgs[3]))
+	if action == "stable" {
+		cluster.slots.setStable(slot)
+		return reply.MakeOkReply()
+	}
+	if len(cmdArgs) != 5 {
+		return reply.MakeArgNumErrReply("cluster|setslot")
+	}
+	node, ok := cluster.resolveNode(string(cmdArgs[4]))
+	if !ok {
+		return reply.MakeErrReply("ERR I don't know about node " + string(cmdArgs[4]))
+	}
+	switch action {
+	case "migrating":
+		if cluster.slots.owner(slot) != cluster.self {
+			return reply.MakeErrReply("ERR I'm not the owner of hash slot " + strconv.Itoa(slot))
+		}
+		cluster.slots.setMigrating(slot, node)
+	case "importing":
+		if cluster.slots.owner(slot) == cluster.self {
+			return reply.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(slot))
+		}
+		cluster.slots.setImporting(slot, node)
+	case "node":
+		if cluster.raft != nil {
+			return cluster.proposeMeta("setslot", strconv.Itoa(slot), node)
+		}
+		cluster.slots.setOwner(slot, node)
+		cluster.saveNodesConf()
+	default:
+		return reply.MakeSyntaxErrReply()
+	}
+	return reply.MakeOkReply()
+}
+
+// clusterMigrateSlots CLUSTER MIGRATESLOTS target start-slot [end-slot]
+func clusterMigrateSlots(cluster *ClusterDatabase, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 4 && len(cmdArgs) != 5 {
+		return reply.MakeArgNumErrReply("cluster|migrateslots")
+	}
+	target, ok := cluster.resolveNode(string(cmdArgs[2]))
+	if !ok {
+		return reply.MakeErrReply("ERR I don't know about node " + string(cmdArgs[2]))
+	}
+	if target == cluster.self {
+		return reply.MakeErrReply("ERR can not migrate slots to myself")
+	}
+	start, errReply := parseSlot(cmdArgs[3])
+	if errReply != nil {
+		return errReply
+	}
+	end := start
+	if len(cmdArgs) == 5 {
+		end, errReply = parseSlot(cmdArgs[4])
+		if errReply != nil {
+			return errReply
+		}
+	}
+	var migrated int64
+	for slot := start; slot <= end; slot++ {
+		if cluster.slots.owner(slot) != cluster.self {
+			continue
+		}
+		if errReply := cluster.migrateSlot(slot, target); errReply != nil {
+			return errReply
+		}
+		migrated++
+	}
+	return reply.MakeIntReply(migrated)
+}
+
+// migrateSlot 迁移一个槽位 期间其他客户端的请求照常处理
+func (cluster *ClusterDatabase) migrateSlot(slot int, target string) resp.Reply {
+	slotStr := strconv.Itoa(slot)
+	adminConn := connection.NewInternalConn()
+	ret := cluster.relay(target, adminConn, utils.ToCmdLine("CLUSTER", "SETSLOT", slotStr, "IMPORTING", cluster.self))
+	if reply.IsErrorReply(ret) {
+		return ret
+	}
+	cluster.slots.setMigrating(slot, target)
+
+	for dbIndex := 0; dbIndex < config.Properties.Databases; dbIndex++ {
+		// 迁移期间已有的 key 仍然可能被写入 甚至在搬走之后被重新创建 重复直到槽位为空
+		for {
+			keys := cluster.keysInSlot(dbIndex, slot, migrateBatch)
+			if len(keys) == 0 {
+				break
+			}
+			if errReply := cluster.migrateKeys(dbIndex, target, keys); errReply != nil {
+				cluster.abortMigration(slot, target, adminConn)
+				return errReply
+			}
+		}
+	}
+
+	// 通知所有节点 槽位归属变更
+	if cluster.raft != nil {
+		if ret = cluster.proposeMeta("setslot", slotStr, target); reply.IsErrorReply(ret) {
+			return ret
+		}
+		return nil
+	}
+	cluster.slots.setOwner(slot, target)
+	cluster.saveNodesConf()
+	for _, node := range cluster.getNodes() {
+		if node == cluster.self {
+			continue
+		}
+		ret = cluster.relay(node, adminConn, utils.ToCmdLine("CLUSTER", "SETSLOT", slotStr, "NODE", target))
+		if reply.IsErrorReply(ret) {
+			return ret
+		}
+	}
+	return nil
+}
+
+// keysInSlot 本节点某个 DB 中属于槽位的 key 最多 count 个
+func (cluster *ClusterDatabase) keysInSlot(dbIndex int, slot int, count int) []string {
+	keys := make([]string, 0)
+	cluster.db.ForEach(dbIndex, func(key string, entity *database.DataEntity) bool {
+		if getSlot(key) == slot {
+			keys = append(keys, key)
+		}
+		return len(keys) < count
+	})
+	return keys
+}
+
+// abortMigration 迁移失败时恢复两边的槽位状态 否则槽位一直处于 ASK 重定向
+// 已经搬过去的 key 留在目标节点 槽位仍然属于本节点 可以再次执行 MIGRATESLOTS
+func (cluster *ClusterDatabase) abortMigration(slot int, target string, adminConn resp.Connection) {
+	slotStr := strconv.Itoa(slot)
+	cluster.slots.setStable(slot)
+	ret := cluster.relay(target, adminConn, utils.ToCmdLine("CLUSTER", "SETSLOT", slotStr, "STABLE"))
+	if reply.IsErrorReply(ret) {
+		logger.Warn("clear importing state of slot " + slotStr + " on " + target + " failed: " + string(ret.ToBytes()))
+	}
+}
+
+// migrateKeys 分批用 MIGRATE 把 key 搬到目标节点的同一个 DB
+func (cluster *ClusterDatabase) migrateKeys(dbIndex int, target string, keys []string) resp.Reply {
+	host, port := splitAddr(target)
+	conn := connection.NewInternalConn()
+	conn.SelectDB(dbIndex)
+	for i := 0; i < len(keys); i += migrateBatch {
+		end := i + migrateBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		timeout := strconv.FormatInt(requestTimeout().Milliseconds(), 10)
+		cmdLine := utils.ToCmdLine("MIGRATE", host, strconv.Itoa(port), "", strconv.Itoa(dbIndex), timeout, "REPLACE")
+		switch authArgs := peerAuthArgs(); len(authArgs) {
+		case 1:
+			cmdLine = append(cmdLine, utils.ToCmdLine("AUTH", authArgs[0])...)
+		case 2:
+			cmdLine = append(cmdLine, utils.ToCmdLine("AUTH2", authArgs[0], authArgs[1])...)
+		}
+		cmdLine = append(cmdLine, []byte("KEYS"))
+		cmdLine = append(cmdLine, utils.ToCmdLine(keys[i:end]...)...)
+		ret := cluster.db.Exec(conn, cmdLine)
+		if reply.IsErrorReply(ret) {
+			return ret
+		}
+	}
+	return nil
+}
+
+// clusterRebalance CLUSTER REBALANCE 一致性哈希模式下节点变化后 把不属于本节点的 key 搬走
+// 搬迁期间这些 key 的请求先到本节点查找 见 rehash.go 搬完之后通知所有节点 返回迁移的 key 数量
+func clusterRebalance(cluster *ClusterDatabase) resp.Reply {
+	var moved int64
+	for dbIndex := 0; dbIndex < config.Properties.Databases; dbIndex++ {
+		// 搬迁期间已有的 key 仍然可能被写入 重复直到没有要搬走的 key
+		for {
+			keysOfNode := make(map[string][]string)
+			cluster.db.ForEach(dbIndex, func(key string, entity *database.DataEntity) bool {
+				node := cluster.peerPicker.PickNode(key)
+				if node != cluster.self {
+					keysOfNode[node] = append(keysOfNode[node], key)
+				}
+				return true
+			})
+			if len(keysOfNode) == 0 {
+				break
+			}
+			for node, keys := range keysOfNode {
+				if errReply := cluster.migrateKeys(dbIndex, node, keys); errReply != nil {
+					return errReply
+				}
+				moved += int64(len(keys))
+			}
+		}
+	}
+	cluster.joining.Set(false)
+	cluster.finishRehash(cluster.self)
+	cluster.propagate("", utils.ToCmdLine("CLUSTER", "REHASH", "DONE", cluster.self))
+	return reply.MakeIntReply(moved)
+}
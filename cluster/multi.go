@@ -0,0 +1,341 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+集群模式下的 MULTI / EXEC
+MULTI 之后的命令先放进客户端连接的队列 EXEC 时按 key 所在的节点分组
+只涉及一个节点时把整批指令发给该节点 由 ExecMulti 加锁后一次执行完
+涉及多个节点时走 TCC 每个节点 Prepare 属于自己的那部分指令 全部成功后再 Commit
+WATCH 记录 key 的版本和当时所在的节点 EXEC 时 key 换了节点 (扩缩容 槽位迁移) 直接拒绝
+*/
+
+// txBatch 事务中属于同一个节点的指令
+type txBatch struct {
+	indexes  []int // 指令在事务中的位置 用于按原顺序拼回结果
+	cmdLines [][][]byte
+	watching map[string]uint32
+}
+
+// isTxControlCmd 事务中这些命令直接执行 不入队
+func isTxControlCmd(cmdName string) bool {
+	switch cmdName {
+	case "multi", "exec", "discard", "watch", "unwatch":
+		return true
+	}
+	return false
+}
+
+// execMulti MULTI
+func execMulti(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("multi")
+	}
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR MULTI calls can not be nested")
+	}
+	c.SetMultiState(true)
+	return reply.MakeOkReply()
+}
+
+// execDiscard DISCARD 同时取消所有 WATCH
+func execDiscard(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("discard")
+	}
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR DISCARD without MULTI")
+	}
+	c.SetMultiState(false)
+	return reply.MakeOkReply()
+}
+
+// execWatch WATCH key [key ...] 向 key 所在的节点查询版本
+func execWatch(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("watch")
+	}
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR WATCH inside MULTI is not allowed")
+	}
+	if cluster.slots != nil {
+		keys := make([]string, 0, len(cmdArgs)-1)
+		for _, arg := range cmdArgs[1:] {
+			keys = append(keys, string(arg))
+		}
+		if errReply := cluster.checkSlot(c, keys...); errReply != nil {
+			return errReply
+		}
+	} else if errReply := cluster.checkRehash(utils.BytesToStrings(cmdArgs[1:])...); errReply != nil {
+		return errReply
+	}
+	watching := c.GetWatching()
+	for _, arg := range cmdArgs[1:] {
+		key := string(arg)
+		owner := cluster.pickNode(key)
+		var version uint32
+		if owner == cluster.self {
+			version = cluster.db.GetVersion(c.GetDBIndex(), key)
+		} else {
+			ret := cluster.relay(owner, c, utils.ToCmdLine("GetVer", key))
+			intReply, ok := ret.(*reply.IntReply)
+			if !ok {
+				if reply.IsErrorReply(ret) {
+					return ret
+				}
+				return reply.MakeErrReply("ERR get version of '" + key + "' from " + owner + " failed")
+			}
+			version = uint32(intReply.Code)
+		}
+		watching[key] = &resp.WatchedKey{Version: version, Owner: owner}
+	}
+	return reply.MakeOkReply()
+}
+
+// execUnwatch UNWATCH
+func execUnwatch(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	watching := c.GetWatching()
+	for key := range watching {
+		delete(watching, key)
+	}
+	return reply.MakeOkReply()
+}
+
+// execGetVer GetVer key  其他节点 WATCH 时查询 key 在本节点的版本
+func execGetVer(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR GETVER is only allowed from cluster nodes")
+	}
+	if len(cmdArgs) != 2 {
+		return reply.MakeArgNumErrReply("getver")
+	}
+	return reply.MakeIntReply(int64(cluster.db.GetVersion(c.GetDBIndex(), string(cmdArgs[1]))))
+}
+
+// enqueueCmd MULTI 之后的命令只做检查然后入队 出错时 EXEC 会放弃整个事务
+func (cluster *ClusterDatabase) enqueueCmd(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	if _, errReply := cluster.checkTxCmd(c, cmdLine); errReply != nil {
+		c.AddTxError(errors.New(strings.TrimSpace(string(errReply.ToBytes()))))
+		return errReply
+	}
+	c.EnqueueCmd(cmdLine)
+	return reply.MakeQueuedReply()
+}
+
+// checkTxCmd 检查事务中的指令 返回指令应该在哪个节点执行
+// 一条指令的 key 必须在同一个节点上 不涉及 key 的指令只允许 PING
+func (cluster *ClusterDatabase) checkTxCmd(c resp.Connection, cmdLine [][]byte) (string, resp.Reply) {
+	if errReply := cluster.db.CheckCmdLine(cmdLine); errReply != nil {
+		return "", errReply
+	}
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	writeKeys, readKeys := cluster.db.GetRelatedKeys(cmdLine)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 {
+		if cmdName != "ping" {
+			return "", reply.MakeErrReply("ERR command '" + cmdName + "' can not be used in cluster transaction")
+		}
+		return cluster.self, nil
+	}
+	if cluster.slots != nil {
+		if errReply := cluster.checkSlot(c, keys...); errReply != nil {
+			return "", errReply
+		}
+		return cluster.self, nil
+	}
+	node := cluster.pickNode(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.pickNode(key) != node {
+			return "", reply.MakeErrReply("ERR keys of command '" + cmdName + "' belong to different nodes")
+		}
+	}
+	if errReply := cluster.checkRehash(keys...); errReply != nil {
+		return "", errReply
+	}
+	return node, nil
+}
+
+// execExec EXEC
+func execExec(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("exec")
+	}
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR EXEC without MULTI")
+	}
+	defer c.SetMultiState(false)
+	if len(c.GetTxErrors()) > 0 {
+		return reply.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	batches := make(map[string]*txBatch)
+	getBatch := func(node string) *txBatch {
+		batch, ok := batches[node]
+		if !ok {
+			batch = &txBatch{watching: make(map[string]uint32)}
+			batches[node] = batch
+		}
+		return batch
+	}
+	// WATCH 之后 key 换了节点 原来记录的版本已经没有意义
+	for key, watched := range c.GetWatching() {
+		owner := cluster.pickNode(key)
+		if owner != watched.Owner {
+			return reply.MakeErrReply("EXECABORT watched key '" + key + "' moved from " + watched.Owner + " to " + owner)
+		}
+		getBatch(owner).watching[key] = watched.Version
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	for i, cmdLine := range cmdLines {
+		// 入队之后集群拓扑可能发生变化 重新计算节点
+		node, errReply := cluster.checkTxCmd(c, cmdLine)
+		if errReply != nil {
+			return errReply
+		}
+		batch := getBatch(node)
+		batch.indexes = append(batch.indexes, i)
+		batch.cmdLines = append(batch.cmdLines, cmdLine)
+	}
+
+	if len(batches) == 0 {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	if len(batches) == 1 {
+		for node, batch := range batches {
+			if node == cluster.self {
+				return cluster.db.ExecMulti(c, batch.watching, batch.cmdLines)
+			}
+			return cluster.relay(node, c, append(utils.ToCmdLine("ExecBatch"), encodeBatch(batch)...))
+		}
+	}
+	return cluster.execBatchTx(c, batches, len(cmdLines))
+}
+
+// execBatchTx 事务涉及多个节点 通过 TCC 保证所有节点要么都执行要么都不执行
+func (cluster *ClusterDatabase) execBatchTx(c resp.Connection, batches map[string]*txBatch, total int) resp.Reply {
+	txID := cluster.genTxID()
+	peers := make([]string, 0, len(batches))
+	cmdLines := make(map[string][][]byte, len(batches))
+	for node, batch := range batches {
+		peers = append(peers, node)
+		cmdLines[node] = append(utils.ToCmdLine("ExecBatch"), encodeBatch(batch)...)
+	}
+	prepared := cluster.requestPrepare(c, txID, cmdLines)
+	if errReply := prepared.errReply(); errReply != nil {
+		for _, reason := range prepared.failures() {
+			if reason == watchChangedErr {
+				return reply.MakeNullMultiBulkReply()
+			}
+		}
+		return errReply
+	}
+	results, errReply := cluster.requestCommit(c, txID, peers, nil)
+	if errReply != nil {
+		return errReply
+	}
+	replies := make([]resp.Reply, total)
+	for i, node := range peers {
+		batch := batches[node]
+		elems := multiReplyElems(results[i])
+		if len(elems) != len(batch.indexes) {
+			return reply.MakeErrReply("ERR unexpected transaction reply from " + node)
+		}
+		for j, index := range batch.indexes {
+			replies[index] = elems[j]
+		}
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// execExecBatch ExecBatch nWatch key version ... payload  单节点事务在本节点执行
+func execExecBatch(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR EXECBATCH is only allowed from cluster nodes")
+	}
+	watching, cmdLines, err := decodeBatch(cmdArgs[1:])
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	// 里面的指令不经过集群的 Exec 同样要检查 ACL
+	for _, cmdLine := range cmdLines {
+		if errReply := cluster.db.CheckPermission(c, cmdLine); errReply != nil {
+			return errReply
+		}
+	}
+	return cluster.db.ExecMulti(c, watching, cmdLines)
+}
+
+// encodeBatch 把一批指令编码为参数 nWatch key version ... payload
+// payload 是所有指令按 RESP 数组格式拼接起来的字节
+func encodeBatch(batch *txBatch) [][]byte {
+	args := make([][]byte, 0, 2+2*len(batch.watching))
+	args = append(args, []byte(strconv.Itoa(len(batch.watching))))
+	for key, version := range batch.watching {
+		args = append(args, []byte(key), []byte(strconv.FormatUint(uint64(version), 10)))
+	}
+	var payload bytes.Buffer
+	for _, cmdLine := range batch.cmdLines {
+		payload.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+	}
+	return append(args, payload.Bytes())
+}
+
+// decodeBatch encodeBatch 的逆过程
+func decodeBatch(args [][]byte) (map[string]uint32, [][][]byte, error) {
+	if len(args) < 2 {
+		return nil, nil, errors.New("invalid batch")
+	}
+	n, err := strconv.Atoi(string(args[0]))
+	if err != nil || n < 0 || len(args) != 2*n+2 {
+		return nil, nil, errors.New("invalid batch")
+	}
+	watching := make(map[string]uint32, n)
+	for i := 0; i < n; i++ {
+		version, err := strconv.ParseUint(string(args[2+2*i]), 10, 32)
+		if err != nil {
+			return nil, nil, errors.New("invalid batch")
+		}
+		watching[string(args[1+2*i])] = uint32(version)
+	}
+	replies, err := parser.ParseBytes(args[len(args)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	cmdLines := make([][][]byte, 0, len(replies))
+	for _, r := range replies {
+		multiBulk, ok := r.(*reply.MultiBulkReply)
+		if !ok {
+			return nil, nil, errors.New("invalid batch")
+		}
+		cmdLines = append(cmdLines, multiBulk.Args)
+	}
+	return watching, cmdLines, nil
+}
+
+// multiReplyElems 取出数组回复中的每个元素 经过网络后全是字符串的数组会被解析为 MultiBulkReply
+func multiReplyElems(r resp.Reply) []resp.Reply {
+	switch r := r.(type) {
+	case *reply.MultiRawReply:
+		return r.Replies
+	case *reply.MultiBulkReply:
+		elems := make([]resp.Reply, 0, len(r.Args))
+		for _, arg := range r.Args {
+			if arg == nil {
+				elems = append(elems, reply.MakeNullBulkReply())
+			} else {
+				elems = append(elems, reply.MakeBulkReply(arg))
+			}
+		}
+		return elems
+	}
+	return nil
+}
@@ -0,0 +1,629 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"go-redis/lib/logger"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Raft 元数据日志
+集群成员和槽位分配的每一次修改都是日志中的一条记录 由 leader 追加并复制给其他节点
+过半节点写入后提交 所有节点按相同的顺序应用 因此看到的拓扑变化顺序一致
+投票成员就是当前的集群成员 成员变化在应用时生效 每次只增删一个节点
+term votedFor 和日志持久化在 cluster-raft-file 中 commitIndex 不持久化 重启后由 leader 重新告知
+节点之间的通信通过 raftTransport 完成 集群中走节点间的连接 测试时可以换成进程内的实现
+*/
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+var raftRoleNames = []string{"follower", "candidate", "leader"}
+
+const (
+	raftTick           = 20 * time.Millisecond
+	raftHeartbeat      = 100 * time.Millisecond
+	raftElectionMin    = 500 * time.Millisecond // 选举超时在 [min, 2*min) 之间随机
+	raftProposeTimeout = 3 * time.Second
+	raftMaxBatch       = 128 // 一次 AppendEntries 最多携带的日志条数
+)
+
+// raftEntry 日志中的一条记录 Cmd 是拓扑修改命令 例如 addnode 127.0.0.1:6399
+type raftEntry struct {
+	Term  uint64   `json:"term"`
+	Index uint64   `json:"index"`
+	Cmd   []string `json:"cmd"`
+}
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term         uint64       `json:"term"`
+	Leader       string       `json:"leader"`
+	PrevLogIndex uint64       `json:"prevLogIndex"`
+	PrevLogTerm  uint64       `json:"prevLogTerm"`
+	Entries      []*raftEntry `json:"entries"`
+	LeaderCommit uint64       `json:"leaderCommit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex 成功时是 follower 与 leader 一致的最后位置 失败时帮助 leader 快速回退
+	LastIndex uint64 `json:"lastIndex"`
+}
+
+// raftTransport raft 节点之间的 RPC
+type raftTransport interface {
+	requestVote(peer string, req *voteRequest) (*voteResponse, error)
+	appendEntries(peer string, req *appendRequest) (*appendResponse, error)
+}
+
+// raftState 需要持久化的状态
+type raftState struct {
+	Term     uint64       `json:"term"`
+	VotedFor string       `json:"votedFor"`
+	Log      []*raftEntry `json:"log"`
+}
+
+// errNotLeader 提案需要转发给 leader
+type errNotLeader struct {
+	leader string
+}
+
+func (e *errNotLeader) Error() string {
+	if e.leader == "" {
+		return "CLUSTERDOWN no raft leader elected"
+	}
+	return "ERR not raft leader, leader is " + e.leader
+}
+
+// raftWaiter 等待提案提交的协程 日志被其他 term 的记录覆盖时返回错误
+type raftWaiter struct {
+	term uint64
+	ch   chan error
+}
+
+type raftNode struct {
+	mu        sync.Mutex
+	self      string
+	peers     func() []string // 当前所有的投票成员 包括自己
+	transport raftTransport
+	apply     func(entry *raftEntry)
+	bootstrap func() []string // 日志为空时 leader 写入的第一条记录 通常是当前完整的拓扑
+	stateFile string          // 为空时不持久化
+
+	role        int
+	term        uint64
+	votedFor    string
+	log         []*raftEntry // log[0] 是占位 Index 为 0
+	leader      string
+	commitIndex uint64
+	lastApplied uint64
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool // 每个节点同时只有一个 AppendEntries 在发送
+
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	joining          bool // 刚加入集群 等待 leader 的日志 期间不发起选举
+
+	waiters   map[uint64]*raftWaiter
+	applyCh   chan struct{}
+	closeChan chan struct{}
+}
+
+func newRaftNode(self string, peers func() []string, transport raftTransport, stateFile string) *raftNode {
+	rn := &raftNode{
+		self:        self,
+		peers:       peers,
+		transport:   transport,
+		apply:       func(entry *raftEntry) {},
+		bootstrap:   func() []string { return []string{"noop"} },
+		stateFile:   stateFile,
+		log:         []*raftEntry{{}},
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		replicating: make(map[string]bool),
+		waiters:     make(map[uint64]*raftWaiter),
+		applyCh:     make(chan struct{}, 1),
+		closeChan:   make(chan struct{}),
+	}
+	rn.load()
+	rn.resetElectionTimer()
+	return rn
+}
+
+func (rn *raftNode) start() {
+	go rn.run()
+	go rn.applyLoop()
+}
+
+func (rn *raftNode) stop() {
+	close(rn.closeChan)
+}
+
+// run 定时检查 leader 发送心跳 其他节点选举超时后发起选举
+func (rn *raftNode) run() {
+	ticker := time.NewTicker(raftTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rn.closeChan:
+			return
+		case <-ticker.C:
+		}
+		peers := rn.peers()
+		isMember := containsNode(peers, rn.self)
+		rn.mu.Lock()
+		switch {
+		case rn.role == raftLeader && !isMember:
+			// 自己已经被移出集群
+			rn.stepDown(rn.term)
+			rn.mu.Unlock()
+		case rn.role == raftLeader:
+			heartbeat := time.Since(rn.lastHeartbeat) >= raftHeartbeat
+			if heartbeat {
+				rn.lastHeartbeat = time.Now()
+			}
+			rn.mu.Unlock()
+			if heartbeat {
+				rn.replicateAll(peers)
+			}
+		case isMember && !rn.joining && time.Now().After(rn.electionDeadline):
+			rn.startElection(peers)
+			rn.mu.Unlock()
+		default:
+			rn.mu.Unlock()
+		}
+	}
+}
+
+// quorum 过半数
+func quorum(n int) int {
+	return n/2 + 1
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (rn *raftNode) resetElectionTimer() {
+	timeout := raftElectionMin + time.Duration(rand.Int63n(int64(raftElectionMin)))
+	rn.electionDeadline = time.Now().Add(timeout)
+}
+
+func (rn *raftNode) lastLog() (uint64, uint64) {
+	last := rn.log[len(rn.log)-1]
+	return last.Index, last.Term
+}
+
+// startElection 调用方持有锁
+func (rn *raftNode) startElection(peers []string) {
+	rn.term++
+	rn.role = raftCandidate
+	rn.votedFor = rn.self
+	rn.leader = ""
+	rn.persist()
+	rn.resetElectionTimer()
+	lastIndex, lastTerm := rn.lastLog()
+	req := &voteRequest{
+		Term:         rn.term,
+		Candidate:    rn.self,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  lastTerm,
+	}
+	logger.Info("raft: start election for term " + strconv.FormatUint(rn.term, 10))
+	votes := 1
+	if votes >= quorum(len(peers)) {
+		rn.becomeLeader(peers)
+		return
+	}
+	for _, peer := range peers {
+		if peer == rn.self {
+			continue
+		}
+		go func(peer string) {
+			resp, err := rn.transport.requestVote(peer, req)
+			if err != nil {
+				return
+			}
+			rn.mu.Lock()
+			defer rn.mu.Unlock()
+			if resp.Term > rn.term {
+				rn.stepDown(resp.Term)
+				return
+			}
+			if rn.role != raftCandidate || rn.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= quorum(len(peers)) {
+				rn.becomeLeader(rn.peers())
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader 调用方持有锁 上任后追加一条本 term 的日志 借此提交之前 term 的日志
+func (rn *raftNode) becomeLeader(peers []string) {
+	rn.role = raftLeader
+	rn.leader = rn.self
+	lastIndex, _ := rn.lastLog()
+	for _, peer := range peers {
+		rn.nextIndex[peer] = lastIndex + 1
+		rn.matchIndex[peer] = 0
+	}
+	cmd := []string{"noop"}
+	if lastIndex == 0 {
+		cmd = rn.bootstrap()
+	}
+	rn.log = append(rn.log, &raftEntry{Term: rn.term, Index: lastIndex + 1, Cmd: cmd})
+	rn.persist()
+	rn.lastHeartbeat = time.Time{}
+	rn.advanceCommit(peers)
+	logger.Info("raft: become leader of term " + strconv.FormatUint(rn.term, 10))
+}
+
+// stepDown 调用方持有锁 发现更大的 term 或者收到当前 leader 的消息
+func (rn *raftNode) stepDown(term uint64) {
+	if term > rn.term {
+		rn.term = term
+		rn.votedFor = ""
+		rn.leader = ""
+		rn.persist()
+	}
+	rn.role = raftFollower
+	rn.resetElectionTimer()
+}
+
+// handleVote 处理 RequestVote
+func (rn *raftNode) handleVote(req *voteRequest) *voteResponse {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	// 已经被移出集群的节点不知道自己被移除 会不断发起选举 不能让它打断现在的 leader
+	if req.Term < rn.term || !containsNode(rn.peers(), req.Candidate) {
+		return &voteResponse{Term: rn.term}
+	}
+	if req.Term > rn.term {
+		rn.stepDown(req.Term)
+	}
+	lastIndex, lastTerm := rn.lastLog()
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= lastIndex)
+	if (rn.votedFor == "" || rn.votedFor == req.Candidate) && upToDate {
+		rn.votedFor = req.Candidate
+		rn.persist()
+		rn.resetElectionTimer()
+		return &voteResponse{Term: rn.term, Granted: true}
+	}
+	return &voteResponse{Term: rn.term}
+}
+
+// handleAppend 处理 AppendEntries 心跳也是不带日志的 AppendEntries
+func (rn *raftNode) handleAppend(req *appendRequest) *appendResponse {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	lastIndex, _ := rn.lastLog()
+	if req.Term < rn.term {
+		return &appendResponse{Term: rn.term, LastIndex: lastIndex}
+	}
+	if req.Term > rn.term || rn.role != raftFollower {
+		rn.stepDown(req.Term)
+	}
+	rn.leader = req.Leader
+	rn.joining = false
+	rn.resetElectionTimer()
+
+	if req.PrevLogIndex > lastIndex || rn.log[req.PrevLogIndex].Term != req.PrevLogTerm {
+		hint := lastIndex
+		if req.PrevLogIndex <= lastIndex {
+			hint = req.PrevLogIndex - 1
+		}
+		return &appendResponse{Term: rn.term, LastIndex: hint}
+	}
+	changed := false
+	for _, entry := range req.Entries {
+		if entry.Index < uint64(len(rn.log)) {
+			if rn.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			// 与 leader 冲突的日志以及之后的都删掉
+			rn.log = rn.log[:entry.Index]
+		}
+		rn.log = append(rn.log, entry)
+		changed = true
+	}
+	if changed {
+		rn.persist()
+	}
+	matched := req.PrevLogIndex + uint64(len(req.Entries))
+	commitIndex := req.LeaderCommit
+	if commitIndex > matched {
+		commitIndex = matched
+	}
+	if commitIndex > rn.commitIndex {
+		rn.commitIndex = commitIndex
+		rn.notifyApply()
+	}
+	return &appendResponse{Term: rn.term, Success: true, LastIndex: matched}
+}
+
+func (rn *raftNode) replicateAll(peers []string) {
+	for _, peer := range peers {
+		if peer != rn.self {
+			go rn.replicate(peer)
+		}
+	}
+}
+
+// replicate 把 nextIndex 之后的日志发给 peer
+func (rn *raftNode) replicate(peer string) {
+	rn.mu.Lock()
+	if rn.role != raftLeader || rn.replicating[peer] {
+		rn.mu.Unlock()
+		return
+	}
+	lastIndex, _ := rn.lastLog()
+	next, ok := rn.nextIndex[peer]
+	if !ok || next < 1 {
+		// 新加入的成员
+		next = lastIndex + 1
+		rn.nextIndex[peer] = next
+	}
+	if next > lastIndex+1 {
+		next = lastIndex + 1
+	}
+	end := lastIndex + 1
+	if end > next+raftMaxBatch {
+		end = next + raftMaxBatch
+	}
+	entries := make([]*raftEntry, end-next)
+	copy(entries, rn.log[next:end])
+	req := &appendRequest{
+		Term:         rn.term,
+		Leader:       rn.self,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  rn.log[next-1].Term,
+		Entries:      entries,
+		LeaderCommit: rn.commitIndex,
+	}
+	rn.replicating[peer] = true
+	rn.mu.Unlock()
+
+	resp, err := rn.transport.appendEntries(peer, req)
+
+	rn.mu.Lock()
+	rn.replicating[peer] = false
+	if err != nil || rn.role != raftLeader || rn.term != req.Term {
+		rn.mu.Unlock()
+		return
+	}
+	if resp.Term > rn.term {
+		rn.stepDown(resp.Term)
+		rn.mu.Unlock()
+		return
+	}
+	if resp.Success {
+		if resp.LastIndex > rn.matchIndex[peer] {
+			rn.matchIndex[peer] = resp.LastIndex
+		}
+		rn.nextIndex[peer] = resp.LastIndex + 1
+		rn.advanceCommit(rn.peers())
+	} else {
+		next = req.PrevLogIndex
+		if resp.LastIndex+1 < next {
+			next = resp.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		rn.nextIndex[peer] = next
+	}
+	lastIndex, _ = rn.lastLog()
+	more := rn.nextIndex[peer] <= lastIndex
+	rn.mu.Unlock()
+	if more {
+		go rn.replicate(peer)
+	}
+}
+
+// advanceCommit 调用方持有锁 只通过统计副本数提交当前 term 的日志
+func (rn *raftNode) advanceCommit(peers []string) {
+	lastIndex, _ := rn.lastLog()
+	for n := lastIndex; n > rn.commitIndex; n-- {
+		if rn.log[n].Term != rn.term {
+			break
+		}
+		count := 0
+		for _, peer := range peers {
+			if peer == rn.self || rn.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= quorum(len(peers)) {
+			rn.commitIndex = n
+			rn.notifyApply()
+			return
+		}
+	}
+}
+
+func (rn *raftNode) notifyApply() {
+	select {
+	case rn.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop 按顺序应用已提交的日志
+func (rn *raftNode) applyLoop() {
+	for {
+		select {
+		case <-rn.closeChan:
+			return
+		case <-rn.applyCh:
+		}
+		for {
+			rn.mu.Lock()
+			if rn.lastApplied >= rn.commitIndex {
+				rn.mu.Unlock()
+				break
+			}
+			rn.lastApplied++
+			entry := rn.log[rn.lastApplied]
+			waiter := rn.waiters[entry.Index]
+			delete(rn.waiters, entry.Index)
+			rn.mu.Unlock()
+
+			rn.apply(entry)
+			if waiter != nil {
+				if waiter.term == entry.Term {
+					waiter.ch <- nil
+				} else {
+					waiter.ch <- errors.New("ERR raft leadership changed, proposal dropped")
+				}
+			}
+		}
+	}
+}
+
+// propose 追加一条日志并等待它被应用 返回日志的位置 只有 leader 可以提案
+func (rn *raftNode) propose(cmd []string) (uint64, error) {
+	rn.mu.Lock()
+	if rn.role != raftLeader {
+		leader := rn.leader
+		rn.mu.Unlock()
+		return 0, &errNotLeader{leader: leader}
+	}
+	lastIndex, _ := rn.lastLog()
+	entry := &raftEntry{Term: rn.term, Index: lastIndex + 1, Cmd: cmd}
+	rn.log = append(rn.log, entry)
+	rn.persist()
+	waiter := &raftWaiter{term: rn.term, ch: make(chan error, 1)}
+	rn.waiters[entry.Index] = waiter
+	peers := rn.peers()
+	rn.advanceCommit(peers)
+	rn.mu.Unlock()
+
+	rn.replicateAll(peers)
+	select {
+	case err := <-waiter.ch:
+		return entry.Index, err
+	case <-time.After(raftProposeTimeout):
+		rn.mu.Lock()
+		delete(rn.waiters, entry.Index)
+		rn.mu.Unlock()
+		return 0, errors.New("ERR raft proposal timeout")
+	}
+}
+
+// waitApplied 等待本节点应用到 index  follower 转发提案后等 leader 的下一次心跳
+func (rn *raftNode) waitApplied(index uint64) bool {
+	deadline := time.Now().Add(raftProposeTimeout)
+	for time.Now().Before(deadline) {
+		rn.mu.Lock()
+		applied := rn.lastApplied >= index
+		rn.mu.Unlock()
+		if applied {
+			return true
+		}
+		time.Sleep(raftTick)
+	}
+	return false
+}
+
+// reset 清空日志 节点加入另一个集群前调用 之后等待新 leader 的日志
+func (rn *raftNode) reset() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.log = []*raftEntry{{}}
+	rn.commitIndex = 0
+	rn.lastApplied = 0
+	rn.role = raftFollower
+	rn.leader = ""
+	rn.votedFor = ""
+	rn.joining = true
+	rn.persist()
+	rn.resetElectionTimer()
+}
+
+// status 返回 CLUSTER RAFT 展示的信息
+func (rn *raftNode) status() []string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	lastIndex, lastTerm := rn.lastLog()
+	return []string{
+		"raft_role:" + raftRoleNames[rn.role],
+		"raft_term:" + strconv.FormatUint(rn.term, 10),
+		"raft_leader:" + rn.leader,
+		"raft_voted_for:" + rn.votedFor,
+		"raft_last_log_index:" + strconv.FormatUint(lastIndex, 10),
+		"raft_last_log_term:" + strconv.FormatUint(lastTerm, 10),
+		"raft_commit_index:" + strconv.FormatUint(rn.commitIndex, 10),
+		"raft_last_applied:" + strconv.FormatUint(rn.lastApplied, 10),
+	}
+}
+
+// persist 调用方持有锁 先写临时文件再改名
+func (rn *raftNode) persist() {
+	if rn.stateFile == "" {
+		return
+	}
+	data, err := json.Marshal(&raftState{
+		Term:     rn.term,
+		VotedFor: rn.votedFor,
+		Log:      rn.log[1:],
+	})
+	if err == nil {
+		tmpFile := rn.stateFile + ".tmp"
+		err = os.WriteFile(tmpFile, data, 0644)
+		if err == nil {
+			err = os.Rename(tmpFile, rn.stateFile)
+		}
+	}
+	if err != nil {
+		logger.Warn("raft: save " + rn.stateFile + " failed: " + err.Error())
+	}
+}
+
+func (rn *raftNode) load() {
+	if rn.stateFile == "" {
+		return
+	}
+	data, err := os.ReadFile(rn.stateFile)
+	if err != nil {
+		return
+	}
+	state := &raftState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		logger.Warn("raft: load " + rn.stateFile + " failed: " + err.Error())
+		return
+	}
+	rn.term = state.Term
+	rn.votedFor = state.VotedFor
+	rn.log = append([]*raftEntry{{}}, state.Log...)
+}
@@ -0,0 +1,293 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+集群拓扑和 Raft 日志的对接
+开启 cluster-raft 后 CLUSTER MEET / FORGET / SETSLOT NODE 不再直接修改本地并广播 而是向 leader 提案
+日志中的命令:
+  topology addr=ranges ...  leader 第一次上任时写入的完整拓扑 ranges 形如 0-5460,5462 一致性哈希模式为空
+  addnode addr              加入节点
+  delnode addr              移除节点
+  setslot slot addr         槽位归属变更
+  noop                      leader 上任时写入 用来提交之前 term 的日志
+内部命令:
+  RAFT VOTE json / RAFT APPEND json  节点之间的 RPC
+  RAFT PROPOSE cmd args...           follower 把提案转发给 leader
+  RAFT JOIN                          新节点加入前清空自己的日志 等待 leader 复制
+*/
+
+const defaultRaftFile = "raft.conf"
+
+func raftStateFile() string {
+	if config.Properties.ClusterRaftFile != "" {
+		return config.Properties.ClusterRaftFile
+	}
+	return defaultRaftFile
+}
+
+// clusterTransport 通过节点间的连接池发送 RAFT 命令 请求和回复都是 JSON
+type clusterTransport struct {
+	cluster *ClusterDatabase
+}
+
+func (t *clusterTransport) call(peer string, subCmd string, req interface{}, resp interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ret := t.cluster.relay(peer, connection.NewInternalConn(), utils.ToCmdLine("RAFT", subCmd, string(data)))
+	bulk, ok := ret.(*reply.BulkReply)
+	if !ok {
+		return errors.New(strings.TrimSpace(string(ret.ToBytes())))
+	}
+	return json.Unmarshal(bulk.Arg, resp)
+}
+
+func (t *clusterTransport) requestVote(peer string, req *voteRequest) (*voteResponse, error) {
+	resp := &voteResponse{}
+	if err := t.call(peer, "VOTE", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *clusterTransport) appendEntries(peer string, req *appendRequest) (*appendResponse, error) {
+	resp := &appendResponse{}
+	if err := t.call(peer, "APPEND", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// startRaft 创建并启动 Raft 节点
+func (cluster *ClusterDatabase) startRaft() {
+	rn := newRaftNode(cluster.self, cluster.getNodes, &clusterTransport{cluster: cluster}, raftStateFile())
+	rn.apply = cluster.applyMeta
+	rn.bootstrap = cluster.topologySnapshot
+	cluster.raft = rn
+	rn.start()
+}
+
+// execRaft RAFT VOTE|APPEND|PROPOSE|JOIN ...
+func execRaft(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR RAFT is only allowed from cluster nodes")
+	}
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("raft")
+	}
+	if cluster.raft == nil {
+		return reply.MakeErrReply("ERR raft is not enabled")
+	}
+	subCmd := strings.ToLower(string(cmdArgs[1]))
+	switch subCmd {
+	case "vote":
+		if len(cmdArgs) != 3 {
+			return reply.MakeArgNumErrReply("raft|vote")
+		}
+		req := &voteRequest{}
+		if err := json.Unmarshal(cmdArgs[2], req); err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		return makeJSONReply(cluster.raft.handleVote(req))
+	case "append":
+		if len(cmdArgs) != 3 {
+			return reply.MakeArgNumErrReply("raft|append")
+		}
+		req := &appendRequest{}
+		if err := json.Unmarshal(cmdArgs[2], req); err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		return makeJSONReply(cluster.raft.handleAppend(req))
+	case "propose":
+		if len(cmdArgs) < 3 {
+			return reply.MakeArgNumErrReply("raft|propose")
+		}
+		cmd := make([]string, 0, len(cmdArgs)-2)
+		for _, arg := range cmdArgs[2:] {
+			cmd = append(cmd, string(arg))
+		}
+		index, err := cluster.raft.propose(cmd)
+		if err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		return reply.MakeIntReply(int64(index))
+	case "join":
+		if len(cluster.getNodes()) > 1 {
+			return reply.MakeErrReply("ERR node already belongs to a cluster")
+		}
+		cluster.raft.reset()
+		// 重放日志时的成员变化不是真的变化 变化之前的环由发起 MEET 的节点告知
+		cluster.joining.Set(true)
+		return reply.MakeOkReply()
+	}
+	return reply.MakeErrReply("ERR Unknown subcommand or wrong number of arguments for '" + subCmd + "'")
+}
+
+func makeJSONReply(v interface{}) resp.Reply {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeBulkReply(data)
+}
+
+// proposeMeta 提交拓扑修改 本节点不是 leader 时转发给 leader 返回时修改已经在本节点生效
+func (cluster *ClusterDatabase) proposeMeta(cmd ...string) resp.Reply {
+	_, err := cluster.raft.propose(cmd)
+	if notLeader, ok := err.(*errNotLeader); ok && notLeader.leader != "" {
+		ret := cluster.relay(notLeader.leader, connection.NewInternalConn(), utils.ToCmdLine(append([]string{"RAFT", "PROPOSE"}, cmd...)...))
+		index, ok := ret.(*reply.IntReply)
+		if !ok {
+			return ret
+		}
+		// leader 应用之后 本节点还要等下一次心跳才知道日志已经提交
+		if !cluster.raft.waitApplied(uint64(index.Code)) {
+			return reply.MakeErrReply("ERR raft apply timeout")
+		}
+		return reply.MakeOkReply()
+	}
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return reply.MakeOkReply()
+}
+
+// raftMeet CLUSTER MEET 让新节点清空日志 然后提案加入
+func (cluster *ClusterDatabase) raftMeet(addr string) resp.Reply {
+	if containsNode(cluster.getNodes(), addr) {
+		return reply.MakeOkReply()
+	}
+	peerClient, err := makePeerClient(addr)
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	ret := peerClient.Send(utils.ToCmdLine("RAFT", "JOIN"))
+	peerClient.Close()
+	if reply.IsErrorReply(ret) {
+		return ret
+	}
+	ret = cluster.proposeMeta("addnode", addr)
+	if !reply.IsErrorReply(ret) {
+		go cluster.sendRehash(addr, "begin")
+	}
+	return ret
+}
+
+// topologySnapshot 当前完整的拓扑 作为日志的第一条记录
+func (cluster *ClusterDatabase) topologySnapshot() []string {
+	cmd := []string{"topology"}
+	var slotsOfNode map[string][]*slotRange
+	if cluster.slots != nil {
+		slotsOfNode = nodeSlots(cluster)
+	}
+	for _, node := range cluster.getNodes() {
+		ranges := make([]string, 0, len(slotsOfNode[node]))
+		for _, r := range slotsOfNode[node] {
+			if r.start == r.end {
+				ranges = append(ranges, strconv.Itoa(r.start))
+			} else {
+				ranges = append(ranges, strconv.Itoa(r.start)+"-"+strconv.Itoa(r.end))
+			}
+		}
+		cmd = append(cmd, node+"="+strings.Join(ranges, ","))
+	}
+	return cmd
+}
+
+// applyMeta 应用一条已经提交的日志 所有节点按相同顺序调用
+func (cluster *ClusterDatabase) applyMeta(entry *raftEntry) {
+	cmd := entry.Cmd
+	if len(cmd) == 0 {
+		return
+	}
+	switch cmd[0] {
+	case "noop":
+		return
+	case "topology":
+		cluster.applyTopology(cmd[1:])
+	case "addnode":
+		prev := cluster.peerPicker.Clone()
+		if len(cmd) == 2 && cluster.addNode(cmd[1]) {
+			cluster.rehashAfterMeet(prev, false)
+			logger.Info("raft: add node " + cmd[1])
+		}
+	case "delnode":
+		// 不会把自己移除 被移除的节点不再收到日志 由管理员下线
+		prev := cluster.peerPicker.Clone()
+		if len(cmd) == 2 && cmd[1] != cluster.self && cluster.removeNode(cmd[1]) {
+			cluster.rehashAfterForget(prev)
+			logger.Info("raft: remove node " + cmd[1])
+		}
+	case "setslot":
+		if len(cmd) != 3 || cluster.slots == nil {
+			return
+		}
+		slot, err := strconv.Atoi(cmd[1])
+		if err != nil || slot < 0 || slot >= SlotCount {
+			return
+		}
+		cluster.slots.setOwner(slot, cmd[2])
+	default:
+		logger.Warn("raft: unknown command " + cmd[0])
+		return
+	}
+	cluster.saveNodesConf()
+}
+
+// applyTopology 把成员和槽位替换为快照中的内容
+func (cluster *ClusterDatabase) applyTopology(items []string) {
+	nodes := make([]string, 0, len(items))
+	owners := make([]string, SlotCount)
+	for _, item := range items {
+		pivot := strings.LastIndex(item, "=")
+		if pivot < 0 {
+			continue
+		}
+		node := item[:pivot]
+		nodes = append(nodes, node)
+		if item[pivot+1:] == "" {
+			continue
+		}
+		for _, field := range strings.Split(item[pivot+1:], ",") {
+			start, end, ok := parseSlotRange(field)
+			if !ok {
+				continue
+			}
+			for slot := start; slot <= end; slot++ {
+				owners[slot] = node
+			}
+		}
+	}
+	for _, node := range nodes {
+		cluster.addNode(node)
+	}
+	for _, node := range cluster.getNodes() {
+		if node != cluster.self && !containsNode(nodes, node) {
+			cluster.removeNode(node)
+		}
+	}
+	if cluster.slots != nil {
+		cluster.slots.setOwners(owners)
+	}
+}
+
+// clusterRaft CLUSTER RAFT 查看 Raft 状态
+func clusterRaft(cluster *ClusterDatabase) resp.Reply {
+	if cluster.raft == nil {
+		return reply.MakeErrReply("ERR raft is not enabled")
+	}
+	return reply.MakeBulkReply([]byte(strings.Join(cluster.raft.status(), "\r\n") + "\r\n"))
+}
@@ -0,0 +1,355 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNetwork 进程内的网络 节点之间直接调用处理函数 可以断开某个节点模拟故障
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*raftNode
+	down  map[string]bool
+}
+
+func makeMemNetwork() *memNetwork {
+	return &memNetwork{
+		nodes: make(map[string]*raftNode),
+		down:  make(map[string]bool),
+	}
+}
+
+func (n *memNetwork) setDown(node string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[node] = down
+}
+
+// target 两端都在线时返回对端的节点
+func (n *memNetwork) target(from string, to string) (*raftNode, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rn, ok := n.nodes[to]
+	if !ok || n.down[from] || n.down[to] {
+		return nil, errors.New("node " + to + " unreachable")
+	}
+	return rn, nil
+}
+
+// memTransport 进程内的 raftTransport 请求和回复经过 JSON 编解码 与节点间连接上的行为一致
+type memTransport struct {
+	network *memNetwork
+	self    string
+}
+
+func copyByJSON(src interface{}, dst interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func (t *memTransport) requestVote(peer string, req *voteRequest) (*voteResponse, error) {
+	rn, err := t.network.target(t.self, peer)
+	if err != nil {
+		return nil, err
+	}
+	copied := &voteRequest{}
+	if err := copyByJSON(req, copied); err != nil {
+		return nil, err
+	}
+	resp := &voteResponse{}
+	if err := copyByJSON(rn.handleVote(copied), resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *memTransport) appendEntries(peer string, req *appendRequest) (*appendResponse, error) {
+	rn, err := t.network.target(t.self, peer)
+	if err != nil {
+		return nil, err
+	}
+	copied := &appendRequest{}
+	if err := copyByJSON(req, copied); err != nil {
+		return nil, err
+	}
+	resp := &appendResponse{}
+	if err := copyByJSON(rn.handleAppend(copied), resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// testRaftMember 测试中的一个节点 成员列表由 addnode / delnode 日志维护
+type testRaftMember struct {
+	mu      sync.Mutex
+	members []string
+	applied [][]string
+	rn      *raftNode
+}
+
+func (m *testRaftMember) peers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.members...)
+}
+
+func (m *testRaftMember) apply(entry *raftEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = append(m.applied, entry.Cmd)
+	switch entry.Cmd[0] {
+	case "addnode":
+		if !containsNode(m.members, entry.Cmd[1]) {
+			m.members = append(m.members, entry.Cmd[1])
+		}
+	case "delnode":
+		members := make([]string, 0, len(m.members))
+		for _, node := range m.members {
+			if node != entry.Cmd[1] {
+				members = append(members, node)
+			}
+		}
+		m.members = members
+	}
+}
+
+func (m *testRaftMember) appliedCmds() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]string(nil), m.applied...)
+}
+
+type testRaftCluster struct {
+	t       *testing.T
+	network *memNetwork
+	members map[string]*testRaftMember
+}
+
+func makeTestRaftCluster(t *testing.T, n int) *testRaftCluster {
+	tc := &testRaftCluster{
+		t:       t,
+		network: makeMemNetwork(),
+		members: make(map[string]*testRaftMember),
+	}
+	nodes := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		nodes = append(nodes, "node"+strconv.Itoa(i))
+	}
+	for _, node := range nodes {
+		tc.addMember(node, nodes)
+	}
+	t.Cleanup(func() {
+		for _, m := range tc.members {
+			m.rn.stop()
+		}
+	})
+	return tc
+}
+
+// addMember 创建节点并启动 members 是节点启动时知道的成员
+func (tc *testRaftCluster) addMember(node string, members []string) *testRaftMember {
+	m := &testRaftMember{members: append([]string(nil), members...)}
+	rn := newRaftNode(node, m.peers, &memTransport{network: tc.network, self: node}, "")
+	rn.apply = m.apply
+	m.rn = rn
+	tc.network.mu.Lock()
+	tc.network.nodes[node] = rn
+	tc.network.mu.Unlock()
+	tc.members[node] = m
+	return m
+}
+
+func (tc *testRaftCluster) start() {
+	for _, m := range tc.members {
+		m.rn.start()
+	}
+}
+
+// waitFor 在超时之前反复检查条件
+func (tc *testRaftCluster) waitFor(what string, cond func() bool) {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(raftTick)
+	}
+	tc.t.Fatalf("timeout waiting for %s", what)
+}
+
+// leader 返回在线节点中唯一的 leader 没有或者有多个时返回空
+func (tc *testRaftCluster) leader() string {
+	leader := ""
+	var term uint64
+	for node, m := range tc.members {
+		if tc.network.down[node] {
+			continue
+		}
+		m.rn.mu.Lock()
+		isLeader, nodeTerm := m.rn.role == raftLeader, m.rn.term
+		m.rn.mu.Unlock()
+		if !isLeader {
+			continue
+		}
+		if leader != "" && nodeTerm == term {
+			return ""
+		}
+		if leader == "" || nodeTerm > term {
+			leader, term = node, nodeTerm
+		}
+	}
+	return leader
+}
+
+func (tc *testRaftCluster) waitLeader() string {
+	tc.t.Helper()
+	var leader string
+	tc.waitFor("leader election", func() bool {
+		tc.network.mu.Lock()
+		defer tc.network.mu.Unlock()
+		leader = tc.leader()
+		return leader != ""
+	})
+	return leader
+}
+
+func (tc *testRaftCluster) propose(cmd ...string) {
+	tc.t.Helper()
+	leader := tc.waitLeader()
+	if _, err := tc.members[leader].rn.propose(cmd); err != nil {
+		tc.t.Fatalf("propose %v on %s: %v", cmd, leader, err)
+	}
+}
+
+// waitApplied 等待节点应用的日志与 leader 一致
+func (tc *testRaftCluster) waitApplied(nodes ...string) {
+	tc.t.Helper()
+	leader := tc.waitLeader()
+	expected := tc.members[leader].appliedCmds()
+	for _, node := range nodes {
+		m := tc.members[node]
+		tc.waitFor(node+" catch up", func() bool {
+			return reflect.DeepEqual(m.appliedCmds(), expected)
+		})
+	}
+}
+
+func TestRaftElection(t *testing.T) {
+	tc := makeTestRaftCluster(t, 3)
+	tc.start()
+	first := tc.waitLeader()
+	tc.members[first].rn.mu.Lock()
+	firstTerm := tc.members[first].rn.term
+	tc.members[first].rn.mu.Unlock()
+
+	// leader 断开后其他两个节点选出新的 leader
+	tc.network.setDown(first, true)
+	var second string
+	tc.waitFor("re-election", func() bool {
+		tc.network.mu.Lock()
+		defer tc.network.mu.Unlock()
+		second = tc.leader()
+		return second != "" && second != first
+	})
+	tc.members[second].rn.mu.Lock()
+	secondTerm := tc.members[second].rn.term
+	tc.members[second].rn.mu.Unlock()
+	if secondTerm <= firstTerm {
+		t.Fatalf("new leader term %d should be greater than %d", secondTerm, firstTerm)
+	}
+
+	// 旧 leader 恢复后发现更大的 term 退位
+	tc.network.setDown(first, false)
+	old := tc.members[first].rn
+	tc.waitFor("old leader step down", func() bool {
+		old.mu.Lock()
+		defer old.mu.Unlock()
+		return old.role == raftFollower && old.term >= secondTerm
+	})
+}
+
+func TestRaftReplication(t *testing.T) {
+	tc := makeTestRaftCluster(t, 3)
+	tc.start()
+	for i := 0; i < 10; i++ {
+		tc.propose("setslot", strconv.Itoa(i), "node1")
+	}
+	tc.waitApplied("node1", "node2", "node3")
+
+	// 落后的 follower 重新连上后补齐日志
+	leader := tc.waitLeader()
+	lagging := "node1"
+	if lagging == leader {
+		lagging = "node2"
+	}
+	tc.network.setDown(lagging, true)
+	for i := 10; i < 20; i++ {
+		tc.propose("setslot", strconv.Itoa(i), "node2")
+	}
+	if n := len(tc.members[lagging].appliedCmds()); n >= len(tc.members[leader].appliedCmds()) {
+		t.Fatalf("disconnected node should not apply new entries")
+	}
+	tc.network.setDown(lagging, false)
+	tc.waitApplied("node1", "node2", "node3")
+
+	// 只剩一个节点时没有过半 提案不会提交
+	for node := range tc.members {
+		if node != leader {
+			tc.network.setDown(node, true)
+		}
+	}
+	if _, err := tc.members[leader].rn.propose([]string{"setslot", "100", "node3"}); err == nil {
+		t.Fatal("proposal without quorum should fail")
+	}
+}
+
+func TestRaftMembership(t *testing.T) {
+	tc := makeTestRaftCluster(t, 3)
+	tc.start()
+	tc.propose("setslot", "1", "node1")
+
+	// 新节点加入前清空日志 等待 leader 复制 期间不发起选举
+	node4 := tc.addMember("node4", []string{"node1", "node2", "node3", "node4"})
+	node4.rn.reset()
+	node4.rn.start()
+	tc.propose("addnode", "node4")
+	tc.propose("setslot", "2", "node4")
+	tc.waitApplied("node1", "node2", "node3", "node4")
+	leader := tc.waitLeader()
+	if peers := tc.members[leader].peers(); len(peers) != 4 {
+		t.Fatalf("expect 4 members, got %v", peers)
+	}
+
+	// 移除一个 follower 之后剩下的三个节点继续工作 被移除的节点不能打断 leader
+	removed := "node1"
+	if removed == leader {
+		removed = "node2"
+	}
+	tc.propose("delnode", removed)
+	rest := make([]string, 0, 3)
+	for node := range tc.members {
+		if node != removed {
+			rest = append(rest, node)
+		}
+	}
+	tc.waitApplied(rest...)
+	for _, node := range rest {
+		if peers := tc.members[node].peers(); containsNode(peers, removed) {
+			t.Fatalf("%s still has %s in members %v", node, removed, peers)
+		}
+	}
+	tc.propose("setslot", "3", "node3")
+	tc.waitApplied(rest...)
+	if got := tc.waitLeader(); got == removed {
+		t.Fatalf("removed node %s became leader", removed)
+	}
+}
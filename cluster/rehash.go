@@ -0,0 +1,296 @@
+package cluster
+
+import (
+	"context"
+	pool "github.com/jolestar/go-commons-pool/v2"
+	"go-redis/config"
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/consistenthash"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+一致性哈希模式下成员变化之后的在线搬迁
+CLUSTER MEET / FORGET 之后哈希环立即切换 但是 key 还在原来的节点上 直到原来的节点执行完 CLUSTER REBALANCE
+这段时间里每个节点记住变化之前的哈希环 两个环上归属不同的 key 处于迁移状态
+  请求先带着 ASKING 发给旧节点 旧节点有这些 key 就在本地执行 没有就用 LOCALEXEC 交给新节点执行
+  新节点收到这些 key 的普通请求时同样先转给旧节点 不会读不到数据 也不会把写入留在错误的节点
+  涉及多个节点的 DEL RENAME WATCH 和事务返回 TRYAGAIN
+已有的节点在处理 MEET / FORGET 时自己记录变化之前的环
+新加入的节点在认识其他节点的过程中看到的不是真正的变化 (joining) 由其他节点通过 CLUSTER REHASH BEGIN 告知
+被移除的节点通过 CLUSTER REHASH LEAVE 告知 之后它的环上不再有自己
+旧节点执行完 CLUSTER REBALANCE 之后广播 CLUSTER REHASH DONE 所有旧节点都完成后退出迁移状态
+迁移状态只保存在内存中 重启之后丢失
+*/
+
+// rehashState 成员变化之后 REBALANCE 完成之前的状态 由 cluster.mu 保护
+type rehashState struct {
+	prev    *consistenthash.NodeMap // 成员变化之前的环
+	pending map[string]bool         // 还没有执行完 REBALANCE 的旧节点
+	// pools 已经被移除但是还没有搬完的节点 仍然需要连接它查找 key
+	pools map[string]*pool.ObjectPool
+}
+
+func makeRehashState(prev *consistenthash.NodeMap) *rehashState {
+	state := &rehashState{
+		prev:    prev,
+		pending: make(map[string]bool),
+		pools:   make(map[string]*pool.ObjectPool),
+	}
+	for _, node := range prev.Nodes() {
+		state.pending[node] = true
+	}
+	return state
+}
+
+// rehashAfterMeet 加入节点之后调用 prev 是加入之前的环
+// alone 表示加入之前只有自己 这时没有数据的节点是被其他节点 MEET 的新节点 不自己记录迁移状态
+func (cluster *ClusterDatabase) rehashAfterMeet(prev *consistenthash.NodeMap, alone bool) {
+	if alone && !cluster.hasAnyKey() {
+		cluster.joining.Set(true)
+	}
+	if !cluster.joining.Get() {
+		cluster.beginRehash(prev)
+	}
+}
+
+// rehashAfterForget 移除节点之后调用 prev 是移除之前的环
+func (cluster *ClusterDatabase) rehashAfterForget(prev *consistenthash.NodeMap) {
+	if !cluster.joining.Get() {
+		cluster.beginRehash(prev)
+	}
+}
+
+func (cluster *ClusterDatabase) hasAnyKey() bool {
+	found := false
+	for dbIndex := 0; dbIndex < config.Properties.Databases && !found; dbIndex++ {
+		cluster.db.ForEach(dbIndex, func(key string, entity *database.DataEntity) bool {
+			found = true
+			return false
+		})
+	}
+	return found
+}
+
+// beginRehash 成员变化之后调用 prev 是变化之前的环 已经在迁移状态时保留最早的环
+func (cluster *ClusterDatabase) beginRehash(prev *consistenthash.NodeMap) {
+	if cluster.slots != nil {
+		return
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if cluster.rehash == nil {
+		cluster.rehash = makeRehashState(prev)
+	}
+}
+
+// rehashArgs 当前迁移状态下变化之前的环 格式为 node=weight 不在迁移状态时返回 nil
+func (cluster *ClusterDatabase) rehashArgs() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	if cluster.rehash == nil {
+		return nil
+	}
+	weights := cluster.rehash.prev.Weights()
+	args := make([]string, 0, len(weights))
+	for node, weight := range weights {
+		args = append(args, node+"="+strconv.Itoa(weight))
+	}
+	sort.Strings(args)
+	return args
+}
+
+// sendRehash 告诉新加入或者被移除的节点 变化之前的环是什么样的
+func (cluster *ClusterDatabase) sendRehash(node string, action string) {
+	args := cluster.rehashArgs()
+	if args == nil {
+		return
+	}
+	cluster.sendToNode(node, utils.ToCmdLine(append([]string{"CLUSTER", "REHASH", action}, args...)...))
+}
+
+// finishRehash 旧节点已经搬完 所有旧节点都完成后退出迁移状态
+func (cluster *ClusterDatabase) finishRehash(node string) {
+	cluster.mu.Lock()
+	if cluster.rehash == nil {
+		cluster.mu.Unlock()
+		return
+	}
+	delete(cluster.rehash.pending, node)
+	if len(cluster.rehash.pending) > 0 {
+		cluster.mu.Unlock()
+		return
+	}
+	pools := cluster.rehash.pools
+	cluster.rehash = nil
+	cluster.mu.Unlock()
+	for _, peerPool := range pools {
+		peerPool.Close(context.Background())
+	}
+	logger.Info("rehash finished")
+}
+
+// pendingNodes 还没有搬完的旧节点
+func (cluster *ClusterDatabase) pendingNodes() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	if cluster.rehash == nil {
+		return nil
+	}
+	nodes := make([]string, 0, len(cluster.rehash.pending))
+	for node := range cluster.rehash.pending {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// rehashPool 已经被移除但还没有搬完的节点的连接池
+func (cluster *ClusterDatabase) rehashPool(peer string) (*pool.ObjectPool, bool) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if cluster.rehash == nil || !cluster.rehash.pending[peer] {
+		return nil, false
+	}
+	peerPool, ok := cluster.rehash.pools[peer]
+	if !ok {
+		peerPool = newPeerPool(peer)
+		cluster.rehash.pools[peer] = peerPool
+	}
+	return peerPool, true
+}
+
+// movingSource key 在变化之前属于其他节点并且那个节点还没有搬完时 返回那个节点
+// 多个 key 在变化之前属于不同节点时返回 TRYAGAIN
+func (cluster *ClusterDatabase) movingSource(owner string, keys []string) (string, resp.Reply) {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	if cluster.rehash == nil {
+		return "", nil
+	}
+	source := ""
+	for i, key := range keys {
+		node := cluster.rehash.prev.PickNode(key)
+		if node == owner || !cluster.rehash.pending[node] {
+			node = ""
+		}
+		if i > 0 && node != source {
+			return "", makeTryAgainReply()
+		}
+		source = node
+	}
+	return source, nil
+}
+
+// checkRehash 涉及多个节点的命令不能在迁移中的 key 上执行
+func (cluster *ClusterDatabase) checkRehash(keys ...string) resp.Reply {
+	for _, key := range keys {
+		source, errReply := cluster.movingSource(cluster.pickNode(key), []string{key})
+		if errReply != nil {
+			return errReply
+		}
+		if source != "" {
+			return makeTryAgainReply()
+		}
+	}
+	return nil
+}
+
+func makeTryAgainReply() resp.Reply {
+	return reply.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of nodes")
+}
+
+// relayToOwner 把命令交给 key 所属的节点 迁移状态下先去旧节点查找
+func (cluster *ClusterDatabase) relayToOwner(c resp.Connection, owner string, keys []string, cmdArgs [][]byte) resp.Reply {
+	if c.IsAsking() {
+		// 其他节点因为迁移转过来的请求 最多再转发一次
+		return cluster.execOrHandOver(c, owner, keys, cmdArgs)
+	}
+	source, errReply := cluster.movingSource(owner, keys)
+	if errReply != nil {
+		return errReply
+	}
+	if source == "" {
+		return cluster.relay(owner, c, cmdArgs)
+	}
+	if source == cluster.self {
+		return cluster.execOrHandOver(c, owner, keys, cmdArgs)
+	}
+	return cluster.relayAsking(source, c, cmdArgs)
+}
+
+// execOrHandOver key 都在本地时在本地执行 都不在时交给新节点执行 只有一部分在本地时返回 TRYAGAIN
+func (cluster *ClusterDatabase) execOrHandOver(c resp.Connection, owner string, keys []string, cmdArgs [][]byte) resp.Reply {
+	if owner == cluster.self {
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	// 检查和执行之间一直持有 key 的锁 否则 REBALANCE 可能在中间把 key 搬走 执行时又在本地重新创建
+	dbIndex := c.GetDBIndex()
+	writeKeys, readKeys := cluster.db.GetRelatedKeys(cmdArgs)
+	cluster.db.RWLocks(dbIndex, writeKeys, readKeys)
+	exists := 0
+	for _, key := range keys {
+		if cluster.db.Exists(dbIndex, key) {
+			exists++
+		}
+	}
+	if exists == len(keys) {
+		defer cluster.db.RWUnLocks(dbIndex, writeKeys, readKeys)
+		return cluster.db.ExecWithLock(c, cmdArgs)
+	}
+	cluster.db.RWUnLocks(dbIndex, writeKeys, readKeys)
+	if exists == 0 {
+		return cluster.relayLocal(owner, c, cmdArgs)
+	}
+	return makeTryAgainReply()
+}
+
+// clusterRehash CLUSTER REHASH BEGIN|LEAVE node=weight ... / CLUSTER REHASH DONE node
+// 只允许其他节点使用 BEGIN 通知新加入的节点 LEAVE 通知被移除的节点 DONE 通知旧节点已经搬完
+func clusterRehash(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR CLUSTER REHASH is only allowed from cluster nodes")
+	}
+	if len(cmdArgs) < 4 {
+		return reply.MakeArgNumErrReply("cluster|rehash")
+	}
+	action := strings.ToLower(string(cmdArgs[2]))
+	if action == "done" {
+		if len(cmdArgs) != 4 {
+			return reply.MakeArgNumErrReply("cluster|rehash")
+		}
+		cluster.finishRehash(string(cmdArgs[3]))
+		return reply.MakeOkReply()
+	}
+	if action != "begin" && action != "leave" {
+		return reply.MakeSyntaxErrReply()
+	}
+	prev := consistenthash.NewNodeMap(config.Properties.VirtualNodes, nil)
+	for _, arg := range cmdArgs[3:] {
+		item := string(arg)
+		pivot := strings.LastIndex(item, "=")
+		weight := 0
+		if pivot >= 0 {
+			weight, _ = strconv.Atoi(item[pivot+1:])
+		}
+		if weight <= 0 || weight > consistenthash.MaxWeight {
+			return reply.MakeErrReply("ERR invalid node weight '" + item + "'")
+		}
+		prev.AddNodeWithWeight(item[:pivot], weight)
+	}
+	// 发起变更的节点给出的环为准 覆盖新节点在 MEET 过程中自己记录的状态
+	cluster.mu.Lock()
+	cluster.rehash = makeRehashState(prev)
+	cluster.mu.Unlock()
+	cluster.joining.Set(false)
+	if action == "leave" {
+		// 被移除的节点不再负责任何 key REBALANCE 会把所有 key 搬走
+		cluster.peerPicker.RemoveNode(cluster.self)
+	}
+	return reply.MakeOkReply()
+}
@@ -2,19 +2,88 @@ package cluster
 
 import (
 	"go-redis/interface/resp"
+	"go-redis/lib/utils"
 	"go-redis/resp/reply"
+	"strings"
 )
 
+// rename RENAME / RENAMENX  两个 key 在不同节点时通过 TCC 事务完成
 func rename(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
 	if len(cmdArgs) != 3 {
 		return reply.MakeErrReply("ERR wrong number args")
 	}
 	src := string(cmdArgs[1])
 	dest := string(cmdArgs[2])
+	if cluster.slots != nil {
+		if errReply := cluster.checkSlot(c, src, dest); errReply != nil {
+			return errReply
+		}
+		return cluster.db.Exec(c, cmdArgs)
+	}
 	srcPeer := cluster.peerPicker.PickNode(src)
 	destPeer := cluster.peerPicker.PickNode(dest)
-	if srcPeer != destPeer {
-		return reply.MakeErrReply("ERR rename must within on peer")
+	if srcPeer == destPeer {
+		return cluster.relayToOwner(c, srcPeer, []string{src, dest}, cmdArgs)
+	}
+	if errReply := cluster.checkRehash(src, dest); errReply != nil {
+		return errReply
+	}
+
+	isNx := strings.ToLower(string(cmdArgs[0])) == "renamenx"
+	toCmd := renameToCmd
+	if isNx {
+		toCmd = renameNxToCmd
+	}
+	txID := cluster.genTxID()
+	peers := []string{srcPeer, destPeer}
+	// 按节点地址的顺序准备 dest 所在节点在前时先锁住 dest 提交时再携带 src 的数据
+	destFirst := destPeer < srcPeer
+	if destFirst {
+		if ret := cluster.prepareRenameTo(c, txID, destPeer, toCmd, dest, nil); ret != nil {
+			cluster.requestRollback(c, txID, peers)
+			return ret
+		}
+	}
+	// 源节点准备 锁住 src 并返回它的数据
+	ret := cluster.relayTx(srcPeer, c, utils.ToCmdLine("Prepare", txID, renameFromCmd, src))
+	if reply.IsErrorReply(ret) {
+		cluster.requestRollback(c, txID, peers)
+		return ret
+	}
+	payload, ok := ret.(*reply.BulkReply)
+	if !ok {
+		cluster.requestRollback(c, txID, peers)
+		return reply.MakeErrReply("ERR invalid prepare reply from " + srcPeer)
+	}
+	var payloads map[string][]byte
+	if destFirst {
+		payloads = map[string][]byte{destPeer: payload.Arg}
+	} else if ret := cluster.prepareRenameTo(c, txID, destPeer, toCmd, dest, payload.Arg); ret != nil {
+		cluster.requestRollback(c, txID, peers)
+		return ret
+	}
+	if _, errReply := cluster.requestCommit(c, txID, peers, payloads); errReply != nil {
+		return errReply
+	}
+	if isNx {
+		return reply.MakeIntReply(1)
+	}
+	return reply.MakeOkReply()
+}
+
+// prepareRenameTo 目标节点准备 锁住 dest payload 为 nil 时由 Commit 携带
+// RENAMENX 的 dest 已经存在时返回 0 准备成功返回 nil
+func (cluster *ClusterDatabase) prepareRenameTo(c resp.Connection, txID string, destPeer string, toCmd string, dest string, payload []byte) resp.Reply {
+	cmdLine := utils.ToCmdLine("Prepare", txID, toCmd, dest)
+	if payload != nil {
+		cmdLine = append(cmdLine, payload)
+	}
+	ret := cluster.relayTx(destPeer, c, cmdLine)
+	if !reply.IsErrorReply(ret) {
+		return nil
+	}
+	if toCmd == renameNxToCmd && strings.HasPrefix(string(ret.ToBytes()), "-"+targetExistErr) {
+		return reply.MakeIntReply(0)
 	}
-	return cluster.relay(srcPeer, c, cmdArgs)
+	return ret
 }
@@ -0,0 +1,222 @@
+package cluster
+
+import (
+	"go-redis/config"
+	database2 "go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+只读副本
+node-replicas owner=replica,owner=replica2  副本是普通的单机实例 不参与集群
+owner 每执行一条写指令 就把它异步发给自己所有的副本 副本断开或积压太多时丢弃 不保证副本和 owner 完全一致
+客户端发送 READONLY 之后 只读指令(GET EXISTS TYPE ...) 按轮询发给 key 所属节点的副本 副本不可用时回到 owner
+READWRITE 恢复默认 所有指令都由 owner 执行
+*/
+
+const (
+	replicaQueueSize  = 1024
+	replicaRetryDelay = time.Second
+)
+
+// replicaCmd 发给副本的一条写指令
+type replicaCmd struct {
+	dbIndex int
+	cmdLine [][]byte
+}
+
+// replicaLink 本节点到一个副本的转发链路 只有一个协程使用 client
+type replicaLink struct {
+	addr    string
+	queue   chan *replicaCmd
+	client  *client.Client
+	dbIndex int       // 副本连接当前选择的库
+	retryAt time.Time // 连接失败后 在这之前到达的指令直接丢弃
+}
+
+// setupReplicas 读取 node-replicas 为所有副本建立连接池 并开始向本节点的副本转发写指令
+func (cluster *ClusterDatabase) setupReplicas() {
+	cluster.replicas = make(map[string][]string)
+	for _, item := range config.Properties.NodeReplicas {
+		item = strings.TrimSpace(item)
+		pivot := strings.LastIndex(item, "=")
+		if pivot <= 0 || pivot == len(item)-1 {
+			if item != "" {
+				logger.Warn("invalid node replica: " + item)
+			}
+			continue
+		}
+		owner, replica := item[:pivot], item[pivot+1:]
+		if containsNode(cluster.replicas[owner], replica) {
+			continue
+		}
+		cluster.replicas[owner] = append(cluster.replicas[owner], replica)
+		// 副本不是集群成员 只建立连接池 供读请求转发
+		cluster.mu.Lock()
+		if _, ok := cluster.peerConnection[replica]; !ok {
+			cluster.peerConnection[replica] = newPeerPool(replica)
+		}
+		cluster.mu.Unlock()
+	}
+	var links []*replicaLink
+	for _, replica := range cluster.replicas[cluster.self] {
+		link := &replicaLink{
+			addr:  replica,
+			queue: make(chan *replicaCmd, replicaQueueSize),
+		}
+		links = append(links, link)
+		go link.run(cluster.closeChan)
+	}
+	if len(links) == 0 {
+		return
+	}
+	cluster.db.AddWriteListener(func(dbIndex int, cmdLine database2.CmdLine) {
+		for _, link := range links {
+			select {
+			case link.queue <- &replicaCmd{dbIndex: dbIndex, cmdLine: cmdLine}:
+			default:
+				logger.Warn("replica " + link.addr + " queue is full, drop command " + string(cmdLine[0]))
+			}
+		}
+	})
+}
+
+// run 按顺序把写指令发给副本 直到集群关闭
+func (link *replicaLink) run(closeChan chan struct{}) {
+	for {
+		select {
+		case <-closeChan:
+			if link.client != nil {
+				link.client.Close()
+			}
+			return
+		case cmd := <-link.queue:
+			link.send(cmd)
+		}
+	}
+}
+
+// send 连接断开时重连一次 仍然失败就丢弃这条指令
+func (link *replicaLink) send(cmd *replicaCmd) {
+	for i := 0; i < 2; i++ {
+		if !link.connect() {
+			return
+		}
+		if cmd.dbIndex != link.dbIndex {
+			ret := link.client.Send(utils.ToCmdLine("SELECT", strconv.Itoa(cmd.dbIndex)))
+			if reply.IsErrorReply(ret) {
+				if link.client.IsBroken() {
+					continue
+				}
+				logger.Warn("replica " + link.addr + " select failed: " + strings.TrimSpace(string(ret.ToBytes())))
+				return
+			}
+			link.dbIndex = cmd.dbIndex
+		}
+		ret := link.client.Send(cmd.cmdLine)
+		if reply.IsErrorReply(ret) {
+			if link.client.IsBroken() {
+				continue
+			}
+			logger.Warn("replica " + link.addr + " exec " + string(cmd.cmdLine[0]) + " failed: " + strings.TrimSpace(string(ret.ToBytes())))
+		}
+		return
+	}
+}
+
+// connect 确保有可用的连接 重连之后副本回到 0 号库
+func (link *replicaLink) connect() bool {
+	if link.client != nil && !link.client.IsBroken() {
+		return true
+	}
+	if link.client != nil {
+		link.client.Close()
+		link.client = nil
+	}
+	if time.Now().Before(link.retryAt) {
+		return false
+	}
+	c, err := makePeerClient(link.addr)
+	if err != nil {
+		logger.Warn("connect replica " + link.addr + " failed: " + err.Error())
+		link.retryAt = time.Now().Add(replicaRetryDelay)
+		return false
+	}
+	link.client = c
+	link.dbIndex = 0
+	return true
+}
+
+// pickReplica 轮询选择节点的一个副本 没有副本时返回空
+func (cluster *ClusterDatabase) pickReplica(node string) string {
+	replicas := cluster.replicas[node]
+	if len(replicas) == 0 {
+		return ""
+	}
+	i := atomic.AddUint32(&cluster.replicaCursor, 1)
+	return replicas[int(i)%len(replicas)]
+}
+
+// readFromReplica 只读指令发给副本 副本不可用时由 owner 执行
+func (cluster *ClusterDatabase) readFromReplica(owner string, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	replica := cluster.pickReplica(owner)
+	if replica == "" {
+		return cluster.relay(owner, c, cmdArgs)
+	}
+	peerClient, err := cluster.GetPeerClient(replica)
+	if err != nil {
+		return cluster.relay(owner, c, cmdArgs)
+	}
+	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex())))
+	ret := peerClient.Send(cmdArgs)
+	_ = cluster.returnPeerClient(replica, peerClient)
+	if peerClient.IsBroken() || isTimeoutReply(ret) {
+		return cluster.relay(owner, c, cmdArgs)
+	}
+	return ret
+}
+
+// isTimeoutReply 客户端等待回复超时或请求失败
+func isTimeoutReply(ret resp.Reply) bool {
+	errReply, ok := ret.(*reply.StandardErrReply)
+	return ok && (errReply.Status == "server time out" || errReply.Status == "request failed")
+}
+
+// execReadOnly READONLY 之后只读指令可以发给副本
+func execReadOnly(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("readonly")
+	}
+	c.SetReadOnly(true)
+	return reply.MakeOkReply()
+}
+
+// execReadWrite READWRITE 所有指令都由 owner 执行
+func execReadWrite(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("readwrite")
+	}
+	c.SetReadOnly(false)
+	return reply.MakeOkReply()
+}
+
+// clusterReplicas CLUSTER REPLICAS node 列出节点的副本
+func clusterReplicas(cluster *ClusterDatabase, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 3 {
+		return reply.MakeArgNumErrReply("cluster|replicas")
+	}
+	replicas := cluster.replicas[string(cmdArgs[2])]
+	result := make([][]byte, 0, len(replicas))
+	for _, replica := range replicas {
+		result = append(result, []byte(replica))
+	}
+	return reply.MakeMultiBulkReply(result)
+}
@@ -1,27 +1,97 @@
 package cluster
 
-import "go-redis/interface/resp"
+import (
+	database2 "go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+)
 
 func makeRouter() map[string]CmdFunc {
 	routerMap := make(map[string]CmdFunc)
-	routerMap["exists"] = defaultFunc
-	routerMap["type"] = defaultFunc
-	routerMap["set"] = defaultFunc
-	routerMap["setnx"] = defaultFunc
-	routerMap["get"] = defaultFunc
-	routerMap["getset"] = defaultFunc
 	routerMap["ping"] = ping
 	routerMap["rename"] = rename
 	routerMap["renamenx"] = rename
 	routerMap["flushdb"] = flushdb
 	routerMap["del"] = Del
 	routerMap["select"] = execSelect
+	routerMap["cluster"] = execCluster
+	routerMap["asking"] = execAsking
+	routerMap["restore-asking"] = restoreAsking
+	routerMap["migrate"] = localFunc
+	routerMap["localexec"] = execLocalExec
+	routerMap["keys"] = execKeys
+	routerMap["scan"] = execScan
+	routerMap["dbsize"] = execDBSize
+	routerMap["randomkey"] = execRandomKey
+	routerMap["prepare"] = execPrepare
+	routerMap["commit"] = execCommit
+	routerMap["rollback"] = execRollback
+	routerMap["multi"] = execMulti
+	routerMap["exec"] = execExec
+	routerMap["discard"] = execDiscard
+	routerMap["watch"] = execWatch
+	routerMap["unwatch"] = execUnwatch
+	routerMap["getver"] = execGetVer
+	routerMap["execbatch"] = execExecBatch
+	routerMap["raft"] = execRaft
+	routerMap["readonly"] = execReadOnly
+	routerMap["readwrite"] = execReadWrite
+	routerMap["hello"] = localFunc
+	routerMap["auth"] = localFunc
+	routerMap["acl"] = localFunc
+	routerMap["client"] = localFunc
+	routerMap["info"] = localFunc
+	routerMap["config"] = localFunc
+	routerMap["slowlog"] = localFunc
 
 	return routerMap
 }
 
+// defaultFunc 数据库指令的默认处理 按 key 找到所属节点 READONLY 的客户端只读指令可以发给副本
+// 路由表里没有的数据库指令都由它处理 指令是读还是写由 database 的指令表决定
 func defaultFunc(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
-	key := string(cmdArgs[1])
-	peer := cluster.peerPicker.PickNode(key)
-	return cluster.relay(peer, c, cmdArgs)
+	writeKeys, readKeys := cluster.db.GetRelatedKeys(cmdArgs)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 {
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	cmdName := string(cmdArgs[0])
+	if cluster.slots != nil {
+		// 槽位模式不转发 不在本节点就让客户端重定向
+		if errReply := cluster.checkSlot(c, keys...); errReply != nil {
+			return errReply
+		}
+		if c.IsReadOnly() && database2.IsReadOnlyCommand(cmdName) {
+			return cluster.readFromReplica(cluster.self, c, cmdArgs)
+		}
+		return cluster.db.Exec(c, cmdArgs)
+	}
+	peer := cluster.peerPicker.PickNode(keys[0])
+	// 只能整条转发给一个节点 key 分布在不同节点时拒绝执行 与槽位模式的 CROSSSLOT 一致
+	for _, key := range keys[1:] {
+		if cluster.peerPicker.PickNode(key) != peer {
+			return reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same node")
+		}
+	}
+	if c.IsReadOnly() && database2.IsReadOnlyCommand(cmdName) && cluster.checkRehash(keys...) == nil {
+		return cluster.readFromReplica(peer, c, cmdArgs)
+	}
+	return cluster.relayToOwner(c, peer, keys, cmdArgs)
+}
+
+// localFunc 只在本节点执行的命令
+func localFunc(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	return cluster.db.Exec(c, cmdArgs)
+}
+
+// execLocalExec LOCALEXEC cmd args... 其他节点广播过来的命令 只在本节点执行
+func execLocalExec(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("localexec")
+	}
+	// 不经过路由直接在本地执行 只允许其他节点使用 里面的命令照常检查 ACL
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR LOCALEXEC is only allowed from cluster nodes")
+	}
+	return cluster.db.Exec(c, cmdArgs[1:])
 }
@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"go-redis/interface/resp"
+	"go-redis/lib/crc16"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+槽位模式
+16384 个槽位平均分给所有节点 每个节点根据相同的配置算出相同的分配结果
+key 不在本节点时返回 MOVED 让支持集群的客户端直接去找对应节点
+*/
+
+// SlotCount 槽位总数
+const SlotCount = 16384
+
+// getSlot 计算 key 的槽位 支持 {tag} 让多个 key 落在同一个槽位
+func getSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16.Checksum([]byte(key))) % SlotCount
+}
+
+// nodeID 根据节点地址生成 40 位的节点 ID 所有节点算出来的结果一致
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// slotRange 一段连续的槽位 [start, end]
+type slotRange struct {
+	start int
+	end   int
+	node  string
+}
+
+// slotTable 记录每个槽位属于哪个节点 以及正在迁移的槽位
+type slotTable struct {
+	mu        sync.RWMutex
+	owners    []string
+	migrating map[int]string // 本节点正在迁出的槽位 -> 目标节点
+	importing map[int]string // 本节点正在导入的槽位 -> 源节点
+}
+
+// makeSlotTable 节点排序后平均分配槽位 保证每个节点的分配相同
+func makeSlotTable(nodes []string) *slotTable {
+	sorted := make([]string, len(nodes))
+	copy(sorted, nodes)
+	sort.Strings(sorted)
+	table := &slotTable{
+		owners:    make([]string, SlotCount),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+	for i, node := range sorted {
+		start := i * SlotCount / len(sorted)
+		end := (i + 1) * SlotCount / len(sorted)
+		for slot := start; slot < end; slot++ {
+			table.owners[slot] = node
+		}
+	}
+	return table
+}
+
+// makeSlotTableFromOwners 从 nodes.conf 中恢复槽位分配
+func makeSlotTableFromOwners(owners []string) *slotTable {
+	return &slotTable{
+		owners:    owners,
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+}
+
+// nodeOwnsSlots 节点是否还负责槽位
+func (t *slotTable) nodeOwnsSlots(node string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, owner := range t.owners {
+		if owner == node {
+			return true
+		}
+	}
+	return false
+}
+
+// owner 返回槽位所属节点
+func (t *slotTable) owner(slot int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.owners[slot]
+}
+
+// setOwner 槽位迁移完成 确定新的归属 同时清除迁移状态
+func (t *slotTable) setOwner(slot int, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.owners[slot] = node
+	delete(t.migrating, slot)
+	delete(t.importing, slot)
+}
+
+// setOwners 整体替换槽位分配 Raft 应用拓扑快照时使用
+func (t *slotTable) setOwners(owners []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	copy(t.owners, owners)
+	t.migrating = make(map[int]string)
+	t.importing = make(map[int]string)
+}
+
+// setMigrating 标记槽位正在迁往 target
+func (t *slotTable) setMigrating(slot int, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.migrating[slot] = target
+}
+
+// setImporting 标记槽位正在从 source 导入
+func (t *slotTable) setImporting(slot int, source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.importing[slot] = source
+}
+
+// setStable 取消槽位的迁移状态
+func (t *slotTable) setStable(slot int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.migrating, slot)
+	delete(t.importing, slot)
+}
+
+func (t *slotTable) migratingTo(slot int) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	target, ok := t.migrating[slot]
+	return target, ok
+}
+
+func (t *slotTable) importingFrom(slot int) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	source, ok := t.importing[slot]
+	return source, ok
+}
+
+// ranges 把槽位合并为连续的区间
+func (t *slotTable) ranges() []*slotRange {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make([]*slotRange, 0)
+	var current *slotRange
+	for slot, node := range t.owners {
+		if current != nil && current.node == node && current.end == slot-1 {
+			current.end = slot
+			continue
+		}
+		if node == "" {
+			current = nil
+			continue
+		}
+		current = &slotRange{start: slot, end: slot, node: node}
+		result = append(result, current)
+	}
+	return result
+}
+
+// checkSlot 槽位模式下检查 key 是否都在本节点
+// 返回 nil 表示可以在本地执行
+// 槽位迁出时 本地已经没有的 key 返回 ASK  槽位导入时 ASKING 之后的命令可以在本地执行
+func (cluster *ClusterDatabase) checkSlot(c resp.Connection, keys ...string) resp.Reply {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := getSlot(keys[0])
+	for _, key := range keys[1:] {
+		if getSlot(key) != slot {
+			return reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	owner := cluster.slots.owner(slot)
+	if owner == cluster.self {
+		if target, ok := cluster.slots.migratingTo(slot); ok {
+			for _, key := range keys {
+				if !cluster.db.Exists(c.GetDBIndex(), key) {
+					return makeAskReply(slot, target)
+				}
+			}
+		}
+		return nil
+	}
+	if _, ok := cluster.slots.importingFrom(slot); ok && c.IsAsking() {
+		return nil
+	}
+	if cluster.health.isFailed(owner) {
+		return makeClusterDownReply(owner)
+	}
+	return makeMovedReply(slot, owner)
+}
+
+// makeMovedReply 槽位已经确定属于其他节点
+func makeMovedReply(slot int, addr string) resp.Reply {
+	return reply.MakeErrReply("MOVED " + strconv.Itoa(slot) + " " + addr)
+}
+
+// makeAskReply 槽位正在迁移 只有这一次请求去目标节点
+func makeAskReply(slot int, addr string) resp.Reply {
+	return reply.MakeErrReply("ASK " + strconv.Itoa(slot) + " " + addr)
+}
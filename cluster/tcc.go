@@ -0,0 +1,343 @@
+package cluster
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+跨节点的分布式事务 TCC (Try-Confirm-Cancel)
+协调者生成事务 ID 向每个参与的节点发送 Prepare txID cmd args...
+参与者在 Prepare 时锁住相关的 key 校验指令并记录回滚日志 然后一直持有锁
+协调者按节点地址的顺序逐个 Prepare 每个节点内按 key 的锁序号加锁 所以所有事务以相同的全局顺序加锁
+两个事务涉及相同的 key 时后来的只会等待 不会互相持有对方需要的锁直到超时
+全部 Prepare 成功后发送 Commit 执行指令并释放锁 Prepare 失败时向所有节点发送 Rollback
+已经提交的事务拒绝 Rollback 否则回滚日志会覆盖提交之后其他客户端的写入
+参与者超过 maxLockTime 没有等到 Commit 或 Rollback 时自动回滚 防止协调者宕机后 key 一直被锁
+*/
+
+// maxLockTime 要比协调者依次准备其他节点再提交的时间长 每个请求最多等待 requestTimeout
+// 否则协调者还在等待其他节点时 先准备好的节点已经自动回滚 事务只能失败
+func maxLockTime() time.Duration {
+	return 4 * requestTimeout()
+}
+
+const (
+	txPrepared   = 1
+	txCommitted  = 2
+	txRolledBack = 3
+
+	// 跨节点 RENAME 的两个步骤 只在 Prepare 中使用
+	renameFromCmd  = "renamefrom" // RenameFrom src 准备时返回 src 的 DUMP 数据 提交时删除 src
+	renameToCmd    = "renameto"   // RenameTo dest [payload] 提交时用 RESTORE 写入 dest 准备时没有 payload 则由 Commit 携带
+	renameNxToCmd  = "renamenxto" // RenameNxTo dest [payload] 与 RenameTo 相同 但 dest 已存在时准备失败
+	targetExistErr = "ERR target key name already exists"
+
+	// 跨节点 MULTI 中属于本节点的一批指令 ExecBatch nWatch key version ... payload
+	execBatchCmd    = "execbatch"
+	watchChangedErr = "EXECABORT watched keys changed"
+)
+
+// Transaction 参与者一侧的事务
+type Transaction struct {
+	id       string
+	cmdLines [][][]byte        // 提交时执行的指令
+	watching map[string]uint32 // ExecBatch 中 WATCH 的 key 和版本
+	batch    bool              // ExecBatch 提交时返回每条指令的结果
+	// needPayload RenameTo 准备时还不知道 src 的数据 提交时由 Commit 携带
+	needPayload bool
+	cluster     *ClusterDatabase
+	conn        resp.Connection // 记录事务使用的 DB
+	writeKeys   []string
+	readKeys    []string
+	undoLog     [][][]byte
+	status      int8
+	mu          sync.Mutex
+	timer       *time.Timer
+}
+
+// txSeq 生成事务 ID 的序号
+var txSeq int64
+
+func (cluster *ClusterDatabase) genTxID() string {
+	return cluster.self + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" +
+		strconv.FormatInt(atomic.AddInt64(&txSeq, 1), 10)
+}
+
+// prepare 加锁 校验 记录回滚日志 返回 nil 表示准备成功
+func (tx *Transaction) prepare() resp.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	db := tx.cluster.db
+	dbIndex := tx.conn.GetDBIndex()
+
+	// 把跨节点 RENAME 的步骤转换为真正要执行的指令
+	var result resp.Reply = reply.MakeOkReply()
+	original := tx.cmdLines[0]
+	name := strings.ToLower(string(original[0]))
+	switch name {
+	case renameFromCmd:
+		if len(original) != 2 {
+			return reply.MakeArgNumErrReply(name)
+		}
+		tx.cmdLines = [][][]byte{utils.ToCmdLine2("DEL", original[1])}
+	case renameToCmd, renameNxToCmd:
+		if len(original) != 2 && len(original) != 3 {
+			return reply.MakeArgNumErrReply(name)
+		}
+		var payload []byte
+		if len(original) == 3 {
+			payload = original[2]
+		} else {
+			tx.needPayload = true
+		}
+		tx.cmdLines = [][][]byte{utils.ToCmdLine2("RESTORE", original[1], []byte("0"), payload, []byte("REPLACE"))}
+	case execBatchCmd:
+		watching, cmdLines, err := decodeBatch(original[1:])
+		if err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		tx.watching, tx.cmdLines, tx.batch = watching, cmdLines, true
+	}
+
+	tx.writeKeys, tx.readKeys = db.GetRelatedKeysOfCmdLines(tx.cmdLines, tx.watching)
+	db.RWLocks(dbIndex, tx.writeKeys, tx.readKeys)
+	switch name {
+	case renameFromCmd:
+		result = db.ExecWithLock(tx.conn, utils.ToCmdLine2("DUMP", original[1]))
+		if bulk, ok := result.(*reply.BulkReply); !ok || bulk.Arg == nil {
+			result = reply.MakeErrReply("ERR no such key")
+		}
+	case renameNxToCmd:
+		if db.Exists(dbIndex, string(original[1])) {
+			result = reply.MakeErrReply(targetExistErr)
+		}
+	case execBatchCmd:
+		if db.IsWatchingChanged(dbIndex, tx.watching) {
+			result = reply.MakeErrReply(watchChangedErr)
+		}
+	}
+	if reply.IsErrorReply(result) {
+		db.RWUnLocks(dbIndex, tx.writeKeys, tx.readKeys)
+		return result
+	}
+	// 每条指令的回滚日志都基于执行前的数据 倒序执行后恢复到事务之前的状态
+	for _, cmdLine := range tx.cmdLines {
+		tx.undoLog = append(tx.undoLog, db.GetUndoLogs(dbIndex, cmdLine)...)
+	}
+	tx.status = txPrepared
+	tx.timer = time.AfterFunc(maxLockTime(), func() {
+		tx.mu.Lock()
+		prepared := tx.status == txPrepared
+		tx.mu.Unlock()
+		if prepared {
+			logger.Warn("transaction " + tx.id + " timeout, rollback")
+			tx.rollback()
+		}
+	})
+	return result
+}
+
+// commit 执行指令并释放锁 执行失败时按回滚日志恢复 payload 是 RenameTo 准备时缺少的数据
+func (tx *Transaction) commit(payload []byte) resp.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != txPrepared {
+		return reply.MakeErrReply("ERR transaction " + tx.id + " is not prepared")
+	}
+	if tx.needPayload {
+		if payload == nil {
+			return reply.MakeErrReply("ERR transaction " + tx.id + " needs payload to commit")
+		}
+		tx.cmdLines[0][3] = payload
+	}
+	tx.timer.Stop()
+	db := tx.cluster.db
+	var result resp.Reply
+	if tx.batch {
+		// 与 Redis 的 MULTI 一致 单条指令失败不回滚其他指令
+		results := make([]resp.Reply, 0, len(tx.cmdLines))
+		for _, cmdLine := range tx.cmdLines {
+			results = append(results, db.ExecWithLock(tx.conn, cmdLine))
+		}
+		result = reply.MakeMultiRawReply(results)
+	} else {
+		result = db.ExecWithLock(tx.conn, tx.cmdLines[0])
+	}
+	if reply.IsErrorReply(result) {
+		tx.execUndoLog()
+		tx.status = txRolledBack
+	} else {
+		tx.status = txCommitted
+	}
+	db.RWUnLocks(tx.conn.GetDBIndex(), tx.writeKeys, tx.readKeys)
+	// 保留一段时间 迟到的 Rollback 能够得到已经提交的回复
+	time.AfterFunc(maxLockTime(), func() {
+		tx.cluster.transactions.Remove(tx.id)
+	})
+	return result
+}
+
+// rollback 恢复数据并释放锁 已经提交的事务拒绝回滚
+func (tx *Transaction) rollback() resp.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	db := tx.cluster.db
+	dbIndex := tx.conn.GetDBIndex()
+	switch tx.status {
+	case txPrepared:
+		tx.timer.Stop()
+		tx.execUndoLog()
+		db.RWUnLocks(dbIndex, tx.writeKeys, tx.readKeys)
+	case txCommitted:
+		return reply.MakeErrReply("ERR transaction " + tx.id + " is already committed")
+	}
+	tx.status = txRolledBack
+	tx.cluster.transactions.Remove(tx.id)
+	return reply.MakeOkReply()
+}
+
+// execUndoLog 调用方持有 key 的锁
+func (tx *Transaction) execUndoLog() {
+	for i := len(tx.undoLog) - 1; i >= 0; i-- {
+		ret := tx.cluster.db.ExecWithLock(tx.conn, tx.undoLog[i])
+		if reply.IsErrorReply(ret) {
+			logger.Error("transaction " + tx.id + " rollback failed: " + string(ret.ToBytes()))
+		}
+	}
+}
+
+// execPrepare Prepare txID cmd args...
+func execPrepare(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR PREPARE is only allowed from cluster nodes")
+	}
+	if len(cmdArgs) < 3 {
+		return reply.MakeArgNumErrReply("prepare")
+	}
+	conn := connection.NewInternalConn()
+	conn.SelectDB(c.GetDBIndex())
+	tx := &Transaction{
+		id:       string(cmdArgs[1]),
+		cmdLines: [][][]byte{cmdArgs[2:]},
+		cluster:  cluster,
+		conn:     conn,
+	}
+	result := tx.prepare()
+	if !reply.IsErrorReply(result) {
+		cluster.transactions.Put(tx.id, tx)
+	}
+	return result
+}
+
+// execCommit Commit txID [payload]
+func execCommit(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR COMMIT is only allowed from cluster nodes")
+	}
+	if len(cmdArgs) != 2 && len(cmdArgs) != 3 {
+		return reply.MakeArgNumErrReply("commit")
+	}
+	raw, ok := cluster.transactions.Get(string(cmdArgs[1]))
+	if !ok {
+		return reply.MakeErrReply("ERR transaction " + string(cmdArgs[1]) + " not found")
+	}
+	var payload []byte
+	if len(cmdArgs) == 3 {
+		payload = cmdArgs[2]
+	}
+	return raw.(*Transaction).commit(payload)
+}
+
+// execRollback Rollback txID  事务不存在时说明没有准备成功或已经回滚 直接返回成功
+func execRollback(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if !cluster.isPeerConn(c) {
+		return reply.MakeErrReply("ERR ROLLBACK is only allowed from cluster nodes")
+	}
+	if len(cmdArgs) != 2 {
+		return reply.MakeArgNumErrReply("rollback")
+	}
+	raw, ok := cluster.transactions.Get(string(cmdArgs[1]))
+	if !ok {
+		return reply.MakeOkReply()
+	}
+	return raw.(*Transaction).rollback()
+}
+
+// relayTx 发送事务指令 本节点直接走集群的路由
+// 事务指令只接受其他节点的连接 本节点作为参与者时同样使用内部连接 而不是客户端的连接
+func (cluster *ClusterDatabase) relayTx(peer string, c resp.Connection, args [][]byte) resp.Reply {
+	if peer == cluster.self {
+		conn := connection.NewInternalConn()
+		conn.SelectDB(c.GetDBIndex())
+		switch strings.ToLower(string(args[0])) {
+		case "prepare":
+			return execPrepare(cluster, conn, args)
+		case "commit":
+			return execCommit(cluster, conn, args)
+		case "rollback":
+			return execRollback(cluster, conn, args)
+		}
+	}
+	return cluster.relay(peer, c, args)
+}
+
+// requestPrepare 按节点地址的顺序逐个让参与者准备自己的指令 任何一个失败则停止并全部回滚
+// 所有协调者以相同的顺序加锁 涉及相同 key 的事务不会互相等待到超时
+func (cluster *ClusterDatabase) requestPrepare(c resp.Connection, txID string, cmdLines map[string][][]byte) broadcastReplies {
+	peers := make([]string, 0, len(cmdLines))
+	for peer := range cmdLines {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	replies := make(broadcastReplies, len(peers))
+	for _, peer := range peers {
+		ret := cluster.relayTx(peer, c, append(utils.ToCmdLine("Prepare", txID), cmdLines[peer]...))
+		replies[peer] = ret
+		if reply.IsErrorReply(ret) {
+			cluster.requestRollback(c, txID, peers)
+			break
+		}
+	}
+	return replies
+}
+
+// requestRollback 通知所有参与者回滚
+func (cluster *ClusterDatabase) requestRollback(c resp.Connection, txID string, peers []string) {
+	replies := cluster.fanOut(peers, func(peer string) resp.Reply {
+		return cluster.relayTx(peer, c, utils.ToCmdLine("Rollback", txID))
+	})
+	for peer, reason := range replies.failures() {
+		logger.Error("rollback transaction " + txID + " on " + peer + " failed: " + reason)
+	}
+}
+
+// requestCommit 通知所有参与者提交 结果与 peers 的顺序一致 payloads 是某些节点 Commit 需要携带的数据
+// 提交失败的节点已经按回滚日志恢复 还没有提交的节点回滚 已经提交的节点拒绝回滚
+func (cluster *ClusterDatabase) requestCommit(c resp.Connection, txID string, peers []string, payloads map[string][]byte) ([]resp.Reply, resp.Reply) {
+	replies := cluster.fanOut(peers, func(peer string) resp.Reply {
+		args := utils.ToCmdLine("Commit", txID)
+		if payload, ok := payloads[peer]; ok {
+			args = append(args, payload)
+		}
+		return cluster.relayTx(peer, c, args)
+	})
+	if errReply := replies.errReply(); errReply != nil {
+		cluster.requestRollback(c, txID, peers)
+		return nil, errReply
+	}
+	results := make([]resp.Reply, 0, len(peers))
+	for _, peer := range peers {
+		results = append(results, replies[peer])
+	}
+	return results, nil
+}
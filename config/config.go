@@ -22,28 +22,89 @@ type ServerProperties struct {
 	Port           int    `cfg:"port"`
 	AppendOnly     bool   `cfg:"appendOnly"`
 	AppendFilename string `cfg:"appendFilename"`
-	MaxClients     int    `cfg:"maxclients"`
+	MaxClients     int    `cfg:"maxclients"` // 大于 0 时 超过这个数量的新连接收到错误后被关闭
 	RequirePass    string `cfg:"requirepass"`
 	Databases      int    `cfg:"databases"` // 映射全局 config 文件 16
+	// Timeout 客户端空闲超过这么多秒后关闭连接 0 表示不关闭
+	// TCPKeepAlive TCP 保活探测的间隔 秒 0 使用 Go 的默认值 15 秒 小于 0 关闭保活
+	Timeout      int `cfg:"timeout"`
+	TCPKeepAlive int `cfg:"tcp-keepalive"`
+	// ProtoMaxBulkLen 单个参数的最大长度 默认 512mb ClientQueryBufferLimit 一条命令的最大长度 默认 1gb
+	// 超过限制的客户端收到协议错误后被断开 可以写作 512mb 这样的单位
+	ProtoMaxBulkLen        int `cfg:"proto-max-bulk-len"`
+	ClientQueryBufferLimit int `cfg:"client-query-buffer-limit"`
+	// AclFile 保存 ACL 用户的文件 启动时加载 ACL SAVE 写回 AclLogMaxLen ACL LOG 最多保留的记录 默认 128
+	AclFile      string `cfg:"aclfile"`
+	AclLogMaxLen int    `cfg:"acllog-max-len"`
+	// MasterUser MasterAuth 集群节点之间 以及向副本转发时使用的用户和密码 没有设置 MasterAuth 时使用 requirepass
+	MasterUser string `cfg:"masteruser"`
+	MasterAuth string `cfg:"masterauth"`
+	// TLSPort 大于 0 时在这个端口同时提供 TLS 服务 此时 port 为 0 表示不监听明文端口
+	// TLSAuthClients yes(默认) 要求客户端证书 optional 提供了才校验 no 不要求 校验客户端证书需要 TLSCACertFile
+	TLSPort        int    `cfg:"tls-port"`
+	TLSCertFile    string `cfg:"tls-cert-file"`
+	TLSKeyFile     string `cfg:"tls-key-file"`
+	TLSCACertFile  string `cfg:"tls-ca-cert-file"`
+	TLSAuthClients string `cfg:"tls-auth-clients"`
+	// TLSCluster 连接其他节点 副本和 MIGRATE 的目标时使用 TLS 并出示 tls-cert-file 的证书 此时 self 和 peers 应该写 TLS 端口
+	TLSCluster bool `cfg:"tls-cluster"`
+	// UnixSocket 同时在这个路径上监听 Unix 域套接字 UnixSocketPerm 是套接字文件的权限 八进制 例如 700
+	UnixSocket     string `cfg:"unixsocket"`
+	UnixSocketPerm string `cfg:"unixsocketperm"`
 
 	Peers []string `cfg:"peers"`
 	Self  string   `cfg:"self"`
+	// ClusterEnabled 只配置了 self 没有 peers 时 打开才以集群模式启动 之后通过 CLUSTER MEET 加入其他节点
+	ClusterEnabled bool `cfg:"cluster-enabled"`
+	// ClusterMode 集群模式 proxy(默认) 由节点转发命令 slot 按 16384 个槽位返回 MOVED 让客户端直连
+	ClusterMode string `cfg:"cluster-mode"`
+	// VirtualNodes 一致性哈希中每个节点的虚拟节点数量 默认 1 和之前的版本相同 配置为 160 之类的值 key 分布更均匀
+	// 修改后 key 的归属会变化 所有节点使用新的配置重启后 每个节点都要执行一次 CLUSTER REBALANCE 把 key 搬到新的节点
+	// NodeWeights 格式为 host:port=weight 权重 1 到 100 只对集群中已有的节点生效
+	VirtualNodes int      `cfg:"virtual-nodes"`
+	NodeWeights  []string `cfg:"node-weights"`
+	// ClusterConfigFile 持久化集群成员和槽位分配 默认 nodes.conf
+	// 文件存在时成员和槽位以它为准 peers 只在第一次启动时使用 修改 peers 后需要删除这个文件才能生效
+	ClusterConfigFile string `cfg:"cluster-config-file"`
+	// ClusterNodeTimeout 毫秒 默认 15000 节点超过这个时间没有回应就认为疑似下线
+	// 同时也是转发 广播和分布式事务等待其他节点回复的最长时间
+	ClusterNodeTimeout int `cfg:"cluster-node-timeout"`
+	// ClusterRaft 开启后成员和槽位的修改通过 Raft 日志在所有节点上按相同顺序生效 日志保存在 ClusterRaftFile 默认 raft.conf
+	ClusterRaft     bool   `cfg:"cluster-raft"`
+	ClusterRaftFile string `cfg:"cluster-raft-file"`
+	// NodeReplicas 格式为 owner=replica 多个副本重复写 owner 副本是普通的单机实例 owner 执行的写指令异步转发给它
+	NodeReplicas []string `cfg:"node-replicas"`
+	// SlowlogLogSlowerThan 执行时间超过这么多微秒的命令记入 SLOWLOG 0 记录所有命令 小于 0 关闭
+	// SlowlogMaxLen SLOWLOG 最多保留的记录 超过时丢弃最旧的
+	SlowlogLogSlowerThan int `cfg:"slowlog-log-slower-than"`
+	SlowlogMaxLen        int `cfg:"slowlog-max-len"`
 }
 
+// 没有写在配置文件中时使用的默认值 0 对这些配置项有意义 不能用零值表示默认
+const (
+	DefaultSlowlogLogSlowerThan = 10000
+	DefaultSlowlogMaxLen        = 128
+)
+
 // Properties holds global config properties
 var Properties *ServerProperties
 
 func init() {
 	// default config
 	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
+		Bind:                 "127.0.0.1",
+		Port:                 6379,
+		AppendOnly:           false,
+		SlowlogLogSlowerThan: DefaultSlowlogLogSlowerThan,
+		SlowlogMaxLen:        DefaultSlowlogMaxLen,
 	}
 }
 
 func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+	config := &ServerProperties{
+		SlowlogLogSlowerThan: DefaultSlowlogLogSlowerThan,
+		SlowlogMaxLen:        DefaultSlowlogMaxLen,
+	}
 
 	// read config file
 	rawMap := make(map[string]string)
@@ -82,7 +143,7 @@ func parse(src io.Reader) *ServerProperties {
 			case reflect.String:
 				fieldVal.SetString(value)
 			case reflect.Int:
-				intValue, err := strconv.ParseInt(value, 10, 64)
+				intValue, err := parseInt(value)
 				if err == nil {
 					fieldVal.SetInt(intValue)
 				}
@@ -100,6 +161,33 @@ func parse(src io.Reader) *ServerProperties {
 	return config
 }
 
+// parseInt 整数可以带内存单位 k kb m mb g gb 不区分大小写 k 是 1000 kb 是 1024
+func parseInt(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		unit   int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+	lower := strings.ToLower(value)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSuffix(lower, u.suffix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return n * u.unit, nil
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// IsCluster 是否以集群模式启动 同时配置了 self 和 peers 或者打开了 cluster-enabled
+func IsCluster() bool {
+	return Properties.Self != "" && (len(Properties.Peers) > 0 || Properties.ClusterEnabled)
+}
+
 // SetupConfig read config file and store properties into Properties
 func SetupConfig(configFilename string) {
 	file, err := os.Open(configFilename)
@@ -108,4 +196,5 @@ func SetupConfig(configFilename string) {
 	}
 	defer file.Close()
 	Properties = parse(file)
+	ConfigFile = configFilename
 }
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+运行时查看和修改配置 CONFIG GET SET REWRITE 使用
+配置项的名字是 cfg 注解的小写形式 与配置文件中的写法相同
+只有 mutableOptions 中的配置项可以在运行时修改 其他的需要重启才能生效
+*/
+
+// ConfigFile 启动时读取的配置文件 没有配置文件时为空 CONFIG REWRITE 写回这个文件
+var ConfigFile string
+
+// mu 保护运行时对 Properties 的修改和 REWRITE
+// 可以修改的配置项在其他协程中要通过下面的 MaxClients 等函数在读锁内读取 不能直接读 Properties 的字段
+var mu sync.RWMutex
+
+// mutableOptions 可以通过 CONFIG SET 修改的配置项
+// maxclients timeout proto-max-bulk-len client-query-buffer-limit 只对之后建立的连接生效
+// cluster-node-timeout 不能修改 节点之间的连接和故障检测都在启动时确定
+var mutableOptions = map[string]bool{
+	"maxclients":                true,
+	"timeout":                   true,
+	"requirepass":               true,
+	"appendonly":                true,
+	"appendfilename":            true,
+	"proto-max-bulk-len":        true,
+	"client-query-buffer-limit": true,
+	"acllog-max-len":            true,
+	"masteruser":                true,
+	"masterauth":                true,
+	"slowlog-log-slower-than":   true,
+	"slowlog-max-len":           true,
+}
+
+// signedOptions 可以是负数的整数配置项
+var signedOptions = map[string]bool{
+	"tcp-keepalive":           true,
+	"slowlog-log-slower-than": true,
+}
+
+// validators 除了类型之外的检查
+var validators = map[string]func(value string) error{
+	"appendfilename": func(value string) error {
+		if value == "" || strings.ContainsAny(value, "/\\") {
+			return errors.New("appendfilename can't be a path, just a filename")
+		}
+		return nil
+	},
+}
+
+// ErrNoConfigFile 没有配置文件时无法 REWRITE
+var ErrNoConfigFile = errors.New("The server is running without a config file")
+
+// optionName 字段对应的配置项名字
+func optionName(field reflect.StructField) string {
+	key, ok := field.Tag.Lookup("cfg")
+	if !ok {
+		key = field.Name
+	}
+	return strings.ToLower(key)
+}
+
+// lookup 按名字找到 Properties 中的字段
+func lookup(name string) (reflect.Value, bool) {
+	t := reflect.TypeOf(Properties).Elem()
+	v := reflect.ValueOf(Properties).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if optionName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Names 所有配置项的名字 按结构体中的顺序
+func Names() []string {
+	t := reflect.TypeOf(Properties).Elem()
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, optionName(t.Field(i)))
+	}
+	return names
+}
+
+// IsMutable 是否可以在运行时修改
+func IsMutable(name string) bool {
+	return mutableOptions[strings.ToLower(name)]
+}
+
+func readInt(field *int) int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return *field
+}
+
+func readString(field *string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return *field
+}
+
+func readBool(field *bool) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return *field
+}
+
+// 读取可以在运行时修改的配置项
+
+func MaxClients() int             { return readInt(&Properties.MaxClients) }
+func Timeout() int                { return readInt(&Properties.Timeout) }
+func RequirePass() string         { return readString(&Properties.RequirePass) }
+func AppendOnly() bool            { return readBool(&Properties.AppendOnly) }
+func AppendFilename() string      { return readString(&Properties.AppendFilename) }
+func ProtoMaxBulkLen() int        { return readInt(&Properties.ProtoMaxBulkLen) }
+func ClientQueryBufferLimit() int { return readInt(&Properties.ClientQueryBufferLimit) }
+func AclLogMaxLen() int           { return readInt(&Properties.AclLogMaxLen) }
+func MasterUser() string          { return readString(&Properties.MasterUser) }
+func MasterAuth() string          { return readString(&Properties.MasterAuth) }
+func SlowlogLogSlowerThan() int   { return readInt(&Properties.SlowlogLogSlowerThan) }
+func SlowlogMaxLen() int          { return readInt(&Properties.SlowlogMaxLen) }
+
+// Get 配置项的值 与配置文件中的写法相同 布尔值是 yes no 列表用逗号连接
+func Get(name string) (string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	fieldVal, ok := lookup(strings.ToLower(name))
+	if !ok {
+		return "", false
+	}
+	return formatValue(fieldVal), true
+}
+
+func formatValue(fieldVal reflect.Value) string {
+	switch fieldVal.Kind() {
+	case reflect.String:
+		return fieldVal.String()
+	case reflect.Int:
+		return strconv.FormatInt(fieldVal.Int(), 10)
+	case reflect.Bool:
+		if fieldVal.Bool() {
+			return "yes"
+		}
+		return "no"
+	case reflect.Slice:
+		if slice, ok := fieldVal.Interface().([]string); ok {
+			return strings.Join(slice, ",")
+		}
+	}
+	return ""
+}
+
+// Validate 检查 value 能否赋给配置项 不修改配置
+func Validate(name string, value string) error {
+	name = strings.ToLower(name)
+	fieldVal, ok := lookup(name)
+	if !ok {
+		return errors.New("Unknown option or number of arguments for CONFIG SET - '" + name + "'")
+	}
+	if _, err := parseValue(name, fieldVal, value); err != nil {
+		return err
+	}
+	if validate := validators[name]; validate != nil {
+		return validate(value)
+	}
+	return nil
+}
+
+func parseValue(name string, fieldVal reflect.Value, value string) (reflect.Value, error) {
+	switch fieldVal.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(value), nil
+	case reflect.Int:
+		n, err := parseInt(value)
+		if err != nil {
+			return reflect.Value{}, errors.New("argument couldn't be parsed into an integer")
+		}
+		if n < 0 && !signedOptions[name] {
+			return reflect.Value{}, errors.New("argument must be a non-negative integer or memory value")
+		}
+		return reflect.ValueOf(int(n)), nil
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "yes":
+			return reflect.ValueOf(true), nil
+		case "no":
+			return reflect.ValueOf(false), nil
+		}
+		return reflect.Value{}, errors.New("argument must be 'yes' or 'no'")
+	case reflect.Slice:
+		var slice []string
+		if value != "" {
+			slice = strings.Split(value, ",")
+		}
+		return reflect.ValueOf(slice), nil
+	}
+	return reflect.Value{}, errors.New("unsupported option type")
+}
+
+// Set 修改配置项 返回修改之前的值 便于副作用失败时恢复
+func Set(name string, value string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	name = strings.ToLower(name)
+	fieldVal, ok := lookup(name)
+	if !ok {
+		return "", errors.New("Unknown option or number of arguments for CONFIG SET - '" + name + "'")
+	}
+	parsed, err := parseValue(name, fieldVal, value)
+	if err != nil {
+		return "", err
+	}
+	old := formatValue(fieldVal)
+	fieldVal.Set(parsed)
+	return old, nil
+}
+
+// Rewrite 把当前的配置写回配置文件
+// 注释和不认识的行原样保留 已有的配置项在原来的位置更新 重复出现的只保留第一行 值为空的删除
+// 文件中没有而当前值不为零的配置项追加在最后
+func Rewrite() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if ConfigFile == "" {
+		return ErrNoConfigFile
+	}
+	file, err := os.Open(ConfigFile)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	_ = file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(Properties).Elem()
+	v := reflect.ValueOf(Properties).Elem()
+	values := make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		values[optionName(t.Field(i))] = formatValue(v.Field(i))
+	}
+	written := make(map[string]bool)
+	var out []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			out = append(out, line)
+			continue
+		}
+		key := strings.ToLower(strings.Fields(trimmed)[0])
+		value, known := values[key]
+		switch {
+		case !known:
+			out = append(out, line)
+		case written[key] || value == "":
+			// 重复的行或者值已经清空
+		default:
+			out = append(out, key+" "+value)
+		}
+		written[key] = true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name := optionName(t.Field(i))
+		if written[name] || v.Field(i).IsZero() || values[name] == "" {
+			continue
+		}
+		out = append(out, name+" "+values[name])
+	}
+
+	// 先写临时文件再改名 避免写到一半时配置文件损坏
+	tmp, err := os.CreateTemp(filepath.Dir(ConfigFile), filepath.Base(ConfigFile)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	content := strings.Join(out, "\n") + "\n"
+	if _, err := tmp.WriteString(content); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if info, err := os.Stat(ConfigFile); err == nil {
+		_ = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	return os.Rename(tmp.Name(), ConfigFile)
+}
@@ -0,0 +1,440 @@
+package database
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go-redis/config"
+	"go-redis/lib/wildcard"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ACL 用户
+每个用户有自己的密码(保存 SHA-256) 允许的命令 可以访问的 key 和频道
+规则与 Redis 相同 按顺序生效
+  on off                     启用或禁用
+  >pass <pass #hash !hash    添加或删除密码  nopass 任何密码都可以  resetpass 清空密码
+  +cmd -cmd +cmd|sub         允许或禁止命令  +@category -@category 按分类  allcommands nocommands
+  ~pattern allkeys resetkeys 可以访问的 key
+  &pattern allchannels resetchannels  可以访问的订阅频道
+  reset                      恢复为新建用户的状态
+default 用户由 requirepass 初始化 配置了 aclfile 时启动时从文件加载 ACL SAVE 写回文件
+*/
+
+// aclUser 一个用户 修改时整体替换 读取时不需要加锁
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string  // SHA-256 的十六进制
+	rules     []aclRule // 命令规则 为空表示禁止所有命令
+	keys      []string  // key 的通配符
+	channels  []string  // 频道的通配符
+
+	keyPatterns     []*wildcard.Pattern
+	channelPatterns []*wildcard.Pattern
+}
+
+// aclRule +get -@write +config|get
+type aclRule struct {
+	allow    bool
+	category string // 不为空时按分类匹配
+	command  string // 小写的命令 可能带有子命令 config|get
+}
+
+func (r aclRule) String() string {
+	prefix := "-"
+	if r.allow {
+		prefix = "+"
+	}
+	if r.category != "" {
+		return prefix + "@" + r.category
+	}
+	return prefix + r.command
+}
+
+// aclTable 所有用户
+type aclTable struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// makeACLTable 只有 default 用户 设置了 requirepass 时需要密码
+func makeACLTable() *aclTable {
+	table := &aclTable{
+		users: make(map[string]*aclUser),
+	}
+	table.users[defaultUser] = makeDefaultUser(config.RequirePass())
+	return table
+}
+
+func makeDefaultUser(requirePass string) *aclUser {
+	user := &aclUser{name: defaultUser}
+	rules := []string{"on", "allkeys", "allchannels", "allcommands"}
+	if requirePass == "" {
+		rules = append(rules, "nopass")
+	} else {
+		rules = append(rules, ">"+requirePass)
+	}
+	for _, rule := range rules {
+		_ = user.applyRule(rule)
+	}
+	return user
+}
+
+func (t *aclTable) getUser(name string) *aclUser {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.users[name]
+}
+
+// setUser 在已有用户的拷贝上应用规则 全部成功后才替换 不存在时新建
+func (t *aclTable) setUser(name string, rules []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	user := &aclUser{name: name}
+	if old, ok := t.users[name]; ok {
+		user = old.clone()
+	}
+	for _, rule := range rules {
+		if err := user.applyRule(rule); err != nil {
+			return err
+		}
+	}
+	t.users[name] = user
+	return nil
+}
+
+func (t *aclTable) delUser(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.users[name]; !ok {
+		return false
+	}
+	delete(t.users, name)
+	return true
+}
+
+// list 按用户名排序
+func (t *aclTable) list() []*aclUser {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	users := make([]*aclUser, 0, len(t.users))
+	for _, user := range t.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users
+}
+
+// setRequirePass requirepass 修改后同步 default 用户的密码
+func (t *aclTable) setRequirePass(password string) {
+	rules := []string{"resetpass", "nopass"}
+	if password != "" {
+		rules = []string{"resetpass", ">" + password}
+	}
+	_ = t.setUser(defaultUser, rules)
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.rules = append([]aclRule(nil), u.rules...)
+	c.keys = append([]string(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	c.keyPatterns = append([]*wildcard.Pattern(nil), u.keyPatterns...)
+	c.channelPatterns = append([]*wildcard.Pattern(nil), u.channelPatterns...)
+	return &c
+}
+
+// applyRule 应用一条规则
+func (u *aclUser) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch lower {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.keys, u.keyPatterns = nil, nil
+		u.addKeyPattern("*")
+		return nil
+	case "resetkeys":
+		u.keys, u.keyPatterns = nil, nil
+		return nil
+	case "allchannels":
+		u.channels, u.channelPatterns = nil, nil
+		u.addChannelPattern("*")
+		return nil
+	case "resetchannels":
+		u.channels, u.channelPatterns = nil, nil
+		return nil
+	case "allcommands":
+		u.rules = []aclRule{{allow: true, category: "all"}}
+		return nil
+	case "nocommands":
+		u.rules = nil
+		return nil
+	case "reset":
+		*u = aclUser{name: u.name}
+		return nil
+	}
+	if rule == "" {
+		return errors.New("ERR Error in ACL SETUSER modifier '': Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.addPassword(hashPassword(rule[1:]))
+	case '<':
+		u.removePassword(hashPassword(rule[1:]))
+	case '#':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(hash)
+	case '!':
+		u.removePassword(strings.ToLower(rule[1:]))
+	case '~':
+		u.addKeyPattern(rule[1:])
+	case '&':
+		u.addChannelPattern(rule[1:])
+	case '+', '-':
+		if !u.addCommandRule(rule[0] == '+', lower[1:]) {
+			return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Unknown command or category name in ACL")
+		}
+	default:
+		return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i:i], u.passwords[i+1:]...)
+			return
+		}
+	}
+}
+
+func (u *aclUser) addKeyPattern(pattern string) {
+	u.keys = append(u.keys, pattern)
+	u.keyPatterns = append(u.keyPatterns, wildcard.CompilePattern(pattern))
+}
+
+func (u *aclUser) addChannelPattern(pattern string) {
+	u.channels = append(u.channels, pattern)
+	u.channelPatterns = append(u.channelPatterns, wildcard.CompilePattern(pattern))
+}
+
+// addCommandRule +@all 和 -@all 覆盖之前所有的规则 命令或分类不存在时返回 false
+func (u *aclUser) addCommandRule(allow bool, target string) bool {
+	if strings.HasPrefix(target, "@") {
+		category := target[1:]
+		if !isCategory(category) {
+			return false
+		}
+		if category == "all" {
+			u.rules = nil
+			if !allow {
+				return true
+			}
+		}
+		u.rules = append(u.rules, aclRule{allow: allow, category: category})
+		return true
+	}
+	name := target
+	if pivot := strings.Index(target, "|"); pivot >= 0 {
+		name = target[:pivot]
+		if !aclContainerCommands[name] {
+			return false
+		}
+	}
+	if !isKnownCommand(name) {
+		return false
+	}
+	u.rules = append(u.rules, aclRule{allow: allow, command: target})
+	return true
+}
+
+// checkPassword nopass 时任何密码都可以
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun 最后一条匹配的规则决定是否允许 没有匹配时禁止
+func (u *aclUser) canRun(cmdName string, subCmd string) bool {
+	allowed := false
+	full := cmdName + "|" + subCmd
+	for _, rule := range u.rules {
+		var match bool
+		if rule.category != "" {
+			match = commandInCategory(cmdName, rule.category)
+		} else {
+			match = rule.command == cmdName || (subCmd != "" && rule.command == full)
+		}
+		if match {
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+func (u *aclUser) canAccessKey(key string) bool {
+	for _, p := range u.keyPatterns {
+		if p.IsMatch(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel 频道是否匹配 &pattern 规则 没有规则时不能访问任何频道
+func (u *aclUser) canAccessChannel(channel string) bool {
+	for _, p := range u.channelPatterns {
+		if p.IsMatch(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe ACL LIST 和 aclfile 中的一行 user name on nopass ~* &* +@all
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	for _, k := range u.keys {
+		parts = append(parts, "~"+k)
+	}
+	if len(u.channels) == 0 {
+		parts = append(parts, "resetchannels")
+	}
+	for _, ch := range u.channels {
+		parts = append(parts, "&"+ch)
+	}
+	parts = append(parts, u.commandsString())
+	return strings.Join(parts, " ")
+}
+
+// commandsString 没有以 +@all 开始时前面是 -@all
+func (u *aclUser) commandsString() string {
+	rules := make([]string, 0, len(u.rules)+1)
+	if len(u.rules) == 0 || u.rules[0].category != "all" {
+		rules = append(rules, "-@all")
+	}
+	for _, rule := range u.rules {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+// loadACLFile 读取 aclfile 每行 user name rules... 成功之后整体替换 文件中没有 default 时保留由 requirepass 生成的
+func loadACLFile(filename string) (map[string]*aclUser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	tmp := &aclTable{users: make(map[string]*aclUser)}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" {
+			return nil, errors.New("ERR " + filename + ":" + strconv.Itoa(lineNum) + ": line should start with user keyword")
+		}
+		if err := tmp.setUser(fields[1], fields[2:]); err != nil {
+			return nil, errors.New(err.Error() + " at " + filename + ":" + strconv.Itoa(lineNum))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := tmp.users[defaultUser]; !ok {
+		tmp.users[defaultUser] = makeDefaultUser(config.RequirePass())
+	}
+	return tmp.users, nil
+}
+
+// load 从 aclfile 重新加载 失败时保持原来的用户
+func (t *aclTable) load(filename string) error {
+	users, err := loadACLFile(filename)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.users = users
+	t.mu.Unlock()
+	return nil
+}
+
+// save 先写临时文件再改名 避免写到一半时宕机
+func (t *aclTable) save(filename string) error {
+	var builder strings.Builder
+	for _, user := range t.list() {
+		builder.WriteString(user.describe() + "\n")
+	}
+	tmpFile := filename + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(builder.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
@@ -0,0 +1,100 @@
+package database
+
+// aclCategories ACL 中 +@category 使用的分类 @read @write 由指令注册时的 flags 决定
+// 集群和事务的指令不在 cmdTable 中 也在这里列出 ACL 规则才能引用它们
+var aclCategories = map[string][]string{
+	"keyspace":    {"del", "exists", "type", "rename", "renamenx", "keys", "dbsize", "randomkey", "scan", "dump", "restore", "restore-asking", "migrate", "flushdb"},
+	"string":      {"get", "set", "setnx", "getset", "strlen"},
+	"connection":  {"auth", "hello", "ping", "select", "readonly", "readwrite", "asking"},
+	"transaction": {"multi", "exec", "discard", "watch", "unwatch"},
+	"admin":       {"acl", "client", "config", "slowlog", "cluster", "raft", "migrate", "restore-asking", "localexec", "prepare", "commit", "rollback", "getver", "execbatch"},
+	"dangerous":   {"acl", "client", "config", "slowlog", "cluster", "info", "raft", "flushdb", "keys", "migrate", "restore", "restore-asking", "localexec", "prepare", "commit", "rollback", "execbatch"},
+	"pubsub":      {},
+}
+
+// aclContainerCommands 有子命令的指令 规则可以写作 +acl|whoami
+var aclContainerCommands = map[string]bool{
+	"acl":     true,
+	"client":  true,
+	"config":  true,
+	"slowlog": true,
+	"cluster": true,
+	"raft":    true,
+}
+
+// categoryIndex category -> 指令集合
+var categoryIndex = func() map[string]map[string]bool {
+	index := make(map[string]map[string]bool)
+	for category, commands := range aclCategories {
+		set := make(map[string]bool)
+		for _, name := range commands {
+			set[name] = true
+		}
+		index[category] = set
+	}
+	return index
+}()
+
+// aclCategoryNames ACL CAT 列出的所有分类
+func aclCategoryNames() []string {
+	names := []string{"read", "write"}
+	for category := range aclCategories {
+		names = append(names, category)
+	}
+	return names
+}
+
+func isCategory(category string) bool {
+	if category == "all" || category == "read" || category == "write" {
+		return true
+	}
+	_, ok := aclCategories[category]
+	return ok
+}
+
+// isKnownCommand 数据库实现的指令 或者某个分类中的指令
+func isKnownCommand(name string) bool {
+	if IsCommand(name) {
+		return true
+	}
+	for _, set := range categoryIndex {
+		if set[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// commandInCategory name 是小写的指令名
+func commandInCategory(name string, category string) bool {
+	switch category {
+	case "all":
+		return true
+	case "read":
+		return IsReadOnlyCommand(name)
+	case "write":
+		return IsWriteCommand(name)
+	}
+	return categoryIndex[category][name]
+}
+
+// commandsInCategory ACL CAT category 列出分类中的指令
+func commandsInCategory(category string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] && commandInCategory(name, category) {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name := range cmdTable {
+		add(name)
+	}
+	for _, set := range categoryIndex {
+		for name := range set {
+			add(name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var noACLFileReply = reply.MakeErrReply("ERR This Redis instance is not configured to use an ACL file. " +
+	"You may want to specify users via the ACL SETUSER command and then set aclfile in the configuration file")
+
+// execACL ACL SETUSER|GETUSER|DELUSER|LIST|USERS|WHOAMI|CAT|SAVE|LOAD|LOG
+func execACL(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("acl")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "setuser":
+		if len(args) < 2 {
+			return reply.MakeArgNumErrReply("acl|setuser")
+		}
+		rules := make([]string, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			rules = append(rules, string(arg))
+		}
+		if err := mdb.acl.setUser(string(args[1]), rules); err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		return reply.MakeOkReply()
+	case "getuser":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("acl|getuser")
+		}
+		user := mdb.acl.getUser(string(args[1]))
+		if user == nil {
+			return reply.MakeNullReply()
+		}
+		return aclGetUser(user)
+	case "deluser":
+		if len(args) < 2 {
+			return reply.MakeArgNumErrReply("acl|deluser")
+		}
+		var deleted int64
+		for _, arg := range args[1:] {
+			if string(arg) == defaultUser {
+				return reply.MakeErrReply("ERR The 'default' user cannot be removed")
+			}
+		}
+		for _, arg := range args[1:] {
+			if mdb.acl.delUser(string(arg)) {
+				deleted++
+			}
+		}
+		return reply.MakeIntReply(deleted)
+	case "list", "users":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("acl|" + subCmd)
+		}
+		users := mdb.acl.list()
+		result := make([][]byte, 0, len(users))
+		for _, user := range users {
+			if subCmd == "list" {
+				result = append(result, []byte(user.describe()))
+			} else {
+				result = append(result, []byte(user.name))
+			}
+		}
+		return reply.MakeMultiBulkReply(result)
+	case "whoami":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("acl|whoami")
+		}
+		name := c.GetUser()
+		if name == "" {
+			name = defaultUser
+		}
+		return reply.MakeBulkReply([]byte(name))
+	case "cat":
+		return aclCat(args[1:])
+	case "save":
+		if config.Properties.AclFile == "" {
+			return noACLFileReply
+		}
+		if err := mdb.acl.save(config.Properties.AclFile); err != nil {
+			return reply.MakeErrReply("ERR There was an error trying to save the ACLs. Please check the server logs for more information: " + err.Error())
+		}
+		return reply.MakeOkReply()
+	case "load":
+		if config.Properties.AclFile == "" {
+			return noACLFileReply
+		}
+		if err := mdb.acl.load(config.Properties.AclFile); err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		return reply.MakeOkReply()
+	case "log":
+		return aclLogCmd(mdb, args[1:])
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try ACL HELP.")
+}
+
+// aclGetUser flags passwords commands keys channels
+func aclGetUser(user *aclUser) resp.Reply {
+	var flags []resp.Reply
+	if user.enabled {
+		flags = append(flags, reply.MakeBulkReply([]byte("on")))
+	} else {
+		flags = append(flags, reply.MakeBulkReply([]byte("off")))
+	}
+	if user.nopass {
+		flags = append(flags, reply.MakeBulkReply([]byte("nopass")))
+	}
+	passwords := make([][]byte, 0, len(user.passwords))
+	for _, p := range user.passwords {
+		passwords = append(passwords, []byte(p))
+	}
+	keys := make([]string, 0, len(user.keys))
+	for _, k := range user.keys {
+		keys = append(keys, "~"+k)
+	}
+	channels := make([]string, 0, len(user.channels))
+	for _, ch := range user.channels {
+		channels = append(channels, "&"+ch)
+	}
+	return reply.MakeMapReplyFromPairs(
+		reply.MakeBulkReply([]byte("flags")), reply.MakeSetReply(flags),
+		reply.MakeBulkReply([]byte("passwords")), reply.MakeMultiBulkReply(passwords),
+		reply.MakeBulkReply([]byte("commands")), reply.MakeBulkReply([]byte(user.commandsString())),
+		reply.MakeBulkReply([]byte("keys")), reply.MakeBulkReply([]byte(strings.Join(keys, " "))),
+		reply.MakeBulkReply([]byte("channels")), reply.MakeBulkReply([]byte(strings.Join(channels, " "))),
+	)
+}
+
+// aclCat ACL CAT [category] 没有参数时列出所有分类 否则列出分类中的指令
+func aclCat(args [][]byte) resp.Reply {
+	if len(args) > 1 {
+		return reply.MakeArgNumErrReply("acl|cat")
+	}
+	var names []string
+	if len(args) == 0 {
+		names = aclCategoryNames()
+	} else {
+		category := strings.ToLower(string(args[0]))
+		if !isCategory(category) || category == "all" {
+			return reply.MakeErrReply("ERR Unknown category '" + category + "'")
+		}
+		names = commandsInCategory(category)
+	}
+	sort.Strings(names)
+	result := make([][]byte, 0, len(names))
+	for _, name := range names {
+		result = append(result, []byte(name))
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// aclLogCmd ACL LOG [count|RESET]
+func aclLogCmd(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) > 1 {
+		return reply.MakeArgNumErrReply("acl|log")
+	}
+	if len(args) == 0 {
+		return mdb.aclLog.toReply(10)
+	}
+	if strings.ToLower(string(args[0])) == "reset" {
+		mdb.aclLog.reset()
+		return reply.MakeOkReply()
+	}
+	count, err := strconv.Atoi(string(args[0]))
+	if err != nil || count < 0 {
+		return reply.MakeErrReply("ERR value is out of range, must be positive")
+	}
+	return mdb.aclLog.toReply(count)
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ACL LOG 记录认证失败和因为权限被拒绝的命令 最新的在前面
+60 秒内相同用户 原因和对象的记录合并为一条 只增加 count
+*/
+
+const (
+	defaultACLLogMaxLen = 128
+	aclLogGroupWindow   = 60 * time.Second
+)
+
+type aclLogEntry struct {
+	count      int64
+	reason     string // auth command key
+	context    string // toplevel 或 multi
+	object     string // 被拒绝的命令或 key
+	username   string
+	clientInfo string
+	entryID    int64
+	created    time.Time
+	updated    time.Time
+}
+
+type aclLog struct {
+	mu      sync.Mutex
+	entries []*aclLogEntry
+	nextID  int64
+}
+
+func makeACLLog() *aclLog {
+	return &aclLog{}
+}
+
+func aclLogMaxLen() int {
+	if maxLen := config.AclLogMaxLen(); maxLen > 0 {
+		return maxLen
+	}
+	return defaultACLLogMaxLen
+}
+
+// clientInfo 记录是哪个客户端触发的 与 CLIENT INFO 相同
+func clientInfo(c resp.Connection) string {
+	if conn, ok := c.(*connection.Connection); ok {
+		return conn.Info()
+	}
+	return "id=" + strconv.FormatUint(c.GetID(), 10)
+}
+
+func (l *aclLog) add(c resp.Connection, reason string, object string, username string) {
+	context := "toplevel"
+	if c.InMultiState() {
+		context = "multi"
+	}
+	now := time.Now()
+	info := clientInfo(c)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, entry := range l.entries {
+		if entry.reason == reason && entry.context == context && entry.object == object &&
+			entry.username == username && now.Sub(entry.updated) < aclLogGroupWindow {
+			entry.count++
+			entry.updated = now
+			entry.clientInfo = info
+			// 移动到最前面
+			copy(l.entries[1:i+1], l.entries[:i])
+			l.entries[0] = entry
+			return
+		}
+	}
+	entry := &aclLogEntry{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: info,
+		entryID:    l.nextID,
+		created:    now,
+		updated:    now,
+	}
+	l.nextID++
+	l.entries = append([]*aclLogEntry{entry}, l.entries...)
+	if maxLen := aclLogMaxLen(); len(l.entries) > maxLen {
+		l.entries = l.entries[:maxLen]
+	}
+}
+
+func (l *aclLog) reset() {
+	l.mu.Lock()
+	l.entries = nil
+	l.mu.Unlock()
+}
+
+// toReply 最新的 count 条 count 小于 0 时返回全部
+func (l *aclLog) toReply(count int) resp.Reply {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	now := time.Now()
+	result := make([]resp.Reply, 0, count)
+	for _, entry := range l.entries[:count] {
+		result = append(result, reply.MakeMapReplyFromPairs(
+			reply.MakeBulkReply([]byte("count")), reply.MakeIntReply(entry.count),
+			reply.MakeBulkReply([]byte("reason")), reply.MakeBulkReply([]byte(entry.reason)),
+			reply.MakeBulkReply([]byte("context")), reply.MakeBulkReply([]byte(entry.context)),
+			reply.MakeBulkReply([]byte("object")), reply.MakeBulkReply([]byte(entry.object)),
+			reply.MakeBulkReply([]byte("username")), reply.MakeBulkReply([]byte(entry.username)),
+			reply.MakeBulkReply([]byte("age-seconds")), reply.MakeDoubleReply(now.Sub(entry.created).Seconds()),
+			reply.MakeBulkReply([]byte("client-info")), reply.MakeBulkReply([]byte(entry.clientInfo)),
+			reply.MakeBulkReply([]byte("entry-id")), reply.MakeIntReply(entry.entryID),
+			reply.MakeBulkReply([]byte("timestamp-created")), reply.MakeIntReply(entry.created.UnixMilli()),
+			reply.MakeBulkReply([]byte("timestamp-last-updated")), reply.MakeIntReply(entry.updated.UnixMilli()),
+		))
+	}
+	return reply.MakeMultiRawReply(result)
+}
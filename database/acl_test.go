@@ -0,0 +1,131 @@
+package database
+
+import (
+	"go-redis/resp/reply"
+	"strings"
+	"testing"
+)
+
+func TestACLChannelRules(t *testing.T) {
+	cases := []struct {
+		name     string
+		rules    []string
+		channels string // ACL GETUSER 中的 channels
+		allowed  []string
+		denied   []string
+	}{
+		{
+			name:   "new user has no channels",
+			rules:  []string{"on"},
+			denied: []string{"news", ""},
+		},
+		{
+			name:     "patterns",
+			rules:    []string{"&news.*", "&alerts"},
+			channels: "&news.* &alerts",
+			allowed:  []string{"news.sports", "alerts"},
+			denied:   []string{"alerts.high", "weather"},
+		},
+		{
+			name:     "allchannels replaces patterns",
+			rules:    []string{"&news.*", "allchannels"},
+			channels: "&*",
+			allowed:  []string{"news.sports", "weather"},
+		},
+		{
+			name:   "resetchannels",
+			rules:  []string{"allchannels", "resetchannels"},
+			denied: []string{"news"},
+		},
+		{
+			name:     "reset clears channels",
+			rules:    []string{"allchannels", "reset", "&a"},
+			channels: "&a",
+			allowed:  []string{"a"},
+			denied:   []string{"b"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			table := &aclTable{users: make(map[string]*aclUser)}
+			if err := table.setUser("alice", c.rules); err != nil {
+				t.Fatal(err)
+			}
+			user := table.getUser("alice")
+			got := aclGetUser(user).(*reply.MapReply)
+			found := false
+			for i, key := range got.Keys {
+				if string(key.(*reply.BulkReply).Arg) != "channels" {
+					continue
+				}
+				found = true
+				if channels := string(got.Values[i].(*reply.BulkReply).Arg); channels != c.channels {
+					t.Errorf("expect channels %q, got %q", c.channels, channels)
+				}
+			}
+			if !found {
+				t.Fatal("ACL GETUSER should contain channels")
+			}
+			for _, ch := range c.allowed {
+				if !user.canAccessChannel(ch) {
+					t.Errorf("channel %q should be allowed", ch)
+				}
+			}
+			for _, ch := range c.denied {
+				if user.canAccessChannel(ch) {
+					t.Errorf("channel %q should be denied", ch)
+				}
+			}
+		})
+	}
+}
+
+// TestACLDescribeChannels ACL LIST 和 aclfile 中的一行包含频道规则 重新加载之后不变
+func TestACLDescribeChannels(t *testing.T) {
+	cases := []struct {
+		rules  []string
+		expect string
+	}{
+		{
+			rules:  []string{"on", "nopass", "~*", "&*", "+@all"},
+			expect: "user alice on nopass ~* &* +@all",
+		},
+		{
+			rules:  []string{"on", "nopass", "~cache:*", "&news.*", "&alerts", "+get"},
+			expect: "user alice on nopass ~cache:* &news.* &alerts -@all +get",
+		},
+		{
+			rules:  []string{"off", "allchannels", "resetchannels"},
+			expect: "user alice off resetchannels -@all",
+		},
+	}
+	for _, c := range cases {
+		table := &aclTable{users: make(map[string]*aclUser)}
+		if err := table.setUser("alice", c.rules); err != nil {
+			t.Fatal(err)
+		}
+		line := table.getUser("alice").describe()
+		if line != c.expect {
+			t.Errorf("expect %q, got %q", c.expect, line)
+			continue
+		}
+		reloaded := &aclTable{users: make(map[string]*aclUser)}
+		fields := strings.Fields(line)
+		if err := reloaded.setUser(fields[1], fields[2:]); err != nil {
+			t.Fatal(err)
+		}
+		if again := reloaded.getUser("alice").describe(); again != line {
+			t.Errorf("expect %q after reload, got %q", line, again)
+		}
+	}
+}
+
+func TestACLDefaultUserChannels(t *testing.T) {
+	user := makeDefaultUser("")
+	if !user.canAccessChannel("any") {
+		t.Error("default user should access all channels")
+	}
+	if !strings.Contains(user.describe(), " &* ") {
+		t.Errorf("expect &* in %q", user.describe())
+	}
+}
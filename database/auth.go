@@ -0,0 +1,107 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strings"
+)
+
+/*
+认证和权限检查
+default 用户需要密码时(requirepass 或者 ACL SETUSER default >pass) 客户端需要先 AUTH [username] password
+认证之前只能执行 AUTH 和 HELLO ... AUTH 其他命令返回 NOAUTH
+认证之后每条命令执行前检查用户能否执行这个命令 能否访问命令涉及的 key 不允许时返回 NOPERM 并记录到 ACL LOG
+*/
+
+var (
+	noAuthReply    = reply.MakeErrReply("NOAUTH Authentication required.")
+	wrongPassReply = reply.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+	noPermKeyReply = reply.MakeErrReply("NOPERM No permissions to access a key")
+)
+
+const defaultUser = "default"
+
+// currentUser 连接当前的用户 返回 nil 表示还没有认证
+// 没有 AUTH 过的连接使用 default 用户 前提是 default 不需要密码
+// 用户被删除或者禁用之后 连接需要重新认证
+func (mdb *StandaloneDatabase) currentUser(c resp.Connection) *aclUser {
+	name := c.GetUser()
+	if name == "" {
+		user := mdb.acl.getUser(defaultUser)
+		if user != nil && user.enabled && user.nopass {
+			return user
+		}
+		return nil
+	}
+	user := mdb.acl.getUser(name)
+	if user == nil || !user.enabled {
+		return nil
+	}
+	return user
+}
+
+// CheckPermission 执行命令之前检查认证和 ACL 返回 nil 表示可以执行
+// AUTH 和 HELLO 任何时候都可以执行 内部的伪连接不检查
+func (mdb *StandaloneDatabase) CheckPermission(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	if c.IsInternal() {
+		return nil
+	}
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "auth" || cmdName == "hello" {
+		return nil
+	}
+	user := mdb.currentUser(c)
+	if user == nil {
+		return noAuthReply
+	}
+	subCmd := ""
+	if aclContainerCommands[cmdName] && len(cmdLine) > 1 {
+		subCmd = strings.ToLower(string(cmdLine[1]))
+	}
+	if !user.canRun(cmdName, subCmd) {
+		fullName := cmdName
+		if subCmd != "" {
+			fullName += "|" + subCmd
+		}
+		mdb.aclLog.add(c, "command", fullName, user.name)
+		return reply.MakeErrReply("NOPERM User " + user.name + " has no permissions to run the '" + fullName + "' command")
+	}
+	writeKeys, readKeys := getRelatedKeys(cmdLine)
+	for _, keys := range [][]string{writeKeys, readKeys} {
+		for _, key := range keys {
+			if !user.canAccessKey(key) {
+				mdb.aclLog.add(c, "key", key, user.name)
+				return noPermKeyReply
+			}
+		}
+	}
+	return nil
+}
+
+// execAuth AUTH [username] password
+func execAuth(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return reply.MakeArgNumErrReply("auth")
+	}
+	if len(args) == 1 {
+		if user := mdb.acl.getUser(defaultUser); user != nil && user.nopass {
+			return reply.MakeErrReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	}
+	user, password := defaultUser, string(args[0])
+	if len(args) == 2 {
+		user, password = string(args[0]), string(args[1])
+	}
+	return mdb.authenticate(c, user, password)
+}
+
+// authenticate 用户存在 已启用 并且密码正确时认证通过 失败时记录到 ACL LOG
+func (mdb *StandaloneDatabase) authenticate(c resp.Connection, name string, password string) resp.Reply {
+	user := mdb.acl.getUser(name)
+	if user == nil || !user.enabled || !user.checkPassword(password) {
+		mdb.aclLog.add(c, "auth", "AUTH", name)
+		return wrongPassReply
+	}
+	c.SetUser(name)
+	return reply.MakeOkReply()
+}
@@ -0,0 +1,385 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CLIENT 命令 查看和管理客户端连接
+所有连接由 handler 记录 通过 SetClientLister 提供给数据库
+CLIENT PAUSE timeout [WRITE|ALL] 在 timeout 毫秒内暂停执行写命令或者所有命令 命令会等待而不是返回错误
+CLIENT 命令本身不会被暂停 否则无法 UNPAUSE
+*/
+
+// ClientLister 遍历所有的客户端连接 cb 返回 false 时停止
+type ClientLister func(cb func(c *connection.Connection) bool)
+
+// SetClientLister 由 handler 在开始处理请求之前设置
+func (mdb *StandaloneDatabase) SetClientLister(lister ClientLister) {
+	mdb.clientLister = lister
+}
+
+func (mdb *StandaloneDatabase) forEachClient(cb func(c *connection.Connection) bool) {
+	if mdb.clientLister != nil {
+		mdb.clientLister(cb)
+	}
+}
+
+// clientPause CLIENT PAUSE 的状态
+type clientPause struct {
+	mu      sync.Mutex
+	until   time.Time
+	all     bool          // ALL 暂停所有命令 否则只暂停写命令
+	resumed chan struct{} // UNPAUSE 时关闭 唤醒等待的命令
+}
+
+func makeClientPause() *clientPause {
+	return &clientPause{
+		resumed: make(chan struct{}),
+	}
+}
+
+// pause 已经在暂停时 取更晚的结束时间和更严格的模式
+func (p *clientPause) pause(timeout time.Duration, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.After(p.until) {
+		p.all = false
+	}
+	if until := now.Add(timeout); until.After(p.until) {
+		p.until = until
+	}
+	p.all = p.all || all
+}
+
+func (p *clientPause) unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until = time.Time{}
+	p.all = false
+	close(p.resumed)
+	p.resumed = make(chan struct{})
+}
+
+// wait 暂停期间一直等待 直到超时或者 UNPAUSE
+func (p *clientPause) wait(isWrite bool) {
+	for {
+		p.mu.Lock()
+		remain := time.Until(p.until)
+		if remain <= 0 || (!p.all && !isWrite) {
+			p.mu.Unlock()
+			return
+		}
+		resumed := p.resumed
+		p.mu.Unlock()
+		timer := time.NewTimer(remain)
+		select {
+		case <-resumed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// WaitIfPaused 执行命令之前调用 CLIENT PAUSE 期间等待 内部的伪连接不受影响
+func (mdb *StandaloneDatabase) WaitIfPaused(c resp.Connection, cmdName string) {
+	if c.IsInternal() || cmdName == "client" {
+		return
+	}
+	mdb.pause.wait(IsWriteCommand(cmdName))
+}
+
+// FullCommandName 小写的命令名 有子命令时是 client|list 这样的全名
+func FullCommandName(cmdLine [][]byte) string {
+	name := strings.ToLower(string(cmdLine[0]))
+	if aclContainerCommands[name] && len(cmdLine) > 1 {
+		name += "|" + strings.ToLower(string(cmdLine[1]))
+	}
+	return name
+}
+
+// execClient CLIENT ID|INFO|LIST|KILL|SETNAME|GETNAME|PAUSE|UNPAUSE|NO-EVICT
+func execClient(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("client")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "id":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("client|id")
+		}
+		return reply.MakeIntReply(int64(c.GetID()))
+	case "info":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("client|info")
+		}
+		conn, ok := c.(*connection.Connection)
+		if !ok {
+			return reply.MakeNullBulkReply()
+		}
+		return reply.MakeVerbatimReply("txt", []byte(conn.Info()+"\n"))
+	case "list":
+		return clientList(mdb, args[1:])
+	case "kill":
+		return clientKill(c, mdb, args[1:])
+	case "setname":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("client|setname")
+		}
+		if errReply := validateClientName(string(args[1])); errReply != nil {
+			return errReply
+		}
+		c.SetName(string(args[1]))
+		return reply.MakeOkReply()
+	case "getname":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("client|getname")
+		}
+		if name := c.GetName(); name != "" {
+			return reply.MakeBulkReply([]byte(name))
+		}
+		return reply.MakeNullBulkReply()
+	case "pause":
+		return clientPauseCmd(mdb, args[1:])
+	case "unpause":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("client|unpause")
+		}
+		mdb.pause.unpause()
+		return reply.MakeOkReply()
+	case "no-evict":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("client|no-evict")
+		}
+		conn, ok := c.(*connection.Connection)
+		switch strings.ToLower(string(args[1])) {
+		case "on":
+			if ok {
+				conn.SetNoEvict(true)
+			}
+		case "off":
+			if ok {
+				conn.SetNoEvict(false)
+			}
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+		return reply.MakeOkReply()
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CLIENT HELP.")
+}
+
+// validateClientName 名字中不能有空格和不可见字符 否则 CLIENT LIST 无法解析
+func validateClientName(name string) resp.Reply {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return reply.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	return nil
+}
+
+// isClientType 只有普通客户端 没有主从复制和订阅
+func isClientType(typ string) bool {
+	switch typ {
+	case "normal", "master", "replica", "slave", "pubsub":
+		return true
+	}
+	return false
+}
+
+// clientList CLIENT LIST [TYPE type] [ID id ...]
+func clientList(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	var ids map[uint64]bool
+	typ := ""
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "type" && i+1 < len(args):
+			typ = strings.ToLower(string(args[i+1]))
+			if !isClientType(typ) {
+				return reply.MakeErrReply("ERR Unknown client type '" + typ + "'")
+			}
+			i++
+		case option == "id" && i+1 < len(args):
+			ids = make(map[uint64]bool)
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseUint(string(args[i]), 10, 64)
+				if err != nil || id == 0 {
+					return reply.MakeErrReply("ERR Invalid client ID")
+				}
+				ids[id] = true
+			}
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	var builder strings.Builder
+	if typ == "" || typ == "normal" {
+		var conns []*connection.Connection
+		mdb.forEachClient(func(conn *connection.Connection) bool {
+			if ids == nil || ids[conn.GetID()] {
+				conns = append(conns, conn)
+			}
+			return true
+		})
+		// 按 id 排序 与连接建立的顺序相同
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].GetID() < conns[j].GetID()
+		})
+		for _, conn := range conns {
+			builder.WriteString(conn.Info() + "\n")
+		}
+	}
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}
+
+// clientKillFilter CLIENT KILL 的过滤条件 为零值的条件不检查
+type clientKillFilter struct {
+	id     uint64
+	addr   string
+	laddr  string
+	user   string
+	typ    string
+	maxAge int64
+	skipMe bool
+}
+
+func (f *clientKillFilter) match(self resp.Connection, conn *connection.Connection) bool {
+	switch {
+	case f.skipMe && conn.GetID() == self.GetID():
+		return false
+	case f.id != 0 && conn.GetID() != f.id:
+		return false
+	case f.addr != "" && conn.Addr() != f.addr:
+		return false
+	case f.laddr != "" && conn.LocalAddr() != f.laddr:
+		return false
+	case f.typ != "" && f.typ != "normal":
+		return false
+	case f.maxAge > 0 && int64(conn.Age()/time.Second) < f.maxAge:
+		return false
+	}
+	if f.user != "" {
+		user := conn.GetUser()
+		if user == "" {
+			user = defaultUser
+		}
+		if user != f.user {
+			return false
+		}
+	}
+	return true
+}
+
+// clientKill CLIENT KILL addr 或者 CLIENT KILL [ID id] [ADDR addr] [LADDR addr] [USER user] [TYPE type] [MAXAGE sec] [SKIPME yes|no]
+// 旧的写法找不到客户端时返回错误 新的写法返回关闭的数量
+func clientKill(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("client|kill")
+	}
+	filter := &clientKillFilter{skipMe: true}
+	oldStyle := len(args) == 1
+	if oldStyle {
+		filter.addr = string(args[0])
+		filter.skipMe = false
+	} else {
+		if len(args)%2 != 0 {
+			return reply.MakeSyntaxErrReply()
+		}
+		for i := 0; i < len(args); i += 2 {
+			option, value := strings.ToLower(string(args[i])), string(args[i+1])
+			switch option {
+			case "id":
+				id, err := strconv.ParseUint(value, 10, 64)
+				if err != nil || id == 0 {
+					return reply.MakeErrReply("ERR client-id should be greater than 0")
+				}
+				filter.id = id
+			case "addr":
+				filter.addr = value
+			case "laddr":
+				filter.laddr = value
+			case "user":
+				filter.user = value
+			case "type":
+				filter.typ = strings.ToLower(value)
+				if !isClientType(filter.typ) {
+					return reply.MakeErrReply("ERR Unknown client type '" + value + "'")
+				}
+			case "maxage":
+				maxAge, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || maxAge <= 0 {
+					return reply.MakeErrReply("ERR maxage should be greater than 0")
+				}
+				filter.maxAge = maxAge
+			case "skipme":
+				switch strings.ToLower(value) {
+				case "yes":
+					filter.skipMe = true
+				case "no":
+					filter.skipMe = false
+				default:
+					return reply.MakeSyntaxErrReply()
+				}
+			default:
+				return reply.MakeSyntaxErrReply()
+			}
+		}
+	}
+	var killed int64
+	mdb.forEachClient(func(conn *connection.Connection) bool {
+		if !filter.match(c, conn) {
+			return true
+		}
+		killed++
+		if conn.GetID() == c.GetID() {
+			// 当前连接在回复之后再关闭
+			conn.CloseAfterReply()
+		} else {
+			go func() {
+				_ = conn.Close()
+			}()
+		}
+		return true
+	})
+	if oldStyle {
+		if killed == 0 {
+			return reply.MakeErrReply("ERR No such client")
+		}
+		return reply.MakeOkReply()
+	}
+	return reply.MakeIntReply(killed)
+}
+
+// clientPauseCmd CLIENT PAUSE timeout [WRITE|ALL]
+func clientPauseCmd(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return reply.MakeArgNumErrReply("client|pause")
+	}
+	timeout, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || timeout < 0 {
+		return reply.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToLower(string(args[1])) {
+		case "all":
+		case "write":
+			all = false
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	mdb.pause.pause(time.Duration(timeout)*time.Millisecond, all)
+	return reply.MakeOkReply()
+}
@@ -9,15 +9,83 @@ var cmdTable = make(map[string]*command)
 // 每一个指令 Get Put 都是一个 command
 type command struct {
 	exector ExecFunc
-	arity   int // 参数的数量
+	prepare PreFunc  // 分析出指令要写和要读的 key 执行前加锁
+	undo    UndoFunc // 生成撤销指令的命令 分布式事务回滚时使用 只读指令为 nil
+	arity   int      // 参数的数量
+	flags   int      // 只读或写指令 集群据此决定能否发给副本
 }
 
+const (
+	flagWrite    = 1 << iota // 会修改数据
+	flagReadOnly             // 只读取数据 可以在副本上执行
+)
+
+// PreFunc 返回指令涉及的写 key 和读 key  args 不包含指令名
+type PreFunc func(args [][]byte) ([]string, []string)
+
+// UndoFunc 在指令执行之前调用 返回能把数据恢复到执行前状态的命令
+type UndoFunc func(db *DB, args [][]byte) []CmdLine
+
 // RegisterCommand 注册方法
-func RegisterCommand(name string, exector ExecFunc, arity int) {
+func RegisterCommand(name string, exector ExecFunc, prepare PreFunc, undo UndoFunc, arity int, flags int) {
 	// 转换为小写 统一
 	name = strings.ToLower(name)
 	cmdTable[name] = &command{
 		exector: exector,
+		prepare: prepare,
+		undo:    undo,
 		arity:   arity,
+		flags:   flags,
+	}
+}
+
+// IsCommand 是否是数据库实现的指令
+func IsCommand(name string) bool {
+	_, ok := cmdTable[strings.ToLower(name)]
+	return ok
+}
+
+// IsReadOnlyCommand 只读指令 集群中开启 READONLY 的客户端可以从副本读取
+func IsReadOnlyCommand(name string) bool {
+	cmd, ok := cmdTable[strings.ToLower(name)]
+	return ok && cmd.flags&flagReadOnly > 0
+}
+
+// IsWriteCommand 会修改数据的指令
+func IsWriteCommand(name string) bool {
+	cmd, ok := cmdTable[strings.ToLower(name)]
+	return ok && cmd.flags&flagWrite > 0
+}
+
+// noPrepare 不涉及具体的 key
+func noPrepare(args [][]byte) ([]string, []string) {
+	return nil, nil
+}
+
+// readFirstKey 只读第一个 key 例如 GET
+func readFirstKey(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[0])}
+}
+
+// writeFirstKey 写第一个 key 例如 SET
+func writeFirstKey(args [][]byte) ([]string, []string) {
+	return []string{string(args[0])}, nil
+}
+
+// readAllKeys 所有参数都是只读的 key 例如 EXISTS
+func readAllKeys(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+	return nil, keys
+}
+
+// writeAllKeys 所有参数都是要写的 key 例如 DEL
+func writeAllKeys(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
 	}
+	return keys, nil
 }
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"go-redis/aof"
+	"go-redis/config"
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/stats"
+	"go-redis/lib/wildcard"
+	"go-redis/resp/reply"
+	"strings"
+)
+
+/*
+CONFIG 命令 运行时查看和修改配置
+CONFIG SET 先检查所有的参数 全部合法才修改 副作用失败时恢复这次修改的所有配置项
+requirepass 同步 default 用户的密码 appendonly appendfilename 开启 关闭或者切换 AOF 文件
+*/
+
+// execConfig CONFIG GET|SET|REWRITE|RESETSTAT
+func execConfig(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("config")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "get":
+		if len(args) < 2 {
+			return reply.MakeArgNumErrReply("config|get")
+		}
+		return configGet(args[1:])
+	case "set":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return reply.MakeArgNumErrReply("config|set")
+		}
+		return configSet(mdb, args[1:])
+	case "rewrite":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("config|rewrite")
+		}
+		if err := config.Rewrite(); err != nil {
+			return reply.MakeErrReply("ERR Rewriting config file: " + err.Error())
+		}
+		logger.Info("CONFIG REWRITE executed with success")
+		return reply.MakeOkReply()
+	case "resetstat":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("config|resetstat")
+		}
+		stats.ResetStats()
+		return reply.MakeOkReply()
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CONFIG HELP.")
+}
+
+// configGet CONFIG GET pattern [pattern ...] 多个 pattern 匹配到的同一个配置项只返回一次
+func configGet(patterns [][]byte) resp.Reply {
+	compiled := make([]*wildcard.Pattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		compiled = append(compiled, wildcard.CompilePattern(strings.ToLower(string(pattern))))
+	}
+	var pairs []resp.Reply
+	for _, name := range config.Names() {
+		for _, pattern := range compiled {
+			if !pattern.IsMatch(name) {
+				continue
+			}
+			value, _ := config.Get(name)
+			pairs = append(pairs, reply.MakeBulkReply([]byte(name)), reply.MakeBulkReply([]byte(value)))
+			break
+		}
+	}
+	return reply.MakeMapReplyFromPairs(pairs...)
+}
+
+// configSet CONFIG SET name value [name value ...]
+func configSet(mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	mdb.configMu.Lock()
+	defer mdb.configMu.Unlock()
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); i += 2 {
+		name, value := strings.ToLower(string(args[i])), string(args[i+1])
+		if _, ok := config.Get(name); !ok {
+			return reply.MakeErrReply("ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'")
+		}
+		if seen[name] {
+			return configSetErr(name, "duplicate parameter")
+		}
+		seen[name] = true
+		if !config.IsMutable(name) {
+			return configSetErr(name, "can't set immutable config")
+		}
+		if err := config.Validate(name, value); err != nil {
+			return configSetErr(name, err.Error())
+		}
+	}
+
+	// 记录修改前的值 副作用失败时恢复
+	olds := make(map[string]string)
+	restore := func() {
+		for name, old := range olds {
+			_, _ = config.Set(name, old)
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		name := strings.ToLower(string(args[i]))
+		old, err := config.Set(name, string(args[i+1]))
+		if err != nil {
+			restore()
+			return configSetErr(name, err.Error())
+		}
+		olds[name] = old
+	}
+	if _, ok := olds["requirepass"]; ok {
+		mdb.acl.setRequirePass(config.RequirePass())
+	}
+	_, appendOnly := olds["appendonly"]
+	_, appendFilename := olds["appendfilename"]
+	if appendOnly || appendFilename {
+		if err := mdb.reconfigureAof(); err != nil {
+			restore()
+			if _, ok := olds["requirepass"]; ok {
+				mdb.acl.setRequirePass(config.RequirePass())
+			}
+			name := "appendonly"
+			if !appendOnly {
+				name = "appendfilename"
+			}
+			return configSetErr(name, err.Error())
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+func configSetErr(name string, reason string) resp.Reply {
+	return reply.MakeErrReply("ERR CONFIG SET failed (possibly related to argument '" + name + "') - " + reason)
+}
+
+// reconfigureAof 让 AOF 与当前的 appendonly appendfilename 一致
+// 开启或者切换文件时用当前的数据生成新的 AOF 文件 之后的写指令追加在后面
+func (mdb *StandaloneDatabase) reconfigureAof() error {
+	current := mdb.getAofHandler()
+	if !config.AppendOnly() {
+		if current == nil {
+			return nil
+		}
+		mdb.setAofHandler(nil)
+		return current.Close()
+	}
+	filename := config.AppendFilename()
+	if current != nil && current.Filename() == filename {
+		return nil
+	}
+	handler := aof.MakeAOFHandler(mdb, filename)
+	// 先接收写指令再生成快照 快照之后的写指令不会丢失
+	mdb.setAofHandler(handler)
+	if err := handler.Start(mdb.aofSnapshot); err != nil {
+		mdb.setAofHandler(current)
+		return err
+	}
+	logger.Info("AOF enabled, writing to " + filename)
+	if current != nil {
+		return current.Close()
+	}
+	return nil
+}
+
+// aofSnapshot 把所有分 DB 的数据转换成写指令
+func (mdb *StandaloneDatabase) aofSnapshot(write func(dbIndex int, cmdLine aof.CmdLine) error) error {
+	var err error
+	for i := range mdb.dbSet {
+		mdb.ForEach(i, func(key string, entity *database.DataEntity) bool {
+			switch val := entity.Data.(type) {
+			case []byte:
+				err = write(i, aof.CmdLine{[]byte("SET"), []byte(key), val})
+			default:
+				logger.Warn("aof snapshot: unsupported data type of key " + key)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
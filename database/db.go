@@ -4,8 +4,10 @@ import (
 	"go-redis/datastruct/dict"
 	"go-redis/interface/database"
 	"go-redis/interface/resp"
+	"go-redis/lib/lock"
 	"go-redis/resp/reply"
 	"strings"
+	"sync/atomic"
 )
 
 // DB 每一个 Redis 的分数据库
@@ -13,8 +15,22 @@ type DB struct {
 	index  int
 	data   dict.Dict
 	addAof func(CmdLine)
+	// locker 执行指令时锁住涉及的 key 分布式事务准备阶段会一直持有锁直到提交或回滚
+	locker *lock.Locks
+	// versionMap 存在的 key 最近一次被修改时的版本 WATCH 根据版本判断 key 是否被修改过
+	// key 被删除时移除 不会随着写过的 key 一直增长
+	versionMap dict.Dict
+	// seq 版本号的来源 每次修改加一 所以版本不会重复出现
+	seq uint32
+	// removedVersion 最近一次删除 key 时的版本 不存在的 key 都使用这个版本
+	// WATCH 一个不存在的 key 之后 它被创建或者任何 key 被删除都会让版本变化
+	removedVersion uint32
+	// scans SCAN 遍历使用的快照
+	scans *scanCache
 }
 
+const lockerSize = 1024
+
 // ExecFunc 所有的指令实现
 type ExecFunc func(db *DB, args [][]byte) resp.Reply
 
@@ -23,8 +39,11 @@ type CmdLine = [][]byte
 
 func makeDB() *DB {
 	db := &DB{
-		data:   dict.MakeSyncDict(),
-		addAof: func(line CmdLine) {}, // 给一个空的实现 防止恢复数据时出错
+		data:       dict.MakeSyncDict(),
+		addAof:     func(line CmdLine) {}, // 给一个空的实现 防止恢复数据时出错
+		locker:     lock.Make(lockerSize),
+		versionMap: dict.MakeSyncDict(),
+		scans:      makeScanCache(),
 	}
 	return db
 }
@@ -39,11 +58,66 @@ func (db *DB) Exec(c resp.Connection, cmdLine CmdLine) resp.Reply {
 	if !validateArity(cmd.arity, cmdLine) {
 		return reply.MakeArgNumErrReply(cmdName)
 	}
+	writeKeys, readKeys := cmd.prepare(cmdLine[1:])
+	db.locker.RWLocks(writeKeys, readKeys)
+	defer db.locker.RWUnLocks(writeKeys, readKeys)
 	fun := cmd.exector
 	// set k v 不需要第一个 set
 	return fun(db, cmdLine[1:])
 }
 
+// execWithLock 调用方已经持有相关 key 的锁 例如分布式事务的提交阶段
+func (db *DB) execWithLock(cmdLine CmdLine) resp.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok {
+		return reply.MakeErrReply("ERR unknown command" + cmdName)
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+	return cmd.exector(db, cmdLine[1:])
+}
+
+// touch key 的数据真正被修改时更新版本 没有修改数据的写指令和失败的指令不会改变版本
+func (db *DB) touch(key string) {
+	db.versionMap.Put(key, atomic.AddUint32(&db.seq, 1))
+}
+
+// untouch key 被删除时移除它的版本 同时更新不存在的 key 的版本
+// 先更新 removedVersion 再移除 期间读到的旧版本之后一定会变化
+func (db *DB) untouch(key string) {
+	atomic.StoreUint32(&db.removedVersion, atomic.AddUint32(&db.seq, 1))
+	db.versionMap.Remove(key)
+}
+
+// GetVersion 返回 key 当前的版本
+func (db *DB) GetVersion(key string) uint32 {
+	raw, ok := db.versionMap.Get(key)
+	if !ok {
+		return atomic.LoadUint32(&db.removedVersion)
+	}
+	return raw.(uint32)
+}
+
+// getRelatedKeys 返回指令要写和要读的 key
+func getRelatedKeys(cmdLine CmdLine) ([]string, []string) {
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok || !validateArity(cmd.arity, cmdLine) {
+		return nil, nil
+	}
+	return cmd.prepare(cmdLine[1:])
+}
+
+// getUndoLogs 在指令执行前生成回滚命令
+func (db *DB) getUndoLogs(cmdLine CmdLine) []CmdLine {
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok || cmd.undo == nil || !validateArity(cmd.arity, cmdLine) {
+		return nil
+	}
+	return cmd.undo(db, cmdLine[1:])
+}
+
 // validateArity 校验指令的参数是否符合要求
 // set k v arity = 3
 // Exists k1 k2 k3 k4 arity = -2 加个符号 数值为最小值 表示是否变长
@@ -71,19 +145,31 @@ func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
 // PutEntity int 指 put 多少个
 func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
 	// Put 形参为空接口 entity 实参自动旋换为 空接口
-	return db.data.Put(key, entity)
+	result := db.data.Put(key, entity)
+	db.touch(key)
+	return result
 }
 
 func (db *DB) PutIfExists(key string, entity *database.DataEntity) int {
-	return db.data.PutIfExists(key, entity)
+	result := db.data.PutIfExists(key, entity)
+	if result > 0 {
+		db.touch(key)
+	}
+	return result
 }
 
 func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
-	return db.data.PutIfAbsent(key, entity)
+	result := db.data.PutIfAbsent(key, entity)
+	if result > 0 {
+		db.touch(key)
+	}
+	return result
 }
 
 func (db *DB) Remove(key string) {
-	db.data.Remove(key)
+	if db.data.Remove(key) > 0 {
+		db.untouch(key)
+	}
 }
 
 func (db *DB) Removes(keys ...string) (deleted int) {
@@ -98,5 +184,9 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 }
 
 func (db *DB) Flush() {
+	// 被清空的 key 也算被修改 WATCH 它们的事务需要放弃
+	atomic.StoreUint32(&db.removedVersion, atomic.AddUint32(&db.seq, 1))
 	db.data.Clear()
+	db.versionMap.Clear()
+	db.scans.clear()
 }
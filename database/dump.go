@@ -0,0 +1,107 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+/*
+DUMP / RESTORE 在节点之间搬运一个 key
+序列化格式 类型(1 字节) + 数据 + CRC32(4 字节 小端) 校验和防止数据损坏
+*/
+
+const (
+	dumpTypeString byte = 0
+)
+
+var errBadPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// serializeEntity 把 DataEntity 编码成 DUMP 格式
+func serializeEntity(entity *database.DataEntity) ([]byte, error) {
+	var payload []byte
+	switch val := entity.Data.(type) {
+	case []byte:
+		payload = make([]byte, 0, len(val)+5)
+		payload = append(payload, dumpTypeString)
+		payload = append(payload, val...)
+	default:
+		return nil, errors.New("ERR unsupported data type")
+	}
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(payload))
+	return append(payload, sum...), nil
+}
+
+// deserializeEntity 校验并解码 DUMP 格式
+func deserializeEntity(data []byte) (*database.DataEntity, error) {
+	if len(data) < 5 {
+		return nil, errBadPayload
+	}
+	payload := data[:len(data)-4]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errBadPayload
+	}
+	switch payload[0] {
+	case dumpTypeString:
+		val := make([]byte, len(payload)-1)
+		copy(val, payload[1:])
+		return &database.DataEntity{Data: val}, nil
+	}
+	return nil, errBadPayload
+}
+
+// execDump DUMP key
+func execDump(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return reply.MakeNullBulkReply()
+	}
+	data, err := serializeEntity(entity)
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return reply.MakeBulkReply(data)
+}
+
+// execRestore RESTORE key ttl serialized-value [REPLACE]
+// 过期时间暂未实现 ttl 只做校验
+func execRestore(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || ttl < 0 {
+		return reply.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace := false
+	for _, arg := range args[3:] {
+		if strings.ToLower(string(arg)) == "replace" {
+			replace = true
+		} else {
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return reply.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := deserializeEntity(args[2])
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	db.PutEntity(key, entity)
+	db.addAof(utils.ToCmdLine2("Restore", args...))
+	return reply.MakeOkReply()
+}
+
+func init() {
+	RegisterCommand("Dump", execDump, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("Restore", execRestore, writeFirstKey, undoFirstKey, -4, flagWrite)
+	// 迁移时目标节点的槽位还不属于自己 集群用它跳过重定向
+	RegisterCommand("Restore-Asking", execRestore, writeFirstKey, undoFirstKey, -4, flagWrite)
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+// serverVersion 对客户端宣称的 Redis 版本
+const serverVersion = "7.0.0"
+
+// execHello HELLO [protover [AUTH username password] [SETNAME clientname]] 切换连接使用的协议 返回服务端的信息
+// 还没有认证的客户端可以通过 AUTH 选项同时完成认证
+func execHello(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	protocol := c.GetProtocol()
+	if len(args) > 0 {
+		var err error
+		protocol, err = strconv.Atoi(string(args[0]))
+		if err != nil {
+			return reply.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if protocol != reply.Resp2 && protocol != reply.Resp3 {
+			return reply.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+	}
+	setName := ""
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "auth" && i+2 < len(args):
+			if ret := mdb.authenticate(c, string(args[i+1]), string(args[i+2])); reply.IsErrorReply(ret) {
+				return ret
+			}
+			i += 2
+		case option == "setname" && i+1 < len(args):
+			if errReply := validateClientName(string(args[i+1])); errReply != nil {
+				return errReply
+			}
+			setName = string(args[i+1])
+			i++
+		default:
+			return reply.MakeErrReply("ERR Syntax error in HELLO option '" + option + "'")
+		}
+	}
+	if !c.IsInternal() && mdb.currentUser(c) == nil {
+		return reply.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	c.SetProtocol(protocol)
+	if setName != "" {
+		c.SetName(setName)
+	}
+	mode := "standalone"
+	if config.IsCluster() {
+		mode = "cluster"
+	}
+	return reply.MakeMapReplyFromPairs(
+		reply.MakeBulkReply([]byte("server")), reply.MakeBulkReply([]byte("redis")),
+		reply.MakeBulkReply([]byte("version")), reply.MakeBulkReply([]byte(serverVersion)),
+		reply.MakeBulkReply([]byte("proto")), reply.MakeIntReply(int64(c.GetProtocol())),
+		reply.MakeBulkReply([]byte("id")), reply.MakeIntReply(int64(c.GetID())),
+		reply.MakeBulkReply([]byte("mode")), reply.MakeBulkReply([]byte(mode)),
+		reply.MakeBulkReply([]byte("role")), reply.MakeBulkReply([]byte("master")),
+		reply.MakeBulkReply([]byte("modules")), &reply.EmptyMultiBulkReply{},
+	)
+}
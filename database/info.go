@@ -0,0 +1,234 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/stats"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+INFO [section ...] 返回服务端的状态 每个 section 以 # Name 开头 每行是 field:value
+没有参数或者 default all everything 时返回所有 section 不认识的 section 忽略
+*/
+
+// infoSections 按顺序输出的 section
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cluster", "keyspace"}
+
+// runID 每次启动随机生成 用来区分重启前后的实例
+var runID = randomHex(20)
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// infoBuilder 逐行拼接 field:value
+type infoBuilder struct {
+	strings.Builder
+}
+
+func (b *infoBuilder) field(name string, value string) {
+	b.WriteString(name + ":" + value + "\r\n")
+}
+
+func (b *infoBuilder) intField(name string, value int64) {
+	b.field(name, strconv.FormatInt(value, 10))
+}
+
+// execInfo INFO [section ...]
+func execInfo(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		section := strings.ToLower(string(arg))
+		if section == "default" || section == "all" || section == "everything" {
+			wanted = nil
+			break
+		}
+		wanted[section] = true
+	}
+	if len(args) == 0 {
+		wanted = nil
+	}
+	var sections []string
+	for _, section := range infoSections {
+		if wanted != nil && !wanted[section] {
+			continue
+		}
+		b := &infoBuilder{}
+		b.WriteString("# " + strings.ToUpper(section[:1]) + section[1:] + "\r\n")
+		switch section {
+		case "server":
+			mdb.infoServer(b)
+		case "clients":
+			mdb.infoClients(b)
+		case "memory":
+			infoMemory(b)
+		case "persistence":
+			mdb.infoPersistence(b)
+		case "stats":
+			infoStats(b)
+		case "replication":
+			infoReplication(b)
+		case "cluster":
+			mdb.infoCluster(b)
+		case "keyspace":
+			mdb.infoKeyspace(b)
+		}
+		sections = append(sections, b.String())
+	}
+	return reply.MakeVerbatimReply("txt", []byte(strings.Join(sections, "\r\n")))
+}
+
+func (mdb *StandaloneDatabase) infoServer(b *infoBuilder) {
+	mode := "standalone"
+	if config.IsCluster() {
+		mode = "cluster"
+	}
+	uptime := time.Since(stats.StartTime)
+	executable, _ := os.Executable()
+	b.field("redis_version", serverVersion)
+	b.field("redis_mode", mode)
+	b.field("os", runtime.GOOS+" "+runtime.GOARCH)
+	b.intField("arch_bits", strconv.IntSize)
+	b.field("go_version", runtime.Version())
+	b.intField("process_id", int64(os.Getpid()))
+	b.field("run_id", runID)
+	b.intField("tcp_port", int64(config.Properties.Port))
+	b.intField("server_time_usec", time.Now().UnixMicro())
+	b.intField("uptime_in_seconds", int64(uptime/time.Second))
+	b.intField("uptime_in_days", int64(uptime/(24*time.Hour)))
+	b.field("executable", executable)
+}
+
+func (mdb *StandaloneDatabase) infoClients(b *infoBuilder) {
+	var connected int64
+	mdb.forEachClient(func(conn *connection.Connection) bool {
+		connected++
+		return true
+	})
+	b.intField("connected_clients", connected)
+	b.intField("maxclients", int64(config.MaxClients()))
+	b.intField("blocked_clients", 0)
+	paused := "none"
+	mdb.pause.mu.Lock()
+	if time.Now().Before(mdb.pause.until) {
+		paused = "client_pause"
+	}
+	mdb.pause.mu.Unlock()
+	b.field("paused_reason", paused)
+}
+
+func infoMemory(b *infoBuilder) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	b.intField("used_memory", int64(mem.HeapAlloc))
+	b.field("used_memory_human", humanBytes(int64(mem.HeapAlloc)))
+	b.intField("used_memory_rss", int64(mem.Sys))
+	b.field("used_memory_rss_human", humanBytes(int64(mem.Sys)))
+	b.intField("maxmemory", 0)
+	b.field("maxmemory_human", "0B")
+	b.field("mem_allocator", "go")
+	// Go 运行时特有的指标
+	b.intField("go_heap_objects", int64(mem.HeapObjects))
+	b.intField("go_num_gc", int64(mem.NumGC))
+	b.intField("go_gc_pause_total_ms", int64(mem.PauseTotalNs/uint64(time.Millisecond)))
+	b.intField("go_goroutines", int64(runtime.NumGoroutine()))
+}
+
+// humanBytes 与 Redis 相同的格式 1.50K 2.00M
+func humanBytes(n int64) string {
+	units := []string{"K", "M", "G", "T"}
+	if n < 1024 {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	value := float64(n)
+	unit := ""
+	for _, u := range units {
+		if value < 1024 {
+			break
+		}
+		value /= 1024
+		unit = u
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64) + unit
+}
+
+func (mdb *StandaloneDatabase) infoPersistence(b *infoBuilder) {
+	b.intField("loading", 0)
+	aofHandler := mdb.getAofHandler()
+	if aofHandler == nil {
+		b.intField("aof_enabled", 0)
+		b.intField("aof_rewrite_in_progress", 0)
+		b.field("aof_last_write_status", "ok")
+		return
+	}
+	status := "ok"
+	if !aofHandler.LastWriteOK() {
+		status = "err"
+	}
+	b.intField("aof_enabled", 1)
+	b.intField("aof_rewrite_in_progress", 0)
+	b.field("aof_last_write_status", status)
+	b.intField("aof_current_size", aofHandler.Size())
+	b.intField("aof_buffer_length", int64(aofHandler.Pending()))
+}
+
+func infoStats(b *infoBuilder) {
+	b.intField("total_connections_received", stats.ConnectionsReceived.Get())
+	b.intField("total_commands_processed", stats.CommandsProcessed.Get())
+	b.intField("total_net_input_bytes", stats.NetInputBytes.Get())
+	b.intField("total_net_output_bytes", stats.NetOutputBytes.Get())
+	b.intField("rejected_connections", stats.RejectedConnections.Get())
+	b.intField("total_error_replies", stats.ErrorReplies.Get())
+}
+
+// infoReplication 没有主从复制 集群的只读副本由 owner 单向转发 不计入
+func infoReplication(b *infoBuilder) {
+	b.field("role", "master")
+	b.intField("connected_slaves", 0)
+	b.field("master_replid", runID)
+	b.intField("master_repl_offset", 0)
+}
+
+// ClusterInfo 返回集群状态 每项为 field:value 由集群模式的数据库设置
+type ClusterInfo func() []string
+
+// SetClusterInfo 集群模式下 INFO cluster 额外输出集群的健康状态
+func (mdb *StandaloneDatabase) SetClusterInfo(info ClusterInfo) {
+	mdb.clusterInfo = info
+}
+
+func (mdb *StandaloneDatabase) infoCluster(b *infoBuilder) {
+	enabled := int64(0)
+	if config.IsCluster() {
+		enabled = 1
+	}
+	b.intField("cluster_enabled", enabled)
+	if mdb.clusterInfo == nil {
+		return
+	}
+	for _, line := range mdb.clusterInfo() {
+		b.WriteString(line + "\r\n")
+	}
+}
+
+// infoKeyspace 只列出有 key 的库
+func (mdb *StandaloneDatabase) infoKeyspace(b *infoBuilder) {
+	for i, db := range mdb.dbSet {
+		keys := db.data.Len()
+		if keys == 0 {
+			continue
+		}
+		b.field("db"+strconv.Itoa(i), "keys="+strconv.Itoa(keys)+",expires=0,avg_ttl=0")
+	}
+}
@@ -43,17 +43,25 @@ func execFlushDB(db *DB, args [][]byte) resp.Reply {
 
 // Type k1
 func execType(db *DB, args [][]byte) resp.Reply {
-	key := string(args[0])
+	typeName := db.typeOf(string(args[0]))
+	if typeName == "" {
+		return &reply.UnknownErrReply{}
+	}
+	return reply.MakeStatusReply(typeName)
+}
+
+// typeOf 返回 key 的类型名 不存在时为 none
+func (db *DB) typeOf(key string) string {
 	entity, exists := db.GetEntity(key)
 	if !exists {
-		return reply.MakeStatusReply("none")
+		return "none"
 	}
 	switch entity.Data.(type) {
 	// string 保存的是 []byte
 	case []byte:
-		return reply.MakeStatusReply("string")
+		return "string"
 	}
-	return &reply.UnknownErrReply{}
+	return ""
 }
 
 // Rename k1 k2 k1:v k2:v
@@ -70,6 +78,11 @@ func execRename(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeOkReply()
 }
 
+// prepareRename 源 key 和目标 key 都会被修改
+func prepareRename(args [][]byte) ([]string, []string) {
+	return []string{string(args[0]), string(args[1])}, nil
+}
+
 // Renamenx k1 k2 k1:v k2:v 查看原来是否有 k2:v
 func execRenamenx(db *DB, args [][]byte) resp.Reply {
 	src := string(args[0])
@@ -101,12 +114,28 @@ func execKeys(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeMultiBulkReply(result)
 }
 
+// DBSize 当前 DB 中 key 的数量
+func execDBSize(db *DB, args [][]byte) resp.Reply {
+	return reply.MakeIntReply(int64(db.data.Len()))
+}
+
+// RandomKey 随机返回一个 key 空库返回 nil
+func execRandomKey(db *DB, args [][]byte) resp.Reply {
+	keys := db.data.RandomKeys(1)
+	if len(keys) == 0 {
+		return reply.MakeNullBulkReply()
+	}
+	return reply.MakeBulkReply([]byte(keys[0]))
+}
+
 func init() {
-	RegisterCommand("DEL", execDel, -2)
-	RegisterCommand("EXISTS", execExists, -2)
-	RegisterCommand("flushdb", execFlushDB, 1)
-	RegisterCommand("Type", execType, 2)
-	RegisterCommand("Rename", execRename, 3) // rename k1 k2
-	RegisterCommand("Renamenx", execRenamenx, 3)
-	RegisterCommand("Keys", execKeys, 2) // keys *
+	RegisterCommand("DEL", execDel, writeAllKeys, undoAllKeys, -2, flagWrite)
+	RegisterCommand("EXISTS", execExists, readAllKeys, nil, -2, flagReadOnly)
+	RegisterCommand("flushdb", execFlushDB, noPrepare, nil, 1, flagWrite)
+	RegisterCommand("Type", execType, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("Rename", execRename, prepareRename, undoRename, 3, flagWrite) // rename k1 k2
+	RegisterCommand("Renamenx", execRenamenx, prepareRename, undoRename, 3, flagWrite)
+	RegisterCommand("Keys", execKeys, noPrepare, nil, 2, flagReadOnly) // keys *
+	RegisterCommand("DBSize", execDBSize, noPrepare, nil, 1, flagReadOnly)
+	RegisterCommand("RandomKey", execRandomKey, noPrepare, nil, 1, flagReadOnly)
 }
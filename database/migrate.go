@@ -0,0 +1,146 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/tlsutil"
+	"go-redis/lib/utils"
+	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execMigrate MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+// 逐个 DUMP 后发到目标节点 每个 key RESTORE 成功之后立即删除本地的 key
+func execMigrate(db *DB, args [][]byte) resp.Reply {
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	keys := make([]string, 0)
+	if len(args[2]) > 0 {
+		keys = append(keys, string(args[2]))
+	}
+	destDB, err := strconv.Atoi(string(args[3]))
+	if err != nil || destDB < 0 {
+		return reply.MakeErrReply("ERR invalid DB index")
+	}
+	timeout, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil || timeout < 0 {
+		return reply.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	copyKey, replace := false, false
+	var authArgs [][]byte // 目标节点需要认证时发送的 AUTH 参数
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "copy":
+			copyKey = true
+		case "replace":
+			replace = true
+		case "auth":
+			if i+1 >= len(args) {
+				return reply.MakeSyntaxErrReply()
+			}
+			authArgs = args[i+1 : i+2]
+			i++
+		case "auth2":
+			if i+2 >= len(args) {
+				return reply.MakeSyntaxErrReply()
+			}
+			authArgs = args[i+1 : i+3]
+			i += 2
+		case "keys":
+			if len(args[2]) > 0 {
+				return reply.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(args)
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+
+	// 只迁移存在的 key
+	payloads := make(map[string][]byte)
+	for _, key := range keys {
+		entity, exists := db.GetEntity(key)
+		if !exists {
+			continue
+		}
+		data, err := serializeEntity(entity)
+		if err != nil {
+			return reply.MakeErrReply(err.Error())
+		}
+		payloads[key] = data
+	}
+	if len(payloads) == 0 {
+		return reply.MakeStatusReply("NOKEY")
+	}
+
+	tlsConfig, err := tlsutil.ClusterClientConfig()
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	peer, err := client.MakeTLSClient(addr, tlsConfig)
+	if err != nil {
+		return reply.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	peer.SetTimeout(time.Duration(timeout) * time.Millisecond)
+	peer.Start()
+	defer peer.Close()
+	if authArgs != nil {
+		ret := peer.Auth(authArgs)
+		if reply.IsErrorReply(ret) {
+			return ret
+		}
+	}
+	ret := peer.Send(utils.ToCmdLine("SELECT", strconv.Itoa(destDB)))
+	if reply.IsErrorReply(ret) {
+		return ret
+	}
+	for key, data := range payloads {
+		cmdLine := utils.ToCmdLine("RESTORE-ASKING", key, "0")
+		cmdLine = append(cmdLine, data)
+		if replace {
+			cmdLine = append(cmdLine, []byte("REPLACE"))
+		}
+		ret = peer.Send(cmdLine)
+		if reply.IsErrorReply(ret) {
+			return ret
+		}
+		// RESTORE 成功后立即删除 执行期间 key 一直被锁住 不会有写入丢失
+		if !copyKey {
+			db.Remove(key)
+			db.addAof(utils.ToCmdLine("Del", key))
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+// prepareMigrate MIGRATE 要写的 key 是 key 参数和 KEYS 之后的所有参数 执行期间加锁
+// ACL 同样按这些 key 检查权限 AUTH 的参数不是 key
+func prepareMigrate(args [][]byte) ([]string, []string) {
+	var keys []string
+	if len(args) > 2 && len(args[2]) > 0 {
+		keys = append(keys, string(args[2]))
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "auth":
+			i++
+		case "auth2":
+			i += 2
+		case "keys":
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			return keys, nil
+		}
+	}
+	return keys, nil
+}
+
+func init() {
+	RegisterCommand("Migrate", execMigrate, prepareMigrate, nil, -6, flagWrite)
+}
@@ -12,5 +12,5 @@ func Ping(db *DB, args [][]byte) resp.Reply {
 // init 相当于特殊关键字
 // 包在启动的时候就会调用
 func init() {
-	RegisterCommand("ping", Ping, 1)
+	RegisterCommand("ping", Ping, noPrepare, nil, 1, 0)
 }
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/wildcard"
+	"go-redis/resp/reply"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+底层的 sync.Map 没有稳定的遍历顺序 所以按 key 的哈希值排序遍历
+游标 0 时生成一份按哈希值排序的快照 之后的调用在快照上二分查找 每次只花费 O(log N + COUNT)
+游标的 32 到 53 位是快照的编号 低 32 位是下一次开始的哈希值 返回 0 表示遍历结束
+集群把节点序号放在游标的低 10 位 所以单机的游标不能超过 54 位
+快照已经过期时重新生成一份 从同一个哈希值继续 所以遍历期间一直存在的 key 至少会被返回一次
+快照之后删除的 key 不会返回 新增的 key 可能不会返回 哈希值相同的 key 总是在同一批返回
+*/
+
+const (
+	defaultScanCount = 10
+	// maxScanSnapshots 每个 DB 同时保留的快照数量 scanSnapshotTTL 快照最长的保留时间
+	maxScanSnapshots = 16
+	scanSnapshotTTL  = time.Minute
+	// scanSnapshotBits 游标中快照编号占用的位数
+	scanSnapshotBits = 22
+)
+
+type scanEntry struct {
+	hash uint32
+	key  string
+}
+
+func scanHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+type scanSnapshot struct {
+	entries []scanEntry // 按哈希值排序
+	created time.Time
+}
+
+// scanCache 正在进行的 SCAN 遍历使用的快照
+type scanCache struct {
+	mu        sync.Mutex
+	snapshots map[uint32]*scanSnapshot
+	nextID    uint32
+}
+
+func makeScanCache() *scanCache {
+	return &scanCache{
+		snapshots: make(map[uint32]*scanSnapshot),
+	}
+}
+
+// get 找到游标对应的快照 不存在或者过期时生成一份新的
+func (sc *scanCache) get(db *DB, id uint32) (uint32, *scanSnapshot) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	now := time.Now()
+	for snapshotID, snapshot := range sc.snapshots {
+		if now.Sub(snapshot.created) > scanSnapshotTTL {
+			delete(sc.snapshots, snapshotID)
+		}
+	}
+	if snapshot, ok := sc.snapshots[id]; ok {
+		return id, snapshot
+	}
+	if len(sc.snapshots) >= maxScanSnapshots {
+		// 丢弃最旧的 对应的遍历之后会重新生成快照
+		var oldestID uint32
+		var oldest *scanSnapshot
+		for snapshotID, snapshot := range sc.snapshots {
+			if oldest == nil || snapshot.created.Before(oldest.created) {
+				oldestID, oldest = snapshotID, snapshot
+			}
+		}
+		delete(sc.snapshots, oldestID)
+	}
+	entries := make([]scanEntry, 0)
+	db.data.ForEach(func(key string, val interface{}) bool {
+		entries = append(entries, scanEntry{hash: scanHash(key), key: key})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].hash < entries[j].hash
+	})
+	sc.nextID = (sc.nextID + 1) & (1<<scanSnapshotBits - 1)
+	if sc.nextID == 0 {
+		sc.nextID++
+	}
+	snapshot := &scanSnapshot{entries: entries, created: now}
+	sc.snapshots[sc.nextID] = snapshot
+	return sc.nextID, snapshot
+}
+
+func (sc *scanCache) remove(id uint32) {
+	sc.mu.Lock()
+	delete(sc.snapshots, id)
+	sc.mu.Unlock()
+}
+
+// clear FLUSHDB 之后快照中的 key 都已经不存在
+func (sc *scanCache) clear() {
+	sc.mu.Lock()
+	sc.snapshots = make(map[uint32]*scanSnapshot)
+	sc.mu.Unlock()
+}
+
+// execScan SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func execScan(db *DB, args [][]byte) resp.Reply {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	var pattern *wildcard.Pattern
+	count := defaultScanCount
+	typeName := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return reply.MakeSyntaxErrReply()
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = wildcard.CompilePattern(string(args[i+1]))
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				return reply.MakeSyntaxErrReply()
+			}
+		case "type":
+			typeName = strings.ToLower(string(args[i+1]))
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+
+	id, snapshot := db.scans.get(db, uint32(cursor>>32)&(1<<scanSnapshotBits-1))
+	position := uint32(cursor)
+	entries := snapshot.entries
+	start := sort.Search(len(entries), func(i int) bool {
+		return entries[i].hash >= position
+	})
+	keys := make([][]byte, 0, count)
+	var next uint64
+	for i := start; i < len(entries); i++ {
+		entry := entries[i]
+		// 哈希值相同的 key 不能被拆到两批中
+		if i-start >= count && entry.hash != entries[i-1].hash {
+			next = uint64(id)<<32 | uint64(entry.hash)
+			break
+		}
+		if pattern != nil && !pattern.IsMatch(entry.key) {
+			continue
+		}
+		// 快照之后被删除的 key 不返回
+		if _, exists := db.GetEntity(entry.key); !exists {
+			continue
+		}
+		if typeName != "" && typeName != db.typeOf(entry.key) {
+			continue
+		}
+		keys = append(keys, []byte(entry.key))
+	}
+	if next == 0 {
+		db.scans.remove(id)
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(next, 10))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
+
+func init() {
+	RegisterCommand("Scan", execScan, noPrepare, nil, -2, flagReadOnly)
+}
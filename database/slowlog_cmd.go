@@ -0,0 +1,79 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/slowlog"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSlowlogGetCount SLOWLOG GET 不指定数量时返回的记录数
+const defaultSlowlogGetCount = 10
+
+// RecordSlowlog 命令执行完之后调用 start 是等待 CLIENT PAUSE 结束 开始执行的时间
+// 内部的伪连接执行的命令不记录
+func RecordSlowlog(c resp.Connection, cmdLine [][]byte, start time.Time) {
+	if c.IsInternal() {
+		return
+	}
+	duration := time.Since(start)
+	addr := ""
+	if conn, ok := c.(*connection.Connection); ok {
+		addr = conn.Addr()
+	}
+	slowlog.Record(FullCommandName(cmdLine), cmdLine, duration, addr, c.GetName())
+}
+
+// execSlowlog SLOWLOG GET [count]|LEN|RESET
+func execSlowlog(c resp.Connection, mdb *StandaloneDatabase, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("slowlog")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "get":
+		if len(args) > 2 {
+			return reply.MakeArgNumErrReply("slowlog|get")
+		}
+		count := defaultSlowlogGetCount
+		if len(args) == 2 {
+			n, err := strconv.Atoi(string(args[1]))
+			if err != nil || n < -1 {
+				return reply.MakeErrReply("ERR count should be greater than or equal to -1")
+			}
+			count = n
+		}
+		return slowlogToReply(slowlog.Get(count))
+	case "len":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("slowlog|len")
+		}
+		return reply.MakeIntReply(int64(slowlog.Len()))
+	case "reset":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("slowlog|reset")
+		}
+		slowlog.Reset()
+		return reply.MakeOkReply()
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try SLOWLOG HELP.")
+}
+
+// slowlogToReply 每条记录是 id 时间戳 微秒 参数 客户端地址 客户端名字
+func slowlogToReply(entries []*slowlog.Entry) resp.Reply {
+	result := make([]resp.Reply, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeIntReply(entry.ID),
+			reply.MakeIntReply(entry.Time.Unix()),
+			reply.MakeIntReply(int64(entry.Duration / time.Microsecond)),
+			reply.MakeMultiBulkReply(entry.Args),
+			reply.MakeBulkReply([]byte(entry.Addr)),
+			reply.MakeBulkReply([]byte(entry.Name)),
+		}))
+	}
+	return reply.MakeMultiRawReply(result)
+}
@@ -3,22 +3,52 @@ package database
 import (
 	"go-redis/aof"
 	"go-redis/config"
+	"go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/lib/logger"
 	"go-redis/resp/reply"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // StandaloneDatabase 成员由 DB 组成
 type StandaloneDatabase struct {
 	dbSet      []*DB
 	aofHandler *aof.AofHandler // 加个参数名 不加参数名就成组合了
+	// aofMu CONFIG SET appendonly 会在运行时替换 aofHandler
+	aofMu sync.RWMutex
+	// writeListeners 每个写指令执行后调用 与 AOF 收到的命令相同 集群用来向副本转发
+	writeListeners []func(dbIndex int, cmdLine CmdLine)
+	// acl 用户和权限 aclLog 记录认证失败和被拒绝的命令
+	acl    *aclTable
+	aclLog *aclLog
+	// clientLister 遍历客户端连接 pause CLIENT PAUSE 的状态
+	clientLister ClientLister
+	pause        *clientPause
+	// clusterInfo 集群模式下 INFO cluster 输出的集群状态
+	clusterInfo ClusterInfo
+	// configMu CONFIG SET 同一时间只有一个在修改配置和执行副作用
+	configMu sync.Mutex
+	// skipSlowlog 作为集群的本地数据库时为 true 由集群的 Exec 记录 SLOWLOG 避免重复
+	skipSlowlog bool
 }
 
 // NewStandaloneDatabase 初始化
 func NewStandaloneDatabase() *StandaloneDatabase {
-	mdb := &StandaloneDatabase{}
+	mdb := &StandaloneDatabase{
+		acl:    makeACLTable(),
+		aclLog: makeACLLog(),
+		pause:  makeClientPause(),
+	}
+	if config.Properties.AclFile != "" {
+		if err := mdb.acl.load(config.Properties.AclFile); err != nil && !os.IsNotExist(err) {
+			// 与 AOF 相同 启动时 ACL 文件有错误就不能继续
+			panic(err)
+		}
+	}
 	if config.Properties.Databases == 0 {
 		config.Properties.Databases = 16
 	}
@@ -28,25 +58,31 @@ func NewStandaloneDatabase() *StandaloneDatabase {
 		singleDB.index = i
 		mdb.dbSet[i] = singleDB
 	}
-	if config.Properties.AppendOnly {
+	if config.AppendOnly() {
 		aofHandler, err := aof.NewAOFHandler(mdb)
 		if err != nil {
 			// 因为这是在启动的过程中报 panic
 			panic(err)
 		}
 		mdb.aofHandler = aofHandler
-		for _, db := range mdb.dbSet {
-			// 引用第二遍时 发生逃逸到了 堆上
-			// 闭包问题 引用外部的变量会变
-			sdb := db // sdb 在引用第二次时 可能名字相同 但是地址已经不同了
-			sdb.addAof = func(line CmdLine) {
-				mdb.aofHandler.AddAof(sdb.index, line)
-			}
+	}
+	// 加载 AOF 时 addAof 还是空的实现 加载完成之后才记录写指令
+	for _, db := range mdb.dbSet {
+		// 引用第二遍时 发生逃逸到了 堆上
+		// 闭包问题 引用外部的变量会变
+		sdb := db // sdb 在引用第二次时 可能名字相同 但是地址已经不同了
+		sdb.addAof = func(line CmdLine) {
+			mdb.afterWrite(sdb.index, line)
 		}
 	}
 	return mdb
 }
 
+// SkipSlowlog 集群的 Exec 已经记录 SLOWLOG 本地执行时不再记录
+func (mdb *StandaloneDatabase) SkipSlowlog() {
+	mdb.skipSlowlog = true
+}
+
 // Exec 把用户的指令转交给 分 DB
 // parameter `cmdLine` contains command and its arguments, for example: "set key value"
 func (mdb *StandaloneDatabase) Exec(c resp.Connection, cmdLine [][]byte) (result resp.Reply) {
@@ -58,12 +94,42 @@ func (mdb *StandaloneDatabase) Exec(c resp.Connection, cmdLine [][]byte) (result
 
 	// 特殊指令 select 1,2
 	cmdName := strings.ToLower(string(cmdLine[0]))
+	if errReply := mdb.CheckPermission(c, cmdLine); errReply != nil {
+		return errReply
+	}
+	mdb.WaitIfPaused(c, cmdName)
+	// 等待 CLIENT PAUSE 的时间不计入 SLOWLOG
+	if !mdb.skipSlowlog {
+		start := time.Now()
+		defer RecordSlowlog(c, cmdLine, start)
+	}
+	if cmdName == "auth" {
+		return execAuth(c, mdb, cmdLine[1:])
+	}
+	if cmdName == "client" {
+		return execClient(c, mdb, cmdLine[1:])
+	}
+	if cmdName == "info" {
+		return execInfo(c, mdb, cmdLine[1:])
+	}
+	if cmdName == "acl" {
+		return execACL(c, mdb, cmdLine[1:])
+	}
+	if cmdName == "config" {
+		return execConfig(c, mdb, cmdLine[1:])
+	}
+	if cmdName == "slowlog" {
+		return execSlowlog(c, mdb, cmdLine[1:])
+	}
 	if cmdName == "select" {
 		if len(cmdLine) != 2 {
 			return reply.MakeArgNumErrReply("select")
 		}
 		return execSelect(c, mdb, cmdLine[1:])
 	}
+	if cmdName == "hello" {
+		return execHello(c, mdb, cmdLine[1:])
+	}
 	// 一般的指令
 	dbIndex := c.GetDBIndex()
 	selectedDB := mdb.dbSet[dbIndex]
@@ -71,6 +137,78 @@ func (mdb *StandaloneDatabase) Exec(c resp.Connection, cmdLine [][]byte) (result
 	return selectedDB.Exec(c, cmdLine)
 }
 
+// afterWrite 写指令执行之后 追加到 AOF 并通知监听者
+func (mdb *StandaloneDatabase) afterWrite(dbIndex int, cmdLine CmdLine) {
+	if aofHandler := mdb.getAofHandler(); aofHandler != nil {
+		aofHandler.AddAof(dbIndex, cmdLine)
+	}
+	for _, listener := range mdb.writeListeners {
+		listener(dbIndex, cmdLine)
+	}
+}
+
+func (mdb *StandaloneDatabase) getAofHandler() *aof.AofHandler {
+	mdb.aofMu.RLock()
+	defer mdb.aofMu.RUnlock()
+	return mdb.aofHandler
+}
+
+func (mdb *StandaloneDatabase) setAofHandler(handler *aof.AofHandler) {
+	mdb.aofMu.Lock()
+	mdb.aofHandler = handler
+	mdb.aofMu.Unlock()
+}
+
+// AddWriteListener 注册写指令的监听者 需要在开始处理请求之前调用
+func (mdb *StandaloneDatabase) AddWriteListener(listener func(dbIndex int, cmdLine CmdLine)) {
+	mdb.writeListeners = append(mdb.writeListeners, listener)
+}
+
+// ForEach 遍历某个分 DB 中的所有 key  集群按槽位统计 key 时使用
+func (mdb *StandaloneDatabase) ForEach(dbIndex int, cb func(key string, entity *database.DataEntity) bool) {
+	if dbIndex < 0 || dbIndex >= len(mdb.dbSet) {
+		return
+	}
+	mdb.dbSet[dbIndex].data.ForEach(func(key string, val interface{}) bool {
+		entity, _ := val.(*database.DataEntity)
+		return cb(key, entity)
+	})
+}
+
+// Exists 判断某个分 DB 中 key 是否存在
+func (mdb *StandaloneDatabase) Exists(dbIndex int, key string) bool {
+	if dbIndex < 0 || dbIndex >= len(mdb.dbSet) {
+		return false
+	}
+	_, exists := mdb.dbSet[dbIndex].GetEntity(key)
+	return exists
+}
+
+// RWLocks 锁住某个分 DB 的 key 分布式事务准备阶段使用
+func (mdb *StandaloneDatabase) RWLocks(dbIndex int, writeKeys []string, readKeys []string) {
+	mdb.dbSet[dbIndex].locker.RWLocks(writeKeys, readKeys)
+}
+
+// RWUnLocks 释放 RWLocks 加的锁
+func (mdb *StandaloneDatabase) RWUnLocks(dbIndex int, writeKeys []string, readKeys []string) {
+	mdb.dbSet[dbIndex].locker.RWUnLocks(writeKeys, readKeys)
+}
+
+// ExecWithLock 在调用方已经持有锁的情况下执行指令
+func (mdb *StandaloneDatabase) ExecWithLock(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	return mdb.dbSet[c.GetDBIndex()].execWithLock(cmdLine)
+}
+
+// GetRelatedKeys 返回指令要写和要读的 key
+func (mdb *StandaloneDatabase) GetRelatedKeys(cmdLine [][]byte) ([]string, []string) {
+	return getRelatedKeys(cmdLine)
+}
+
+// GetUndoLogs 生成指令的回滚命令 需要在指令执行前调用
+func (mdb *StandaloneDatabase) GetUndoLogs(dbIndex int, cmdLine [][]byte) []CmdLine {
+	return mdb.dbSet[dbIndex].getUndoLogs(cmdLine)
+}
+
 func (mdb *StandaloneDatabase) Close() {
 
 }
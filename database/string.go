@@ -68,9 +68,9 @@ func execStrLen(db *DB, args [][]byte) resp.Reply {
 }
 
 func init() {
-	RegisterCommand("Get", execGet, 2)
-	RegisterCommand("Set", execSet, -3)
-	RegisterCommand("SetNx", execSetNX, 3)
-	RegisterCommand("GetSet", execGetSet, 3)
-	RegisterCommand("StrLen", execStrLen, 2)
+	RegisterCommand("Get", execGet, readFirstKey, nil, 2, flagReadOnly)
+	RegisterCommand("Set", execSet, writeFirstKey, undoFirstKey, -3, flagWrite)
+	RegisterCommand("SetNx", execSetNX, writeFirstKey, undoFirstKey, 3, flagWrite)
+	RegisterCommand("GetSet", execGetSet, writeFirstKey, undoFirstKey, 3, flagWrite)
+	RegisterCommand("StrLen", execStrLen, readFirstKey, nil, 2, flagReadOnly)
 }
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strings"
+)
+
+// GetVersion 返回某个分 DB 中 key 的版本  WATCH 时记录
+func (mdb *StandaloneDatabase) GetVersion(dbIndex int, key string) uint32 {
+	if dbIndex < 0 || dbIndex >= len(mdb.dbSet) {
+		return 0
+	}
+	return mdb.dbSet[dbIndex].GetVersion(key)
+}
+
+// IsWatchingChanged WATCH 的 key 是否被修改过 调用方需要持有这些 key 的锁
+func (mdb *StandaloneDatabase) IsWatchingChanged(dbIndex int, watching map[string]uint32) bool {
+	for key, ver := range watching {
+		if mdb.GetVersion(dbIndex, key) != ver {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRelatedKeysOfCmdLines 一批指令涉及的所有 key  WATCH 的 key 作为读 key
+func (mdb *StandaloneDatabase) GetRelatedKeysOfCmdLines(cmdLines []CmdLine, watching map[string]uint32) ([]string, []string) {
+	var writeKeys, readKeys []string
+	for _, cmdLine := range cmdLines {
+		write, read := getRelatedKeys(cmdLine)
+		writeKeys = append(writeKeys, write...)
+		readKeys = append(readKeys, read...)
+	}
+	for key := range watching {
+		readKeys = append(readKeys, key)
+	}
+	return writeKeys, readKeys
+}
+
+// ExecMulti 原子的执行事务中的一批指令
+// WATCH 的 key 被修改过时放弃执行 返回 *-1  单条指令出错不影响其他指令 与 Redis 一致
+func (mdb *StandaloneDatabase) ExecMulti(c resp.Connection, watching map[string]uint32, cmdLines []CmdLine) resp.Reply {
+	dbIndex := c.GetDBIndex()
+	writeKeys, readKeys := mdb.GetRelatedKeysOfCmdLines(cmdLines, watching)
+	mdb.RWLocks(dbIndex, writeKeys, readKeys)
+	defer mdb.RWUnLocks(dbIndex, writeKeys, readKeys)
+
+	if mdb.IsWatchingChanged(dbIndex, watching) {
+		return reply.MakeNullMultiBulkReply()
+	}
+	results := make([]resp.Reply, 0, len(cmdLines))
+	for _, cmdLine := range cmdLines {
+		results = append(results, mdb.ExecWithLock(c, cmdLine))
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+// CheckCmdLine 事务入队前检查指令是否存在 参数数量是否正确
+func (mdb *StandaloneDatabase) CheckCmdLine(cmdLine CmdLine) resp.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok {
+		return reply.MakeErrReply("ERR unknown command '" + cmdName + "'")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"go-redis/lib/utils"
+)
+
+/*
+分布式事务的回滚日志
+指令执行之前记录相关 key 的原始值 回滚时用 RESTORE 还原 原来不存在的 key 直接删除
+*/
+
+// undoKeys 生成恢复给定 key 的命令
+func undoKeys(db *DB, keys ...string) []CmdLine {
+	undoLog := make([]CmdLine, 0, len(keys))
+	for _, key := range keys {
+		entity, exists := db.GetEntity(key)
+		if !exists {
+			undoLog = append(undoLog, utils.ToCmdLine("DEL", key))
+			continue
+		}
+		data, err := serializeEntity(entity)
+		if err != nil {
+			continue
+		}
+		cmdLine := utils.ToCmdLine("RESTORE", key, "0")
+		cmdLine = append(cmdLine, data, []byte("REPLACE"))
+		undoLog = append(undoLog, cmdLine)
+	}
+	return undoLog
+}
+
+// undoFirstKey 只修改第一个 key 的指令
+func undoFirstKey(db *DB, args [][]byte) []CmdLine {
+	return undoKeys(db, string(args[0]))
+}
+
+// undoAllKeys 所有参数都是要修改的 key
+func undoAllKeys(db *DB, args [][]byte) []CmdLine {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+	return undoKeys(db, keys...)
+}
+
+// undoRename RENAME src dest 两个 key 都会被修改
+func undoRename(db *DB, args [][]byte) []CmdLine {
+	return undoKeys(db, string(args[0]), string(args[1]))
+}
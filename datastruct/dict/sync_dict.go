@@ -1,6 +1,9 @@
 package dict
 
-import "sync"
+import (
+	"math/rand"
+	"sync"
+)
 
 // SyncDict 并发安全的字典 最底层的结构 其上的结构是 16 个 DB
 type SyncDict struct {
@@ -69,8 +72,8 @@ func (dict *SyncDict) Remove(key string) (result int) {
 
 func (dict *SyncDict) ForEach(consumer Consumer) {
 	dict.m.Range(func(key, value interface{}) bool {
-		consumer(key.(string), value)
-		return true
+		// consumer 返回 false 时停止遍历
+		return consumer(key.(string), value)
 	})
 }
 
@@ -87,12 +90,18 @@ func (dict *SyncDict) Keys() []string {
 }
 
 func (dict *SyncDict) RandomKeys(limit int) []string {
-	result := make([]string, dict.Len())
+	size := dict.Len()
+	if size == 0 {
+		return []string{}
+	}
+	result := make([]string, limit)
 	for i := 0; i < limit; i++ {
-		// 随机的 从 Range 取出一个
+		// Range 的顺序并不随机 随机跳过若干个之后取出一个
+		skip := rand.Intn(size)
 		dict.m.Range(func(key, value interface{}) bool {
 			result[i] = key.(string)
-			return false
+			skip--
+			return skip >= 0
 		})
 	}
 	return result
@@ -100,14 +109,12 @@ func (dict *SyncDict) RandomKeys(limit int) []string {
 
 // RandomDistinctKeys 不能重复
 func (dict *SyncDict) RandomDistinctKeys(limit int) []string {
-	result := make([]string, dict.Len())
-	i := 0
+	result := make([]string, 0, limit)
 	dict.m.Range(func(key, value interface{}) bool {
-		result[i] = key.(string)
-		i++
-		if i == limit {
+		if len(result) == limit {
 			return false
 		}
+		result = append(result, key.(string))
 		return true
 	})
 	return result
@@ -6,4 +6,32 @@ type Connection interface {
 	Write([]byte) error // 给客户端回应
 	GetDBIndex() int    // 客户端连接的是哪个库
 	SelectDB(int)       // 切换库
+	SetAsking(bool)     // 集群迁移时 ASKING 之后的下一条命令允许访问正在导入的槽位
+	IsAsking() bool
+	SetReadOnly(bool) // 集群中 READONLY 之后只读指令可以发给副本
+	IsReadOnly() bool
+	SetProtocol(int) // HELLO 协商的协议版本 2 或 3
+	GetProtocol() int
+	SetUser(string) // AUTH 通过的 ACL 用户
+	GetUser() string
+	IsInternal() bool // 服务端内部使用的伪连接 AOF 加载和集群内部执行命令 不需要认证
+	GetID() uint64    // 连接的唯一 id CLIENT ID
+	SetName(string)   // CLIENT SETNAME 设置的名字
+	GetName() string
+
+	// MULTI 事务 EXEC 之前的命令都先放入队列
+	InMultiState() bool
+	SetMultiState(bool)
+	GetQueuedCmdLine() [][][]byte
+	EnqueueCmd([][]byte)
+	ClearQueuedCmds()
+	AddTxError(err error) // 入队时出错 EXEC 时整个事务放弃执行
+	GetTxErrors() []error
+	GetWatching() map[string]*WatchedKey // WATCH 的 key
+}
+
+// WatchedKey WATCH 时记录的 key 的版本 以及 key 当时所在的节点
+type WatchedKey struct {
+	Version uint32
+	Owner   string
 }
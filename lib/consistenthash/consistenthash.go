@@ -3,19 +3,44 @@ package consistenthash
 import (
 	"hash/crc32"
 	"sort"
+	"strconv"
+	"sync"
 )
 
+/*
+一致性哈希
+每个物理节点在环上放 replicas * weight 个虚拟节点 让 key 分布得更均匀
+环由节点集合排序后重新生成 所以不管节点以什么顺序加入 所有节点算出的环都相同
+第一个虚拟节点就是节点自己 replicas 为 1 且权重为 1 时和之前每个节点一个点的环完全相同
+*/
+
 type HashFunc func(data []byte) uint32
 
+// DefaultReplicas 每个物理节点默认的虚拟节点数量 保持和之前的版本相同 升级后 key 的归属不变
+// 需要更均匀的分布时显式指定 replicas 例如 160
+const DefaultReplicas = 1
+
+// MaxWeight 节点权重的上限 避免环上的虚拟节点过多
+const MaxWeight = 100
+
 type NodeMap struct {
+	mu          sync.RWMutex
 	hashFunc    HashFunc
+	replicas    int            // 权重为 1 的节点有多少个虚拟节点
+	weights     map[string]int // 物理节点 -> 权重
 	nodeHashs   []int
 	nodehashMap map[int]string
 }
 
-func NewNodeMap(fn HashFunc) *NodeMap {
+// NewNodeMap replicas 小于等于 0 时使用 DefaultReplicas
+func NewNodeMap(replicas int, fn HashFunc) *NodeMap {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
 	m := &NodeMap{
 		hashFunc:    fn,
+		replicas:    replicas,
+		weights:     make(map[string]int),
 		nodehashMap: make(map[int]string),
 	}
 	if m.hashFunc == nil {
@@ -25,23 +50,119 @@ func NewNodeMap(fn HashFunc) *NodeMap {
 }
 
 func (m *NodeMap) IsEmpty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.nodeHashs) == 0
 }
 
+// AddNode 以权重 1 加入节点 已经存在的节点保持原来的权重
 func (m *NodeMap) AddNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, key := range keys {
 		if key == "" {
 			continue
 		}
-		hash := int(m.hashFunc([]byte(key)))
-		m.nodeHashs = append(m.nodeHashs, hash)
-		m.nodehashMap[hash] = key
+		if _, ok := m.weights[key]; !ok {
+			m.weights[key] = 1
+		}
+	}
+	m.rebuild()
+}
+
+// AddNodeWithWeight 加入节点或修改节点的权重 权重越大分到的 key 越多 超过 MaxWeight 时按 MaxWeight 计算
+func (m *NodeMap) AddNodeWithWeight(key string, weight int) {
+	if key == "" || weight <= 0 {
+		return
+	}
+	if weight > MaxWeight {
+		weight = MaxWeight
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.weights[key] = weight
+	m.rebuild()
+}
+
+// RemoveNode 从环上移除节点 原来属于它的 key 由顺时针的下一个节点接管
+func (m *NodeMap) RemoveNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.weights, key)
+	}
+	m.rebuild()
+}
+
+// Weights 返回每个节点的权重
+func (m *NodeMap) Weights() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	weights := make(map[string]int, len(m.weights))
+	for node, weight := range m.weights {
+		weights[node] = weight
+	}
+	return weights
+}
+
+// Clone 复制一个相同的环 之后两个环互不影响
+func (m *NodeMap) Clone() *NodeMap {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	clone := NewNodeMap(m.replicas, m.hashFunc)
+	for node, weight := range m.weights {
+		clone.weights[node] = weight
+	}
+	clone.rebuild()
+	return clone
+}
+
+// Nodes 返回所有物理节点 按名字排序
+func (m *NodeMap) Nodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sortedNodes()
+}
+
+func (m *NodeMap) sortedNodes() []string {
+	nodes := make([]string, 0, len(m.weights))
+	for node := range m.weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// rebuild 重新生成哈希环 调用方需要持有写锁
+// 虚拟节点的哈希值冲突时 后放置的节点加盐重新计算 而不是覆盖之前的节点
+func (m *NodeMap) rebuild() {
+	m.nodeHashs = m.nodeHashs[:0]
+	m.nodehashMap = make(map[int]string)
+	for _, node := range m.sortedNodes() {
+		count := m.replicas * m.weights[node]
+		for i := 0; i < count; i++ {
+			virtual := node
+			if i > 0 {
+				virtual = strconv.Itoa(i) + node
+			}
+			hash := int(m.hashFunc([]byte(virtual)))
+			for salt := 1; ; salt++ {
+				if _, exists := m.nodehashMap[hash]; !exists {
+					break
+				}
+				hash = int(m.hashFunc([]byte(virtual + "#" + strconv.Itoa(salt))))
+			}
+			m.nodeHashs = append(m.nodeHashs, hash)
+			m.nodehashMap[hash] = node
+		}
 	}
 	sort.Ints(m.nodeHashs)
 }
 
 func (m *NodeMap) PickNode(key string) string {
-	if m.IsEmpty() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.nodeHashs) == 0 {
 		return ""
 	}
 	hash := int(m.hashFunc([]byte(key)))
@@ -53,3 +174,21 @@ func (m *NodeMap) PickNode(key string) string {
 	}
 	return m.nodehashMap[m.nodeHashs[idx]]
 }
+
+// Distribution 计算每个节点在哈希环上占的比例 即预计分到的 key 的比例
+// 每个虚拟节点负责从上一个虚拟节点到自己之间的区间
+func (m *NodeMap) Distribution() map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make(map[string]float64)
+	if len(m.nodeHashs) == 0 {
+		return result
+	}
+	const ringSize = float64(1 << 32)
+	prev := m.nodeHashs[len(m.nodeHashs)-1] - (1 << 32) // 第一个虚拟节点负责环尾绕回来的区间
+	for _, hash := range m.nodeHashs {
+		result[m.nodehashMap[hash]] += float64(hash-prev) / ringSize
+		prev = hash
+	}
+	return result
+}
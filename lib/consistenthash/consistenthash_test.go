@@ -0,0 +1,172 @@
+package consistenthash
+
+import (
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestDefaultRing 默认每个节点一个点 和之前直接对节点名做哈希的环相同
+func TestDefaultRing(t *testing.T) {
+	nodes := []string{"127.0.0.1:6379", "127.0.0.1:6380", "127.0.0.1:6381"}
+	m := NewNodeMap(0, nil)
+	m.AddNode(nodes...)
+	hashs := make([]int, 0, len(nodes))
+	owners := make(map[int]string)
+	for _, node := range nodes {
+		hash := int(crc32.ChecksumIEEE([]byte(node)))
+		hashs = append(hashs, hash)
+		owners[hash] = node
+	}
+	sort.Ints(hashs)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		hash := int(crc32.ChecksumIEEE([]byte(key)))
+		idx := sort.SearchInts(hashs, hash)
+		if idx == len(hashs) {
+			idx = 0
+		}
+		if got := m.PickNode(key); got != owners[hashs[idx]] {
+			t.Fatalf("key %s: expect %s, got %s", key, owners[hashs[idx]], got)
+		}
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights map[string]int
+		expect  map[string]float64 // 预计的比例
+	}{
+		{
+			name:    "equal weights",
+			weights: map[string]int{"a": 1, "b": 1, "c": 1},
+			expect:  map[string]float64{"a": 1.0 / 3, "b": 1.0 / 3, "c": 1.0 / 3},
+		},
+		{
+			name:    "one node with triple weight",
+			weights: map[string]int{"a": 1, "b": 3},
+			expect:  map[string]float64{"a": 0.25, "b": 0.75},
+		},
+		{
+			name:    "weight over MaxWeight is capped",
+			weights: map[string]int{"a": MaxWeight, "b": MaxWeight * 10},
+			expect:  map[string]float64{"a": 0.5, "b": 0.5},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewNodeMap(160, nil)
+			for node, weight := range c.weights {
+				m.AddNodeWithWeight(node, weight)
+			}
+			dist := m.Distribution()
+			total := 0.0
+			for node, share := range dist {
+				total += share
+				if math.Abs(share-c.expect[node]) > 0.05 {
+					t.Errorf("node %s: expect share about %.2f, got %.4f", node, c.expect[node], share)
+				}
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Errorf("shares should add up to 1, got %f", total)
+			}
+			for node, weight := range m.Weights() {
+				if weight > MaxWeight {
+					t.Errorf("node %s: weight %d over MaxWeight", node, weight)
+				}
+			}
+		})
+	}
+}
+
+// TestHashCollision 虚拟节点的哈希值冲突时 两个节点都保留在环上
+func TestHashCollision(t *testing.T) {
+	cases := []struct {
+		name     string
+		replicas int
+		nodes    []string
+	}{
+		{name: "single point", replicas: 1, nodes: []string{"a", "b"}},
+		{name: "virtual nodes", replicas: 10, nodes: []string{"a", "b", "c"}},
+	}
+	// 没有加盐的名字全部冲突
+	collide := func(data []byte) uint32 {
+		if !strings.Contains(string(data), "#") {
+			return 42
+		}
+		return crc32.ChecksumIEEE(data)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewNodeMap(c.replicas, collide)
+			m.AddNode(c.nodes...)
+			if len(m.nodeHashs) != c.replicas*len(c.nodes) {
+				t.Fatalf("expect %d virtual nodes, got %d", c.replicas*len(c.nodes), len(m.nodeHashs))
+			}
+			if len(m.nodehashMap) != len(m.nodeHashs) {
+				t.Fatalf("virtual nodes overwrite each other: %d hashes, %d owners", len(m.nodeHashs), len(m.nodehashMap))
+			}
+			dist := m.Distribution()
+			for _, node := range c.nodes {
+				if dist[node] == 0 {
+					t.Errorf("node %s lost from ring", node)
+				}
+			}
+		})
+	}
+}
+
+// TestRemoveNode 移除节点后只有原来属于它的 key 换了节点
+func TestRemoveNode(t *testing.T) {
+	cases := []struct {
+		name    string
+		nodes   []string
+		removed []string
+	}{
+		{name: "remove one", nodes: []string{"a", "b", "c"}, removed: []string{"b"}},
+		{name: "remove two", nodes: []string{"a", "b", "c", "d"}, removed: []string{"a", "d"}},
+		{name: "remove unknown", nodes: []string{"a", "b"}, removed: []string{"x"}},
+		{name: "remove all", nodes: []string{"a", "b"}, removed: []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewNodeMap(160, nil)
+			m.AddNode(c.nodes...)
+			before := m.Clone()
+			m.RemoveNode(c.removed...)
+			removed := make(map[string]bool)
+			for _, node := range c.removed {
+				removed[node] = true
+			}
+			left := make([]string, 0, len(c.nodes))
+			for _, node := range c.nodes {
+				if !removed[node] {
+					left = append(left, node)
+				}
+			}
+			if strings.Join(m.Nodes(), ",") != strings.Join(left, ",") {
+				t.Fatalf("expect nodes %v, got %v", left, m.Nodes())
+			}
+			if len(m.Nodes()) == 0 {
+				if !m.IsEmpty() || m.PickNode("key") != "" {
+					t.Fatal("empty ring should pick nothing")
+				}
+				return
+			}
+			for i := 0; i < 1000; i++ {
+				key := "key" + strconv.Itoa(i)
+				old, now := before.PickNode(key), m.PickNode(key)
+				if removed[now] {
+					t.Fatalf("key %s still picks removed node %s", key, now)
+				}
+				if !removed[old] && old != now {
+					t.Fatalf("key %s moved from %s to %s", key, old, now)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package crc16
+
+/*
+Redis Cluster 使用的 CRC16 (XMODEM) 算法
+key 的槽位为 CRC16(key) % 16384
+*/
+
+var table [256]uint16
+
+func init() {
+	// 多项式 0x1021 预先生成查表
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+}
+
+// Checksum returns the CRC16 (XMODEM) checksum of data
+func Checksum(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,106 @@
+package lock
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+key 级别的读写锁
+key 哈希到固定数量的锁上 不需要为每个 key 创建锁
+同时锁多个 key 时按锁的序号排序加锁 避免两个协程交叉加锁导致死锁
+*/
+
+const (
+	prime32 = uint32(16777619)
+)
+
+// Locks provides rw locks for keys
+type Locks struct {
+	table []*sync.RWMutex
+}
+
+// Make creates a new lock map
+func Make(tableSize int) *Locks {
+	table := make([]*sync.RWMutex, tableSize)
+	for i := 0; i < tableSize; i++ {
+		table[i] = &sync.RWMutex{}
+	}
+	return &Locks{
+		table: table,
+	}
+}
+
+// fnv32 FNV-1a 哈希
+func fnv32(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash *= prime32
+		hash ^= uint32(key[i])
+	}
+	return hash
+}
+
+func (locks *Locks) spread(hashCode uint32) uint32 {
+	tableSize := uint32(len(locks.table))
+	return hashCode % tableSize
+}
+
+// toLockIndices 去重并排序 reverse 用于解锁时倒序
+func (locks *Locks) toLockIndices(keys []string, reverse bool) []uint32 {
+	indexMap := make(map[uint32]struct{})
+	for _, key := range keys {
+		indexMap[locks.spread(fnv32(key))] = struct{}{}
+	}
+	indices := make([]uint32, 0, len(indexMap))
+	for index := range indexMap {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		if !reverse {
+			return indices[i] < indices[j]
+		}
+		return indices[i] > indices[j]
+	})
+	return indices
+}
+
+// RWLocks 同时锁住写 key 和读 key 一个 key 既读又写时加写锁
+func (locks *Locks) RWLocks(writeKeys []string, readKeys []string) {
+	keys := make([]string, 0, len(writeKeys)+len(readKeys))
+	keys = append(append(keys, writeKeys...), readKeys...)
+	indices := locks.toLockIndices(keys, false)
+	writeIndexSet := make(map[uint32]struct{})
+	for _, wKey := range writeKeys {
+		writeIndexSet[locks.spread(fnv32(wKey))] = struct{}{}
+	}
+	for _, index := range indices {
+		_, w := writeIndexSet[index]
+		mu := locks.table[index]
+		if w {
+			mu.Lock()
+		} else {
+			mu.RLock()
+		}
+	}
+}
+
+// RWUnLocks 释放 RWLocks 加的锁
+func (locks *Locks) RWUnLocks(writeKeys []string, readKeys []string) {
+	keys := make([]string, 0, len(writeKeys)+len(readKeys))
+	keys = append(append(keys, writeKeys...), readKeys...)
+	indices := locks.toLockIndices(keys, true)
+	writeIndexSet := make(map[uint32]struct{})
+	for _, wKey := range writeKeys {
+		writeIndexSet[locks.spread(fnv32(wKey))] = struct{}{}
+	}
+	for _, index := range indices {
+		_, w := writeIndexSet[index]
+		mu := locks.table[index]
+		if w {
+			mu.Unlock()
+		} else {
+			mu.RUnlock()
+		}
+	}
+}
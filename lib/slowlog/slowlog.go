@@ -0,0 +1,184 @@
+package slowlog
+
+import (
+	"go-redis/config"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+SLOWLOG 记录执行时间超过 slowlog-log-slower-than 微秒的命令
+Exec 在等待 CLIENT PAUSE 之后开始计时 执行完调用 Record SLOWLOG 命令读取和清空
+记录保存在固定大小的环形缓冲区中 满了之后覆盖最旧的 slowlog-max-len 修改后按新的大小重建
+*/
+
+const (
+	// maxArgs 每条记录最多保存的参数个数 maxArgLen 每个参数最多保存的字节数
+	maxArgs   = 32
+	maxArgLen = 128
+)
+
+// redactedCommands 参数中有密码的命令 只保留命令名和子命令
+var redactedCommands = map[string]bool{
+	"auth":        true,
+	"hello":       true,
+	"migrate":     true,
+	"acl|setuser": true,
+	"config|set":  true,
+}
+
+// Entry 一条慢查询记录
+type Entry struct {
+	ID       int64
+	Time     time.Time
+	Duration time.Duration
+	Args     [][]byte
+	Addr     string
+	Name     string
+}
+
+type slowLog struct {
+	mu     sync.Mutex
+	ring   []*Entry // 长度等于 slowlog-max-len
+	next   int      // 下一条记录写入的位置
+	count  int      // 已有的记录数量
+	nextID int64
+}
+
+var log = &slowLog{}
+
+// Threshold 当前的阈值 小于 0 表示不记录
+func Threshold() time.Duration {
+	slower := config.SlowlogLogSlowerThan()
+	if slower < 0 {
+		return -1
+	}
+	return time.Duration(slower) * time.Microsecond
+}
+
+// Record 执行时间超过阈值时记录 cmdName 是小写的命令全名 例如 client|list
+func Record(cmdName string, cmdLine [][]byte, duration time.Duration, addr string, name string) {
+	threshold := Threshold()
+	if threshold < 0 || duration < threshold {
+		return
+	}
+	entry := &Entry{
+		Time:     time.Now(),
+		Duration: duration,
+		Args:     truncateArgs(cmdName, cmdLine),
+		Addr:     addr,
+		Name:     name,
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.resize(config.SlowlogMaxLen())
+	entry.ID = log.nextID
+	log.nextID++
+	if len(log.ring) == 0 {
+		return
+	}
+	log.ring[log.next] = entry
+	log.next = (log.next + 1) % len(log.ring)
+	if log.count < len(log.ring) {
+		log.count++
+	}
+}
+
+// truncateArgs 复制参数 超过 maxArgs 个或者 maxArgLen 字节的部分用说明代替
+func truncateArgs(cmdName string, cmdLine [][]byte) [][]byte {
+	if redactedCommands[cmdName] {
+		keep := 1
+		if cmdName != "auth" && cmdName != "hello" && cmdName != "migrate" {
+			keep = 2
+		}
+		if keep > len(cmdLine) {
+			keep = len(cmdLine)
+		}
+		args := make([][]byte, 0, keep+1)
+		for _, arg := range cmdLine[:keep] {
+			args = append(args, append([]byte(nil), arg...))
+		}
+		if len(cmdLine) > keep {
+			args = append(args, []byte("(redacted)"))
+		}
+		return args
+	}
+	n := len(cmdLine)
+	if n > maxArgs {
+		n = maxArgs - 1
+	}
+	args := make([][]byte, 0, n+1)
+	for _, arg := range cmdLine[:n] {
+		if len(arg) > maxArgLen {
+			more := strconv.Itoa(len(arg)-maxArgLen) + " more bytes)"
+			args = append(args, append(append([]byte(nil), arg[:maxArgLen]...), "... ("+more...))
+			continue
+		}
+		args = append(args, append([]byte(nil), arg...))
+	}
+	if n < len(cmdLine) {
+		args = append(args, []byte("... ("+strconv.Itoa(len(cmdLine)-n)+" more arguments)"))
+	}
+	return args
+}
+
+// resize 大小变化时保留最新的记录 调用方持有锁
+func (l *slowLog) resize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	if size == len(l.ring) {
+		return
+	}
+	entries := l.latest(size)
+	l.ring = make([]*Entry, size)
+	// latest 返回的是最新的在前面 按从旧到新的顺序放回
+	for i := range entries {
+		l.ring[i] = entries[len(entries)-1-i]
+	}
+	l.count = len(entries)
+	l.next = 0
+	if size > 0 {
+		l.next = l.count % size
+	}
+}
+
+// latest 最新的 n 条记录 最新的在前面 调用方持有锁
+func (l *slowLog) latest(n int) []*Entry {
+	if n < 0 || n > l.count {
+		n = l.count
+	}
+	entries := make([]*Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		entries = append(entries, l.ring[(l.next-i+len(l.ring))%len(l.ring)])
+	}
+	return entries
+}
+
+// Get 最新的 count 条记录 count 小于 0 时返回全部
+func Get(count int) []*Entry {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.resize(config.SlowlogMaxLen())
+	return log.latest(count)
+}
+
+// Len 当前的记录数量
+func Len() int {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.resize(config.SlowlogMaxLen())
+	return log.count
+}
+
+// Reset 清空所有记录 ID 继续递增
+func Reset() {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for i := range log.ring {
+		log.ring[i] = nil
+	}
+	log.next = 0
+	log.count = 0
+}
@@ -0,0 +1,38 @@
+package stats
+
+import (
+	"go-redis/lib/sync/atomic"
+	"time"
+)
+
+/*
+服务端的统计计数 INFO 命令使用
+由 handler connection 等包在处理过程中累加 全部是原子操作
+*/
+
+// StartTime 进程启动的时间 用来计算 uptime
+var StartTime = time.Now()
+
+var (
+	// ConnectionsReceived 接受的连接总数 包括被 maxclients 拒绝的
+	ConnectionsReceived atomic.Int64
+	// RejectedConnections 因为 maxclients 被拒绝的连接数
+	RejectedConnections atomic.Int64
+	// CommandsProcessed 执行的命令总数
+	CommandsProcessed atomic.Int64
+	// ErrorReplies 返回错误的命令数
+	ErrorReplies atomic.Int64
+	// NetInputBytes NetOutputBytes 从客户端读取和发给客户端的字节数
+	NetInputBytes  atomic.Int64
+	NetOutputBytes atomic.Int64
+)
+
+// ResetStats CONFIG RESETSTAT 清零所有计数 StartTime 不变
+func ResetStats() {
+	ConnectionsReceived.Set(0)
+	RejectedConnections.Set(0)
+	CommandsProcessed.Set(0)
+	ErrorReplies.Set(0)
+	NetInputBytes.Set(0)
+	NetOutputBytes.Set(0)
+}
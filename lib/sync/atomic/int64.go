@@ -0,0 +1,25 @@
+package atomic
+
+import "sync/atomic"
+
+/*
+go 1.17 的 atomic 没有 Int64 类型 包装一下 避免到处取地址
+*/
+
+// Int64 is an int64 value, all actions of it is atomic
+type Int64 int64
+
+// Add adds delta atomically and returns the new value
+func (i *Int64) Add(delta int64) int64 {
+	return atomic.AddInt64((*int64)(i), delta)
+}
+
+// Get reads the value atomically
+func (i *Int64) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+// Set writes the value atomically
+func (i *Int64) Set(v int64) {
+	atomic.StoreInt64((*int64)(i), v)
+}
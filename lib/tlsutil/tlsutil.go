@@ -0,0 +1,96 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"go-redis/config"
+	"os"
+	"strings"
+)
+
+/*
+由证书文件生成 tls.Config
+服务端 tls-auth-clients
+  yes       客户端必须提供由 CA 签发的证书 (双向 TLS)
+  optional  客户端提供了证书时校验
+  no        不要求客户端证书
+客户端(集群节点之间) 用 CA 校验对方的证书 同时出示自己的证书 对方开启 tls-auth-clients 时才能连接
+*/
+
+// loadCA 读取 PEM 格式的 CA 证书
+func loadCA(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return pool, nil
+}
+
+// ServerConfig 服务端使用的配置 certFile keyFile 是必须的
+func ServerConfig(certFile string, keyFile string, caFile string, authClients string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required for tls")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch strings.ToLower(authClients) {
+	case "", "yes":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		cfg.ClientAuth = tls.NoClientCert
+		return cfg, nil
+	default:
+		return nil, errors.New("invalid tls-auth-clients: " + authClients)
+	}
+	if caFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to verify client certificates")
+	}
+	cfg.ClientCAs, err = loadCA(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ClientConfig 客户端使用的配置 没有 caFile 时使用系统的根证书 没有 certFile 时不出示证书
+func ClientConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCA(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// ClusterClientConfig 连接其他节点 副本和 MIGRATE 目标时使用的配置 没有开启 tls-cluster 时返回 nil
+func ClusterClientConfig() (*tls.Config, error) {
+	if !config.Properties.TLSCluster {
+		return nil, nil
+	}
+	return ClientConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile, config.Properties.TLSCACertFile)
+}
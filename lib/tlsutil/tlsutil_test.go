@@ -0,0 +1,214 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert 生成的证书和私钥 以及写入的 PEM 文件
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+var certSerial int64
+
+// makeCert 生成证书 parent 为 nil 时是自签名的 CA
+func makeCert(t *testing.T, dir string, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(certSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	writePEM(t, tc.certFile, "CERTIFICATE", der)
+	writePEM(t, tc.keyFile, "EC PRIVATE KEY", keyDer)
+	return tc
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS 握手成功后回复 +OK 然后关闭
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte("+OK\r\n"))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connect TLS 1.3 中客户端证书被拒绝时握手不会失败 读取回复时才会发现
+func connect(addr string, cfg *tls.Config) error {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	return err
+}
+
+func TestTLSAuthClients(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, dir, "ca", nil, 0)
+	server := makeCert(t, dir, "server", ca, x509.ExtKeyUsageServerAuth)
+	client := makeCert(t, dir, "client", ca, x509.ExtKeyUsageClientAuth)
+	// 不是由 CA 签发的客户端证书
+	otherCA := makeCert(t, dir, "other-ca", nil, 0)
+	untrusted := makeCert(t, dir, "untrusted", otherCA, x509.ExtKeyUsageClientAuth)
+
+	withCert, err := ClientConfig(client.certFile, client.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCert, err := ClientConfig("", "", ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedCert, err := ClientConfig(untrusted.certFile, untrusted.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Go 的客户端只出示服务端接受的 CA 签发的证书 强制出示 让服务端校验
+	untrustedCert.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &untrustedCert.Certificates[0], nil
+	}
+
+	cases := []struct {
+		authClients string
+		client      *tls.Config
+		name        string
+		ok          bool
+	}{
+		{"yes", withCert, "client cert", true},
+		{"yes", noCert, "no client cert", false},
+		{"yes", untrustedCert, "untrusted client cert", false},
+		{"", noCert, "default requires client cert", false},
+		{"optional", withCert, "client cert", true},
+		{"optional", noCert, "no client cert", true},
+		{"optional", untrustedCert, "untrusted client cert", false},
+		{"no", noCert, "no client cert", true},
+		{"no", untrustedCert, "client cert not verified", true},
+	}
+	for _, c := range cases {
+		cfg, err := ServerConfig(server.certFile, server.keyFile, ca.certFile, c.authClients)
+		if err != nil {
+			t.Fatalf("tls-auth-clients %q: %v", c.authClients, err)
+		}
+		addr := serveTLS(t, cfg)
+		err = connect(addr, c.client)
+		if c.ok && err != nil {
+			t.Errorf("tls-auth-clients %q %s: expect success, got %v", c.authClients, c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("tls-auth-clients %q %s: expect failure", c.authClients, c.name)
+		}
+	}
+
+	// 客户端没有 CA 时用系统根证书 不信任测试 CA 签发的服务端证书
+	systemRoots, err := ClientConfig(client.certFile, client.keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ServerConfig(server.certFile, server.keyFile, ca.certFile, "no")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(serveTLS(t, cfg), systemRoots); err == nil {
+		t.Error("server cert signed by unknown CA should be rejected")
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := makeCert(t, dir, "ca", nil, 0)
+	server := makeCert(t, dir, "server", ca, x509.ExtKeyUsageServerAuth)
+	if _, err := ServerConfig("", "", "", "no"); err == nil {
+		t.Error("missing cert file should fail")
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, "", "yes"); err == nil {
+		t.Error("verifying client certs without CA should fail")
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, "", "no"); err != nil {
+		t.Errorf("tls-auth-clients no does not need CA: %v", err)
+	}
+	if _, err := ServerConfig(server.certFile, server.keyFile, ca.certFile, "maybe"); err == nil {
+		t.Error("invalid tls-auth-clients should fail")
+	}
+}
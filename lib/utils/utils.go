@@ -19,6 +19,15 @@ func ToCmdLine2(commandName string, args ...[]byte) [][]byte {
 	return result
 }
 
+// BytesToStrings convert arguments to strings
+func BytesToStrings(args [][]byte) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		result[i] = string(arg)
+	}
+	return result
+}
+
 // BytesEquals check whether the given bytes is equal
 func BytesEquals(a []byte, b []byte) bool {
 	if (a == nil && b != nil) || (a != nil && b == nil) {
@@ -4,16 +4,21 @@ import (
 	"fmt"
 	"go-redis/config"
 	"go-redis/lib/logger"
+	"go-redis/lib/tlsutil"
 	"go-redis/resp/handler"
 	"go-redis/tcp"
 	"os"
+	"strconv"
+	"time"
 )
 
 const configFile string = "redis.conf"
 
 var defaultProperties = &config.ServerProperties{
-	Bind: "0.0.0.0",
-	Port: 6379,
+	Bind:                 "0.0.0.0",
+	Port:                 6379,
+	SlowlogLogSlowerThan: config.DefaultSlowlogLogSlowerThan,
+	SlowlogMaxLen:        config.DefaultSlowlogMaxLen,
 }
 
 func fileExists(filename string) bool {
@@ -37,12 +42,37 @@ func main() {
 		config.Properties = defaultProperties
 	}
 
-	err := tcp.ListenAndServeWithSignal(
-		&tcp.Config{
-			// 字符串 + 整形 拼接
-			Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-		},
-		handler.MakeHandler())
+	tcpConfig := &tcp.Config{
+		// 字符串 + 整形 拼接
+		Address:   fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
+		KeepAlive: time.Duration(config.Properties.TCPKeepAlive) * time.Second,
+	}
+	if config.Properties.TLSPort > 0 {
+		tlsConfig, err := tlsutil.ServerConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile,
+			config.Properties.TLSCACertFile, config.Properties.TLSAuthClients)
+		if err != nil {
+			logger.Error(err)
+			return
+		}
+		tcpConfig.TLSAddress = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.TLSPort)
+		tcpConfig.TLSConfig = tlsConfig
+	}
+	if config.Properties.UnixSocket != "" {
+		tcpConfig.UnixSocket = config.Properties.UnixSocket
+		if config.Properties.UnixSocketPerm != "" {
+			perm, err := strconv.ParseUint(config.Properties.UnixSocketPerm, 8, 32)
+			if err != nil {
+				logger.Error("invalid unixsocketperm: " + config.Properties.UnixSocketPerm)
+				return
+			}
+			tcpConfig.UnixPerm = os.FileMode(perm)
+		}
+	}
+	// port 为 0 时只提供 TLS 或者 Unix 域套接字的服务
+	if config.Properties.Port == 0 && (tcpConfig.TLSAddress != "" || tcpConfig.UnixSocket != "") {
+		tcpConfig.Address = ""
+	}
+	err := tcp.ListenAndServeWithSignal(tcpConfig, handler.MakeHandler())
 
 	if err != nil {
 		logger.Error(err)
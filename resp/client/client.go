@@ -1,13 +1,19 @@
 package client
 
 import (
+	"crypto/tls"
+	"errors"
 	"go-redis/interface/resp"
 	"go-redis/lib/logger"
+	"go-redis/lib/sync/atomic"
 	"go-redis/lib/sync/wait"
+	"go-redis/lib/utils"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
+	"io"
 	"net"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,8 +25,18 @@ type Client struct {
 	waitingReqs chan *request // waiting response
 	ticker      *time.Ticker
 	addr        string
+	// tlsConfig 不为空时使用 TLS 连接 重连时也一样
+	tlsConfig *tls.Config
 
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
+
+	// broken 读连接时出现 IO 错误 连接已经不可用 连接池借出时据此销毁重建
+	broken atomic.Boolean
+	// authed 连接已经通过 AUTH 认证 重新建立的连接没有认证 所以不再自动重连 而是标记为 broken
+	authed atomic.Boolean
+
+	// timeout 等待回复的最长时间
+	timeout time.Duration
 }
 
 // request is a message sends to redis server
@@ -34,23 +50,46 @@ type request struct {
 }
 
 const (
-	chanSize = 256
-	maxWait  = 3 * time.Second
+	chanSize       = 256
+	defaultTimeout = 3 * time.Second
 )
 
 // MakeClient creates a new client
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-	return &Client{
+	return MakeTLSClient(addr, nil)
+}
+
+// MakeTLSClient creates a new client, tlsConfig 为 nil 时与 MakeClient 相同
+func MakeTLSClient(addr string, tlsConfig *tls.Config) (*Client, error) {
+	client := &Client{
 		addr:        addr,
-		conn:        conn,
+		tlsConfig:   tlsConfig,
 		pendingReqs: make(chan *request, chanSize),
 		waitingReqs: make(chan *request, chanSize),
 		working:     &sync.WaitGroup{},
-	}, nil
+		timeout:     defaultTimeout,
+	}
+	conn, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	client.conn = conn
+	return client, nil
+}
+
+// dial 建立连接 TLS 连接在返回前完成握手 证书有问题时立即失败
+func (client *Client) dial() (net.Conn, error) {
+	if client.tlsConfig == nil {
+		return net.Dial("tcp", client.addr)
+	}
+	return tls.Dial("tcp", client.addr, client.tlsConfig)
+}
+
+// SetTimeout 修改等待回复的最长时间 需要在 Start 之前调用
+func (client *Client) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		client.timeout = timeout
+	}
 }
 
 // Start starts asynchronous goroutines
@@ -80,7 +119,15 @@ func (client *Client) Close() {
 	close(client.waitingReqs)
 }
 
+// errAuthLost 认证过的连接断开后不自动重连 由调用方重新创建客户端并认证
+var errAuthLost = errors.New("connection lost, client needs to authenticate again")
+
 func (client *Client) handleConnectionError(err error) error {
+	if client.authed.Get() {
+		client.broken.Set(true)
+		_ = client.conn.Close()
+		return errAuthLost
+	}
 	err1 := client.conn.Close()
 	if err1 != nil {
 		if opErr, ok := err1.(*net.OpError); ok {
@@ -91,7 +138,7 @@ func (client *Client) handleConnectionError(err error) error {
 			return err1
 		}
 	}
-	conn, err1 := net.Dial("tcp", client.addr)
+	conn, err1 := client.dial()
 	if err1 != nil {
 		logger.Error(err1)
 		return err1
@@ -126,7 +173,7 @@ func (client *Client) Send(args [][]byte) resp.Reply {
 	client.working.Add(1)
 	defer client.working.Done()
 	client.pendingReqs <- request
-	timeout := request.waiting.WaitWithTimeout(maxWait)
+	timeout := request.waiting.WaitWithTimeout(client.timeout)
 	if timeout {
 		return reply.MakeErrReply("server time out")
 	}
@@ -136,6 +183,15 @@ func (client *Client) Send(args [][]byte) resp.Reply {
 	return request.reply
 }
 
+// Auth 发送 AUTH password 或者 AUTH username password 成功后连接断开时不再自动重连
+func (client *Client) Auth(args [][]byte) resp.Reply {
+	ret := client.Send(append(utils.ToCmdLine("AUTH"), args...))
+	if !reply.IsErrorReply(ret) {
+		client.authed.Set(true)
+	}
+	return ret
+}
+
 func (client *Client) doHeartbeat() {
 	request := &request{
 		args:      [][]byte{[]byte("PING")},
@@ -146,7 +202,7 @@ func (client *Client) doHeartbeat() {
 	client.working.Add(1)
 	defer client.working.Done()
 	client.pendingReqs <- request
-	request.waiting.WaitWithTimeout(maxWait)
+	request.waiting.WaitWithTimeout(client.timeout)
 }
 
 func (client *Client) doRequest(req *request) {
@@ -189,14 +245,39 @@ func (client *Client) finishRequest(reply resp.Reply) {
 	}
 }
 
+// IsBroken returns whether the connection to server is unusable
+func (client *Client) IsBroken() bool {
+	return client.broken.Get()
+}
+
 func (client *Client) handleRead() error {
 	ch := parser.ParseStream(client.conn)
 	for payload := range ch {
 		if payload.Err != nil {
+			if isIOError(payload.Err) {
+				// 对端关闭或者网络断开 不再有回复
+				client.broken.Set(true)
+				return payload.Err
+			}
 			client.finishRequest(reply.MakeErrReply(payload.Err.Error()))
 			continue
 		}
+		if _, ok := payload.Data.(*reply.PushReply); ok {
+			// RESP3 服务端主动推送的消息 不对应任何请求
+			continue
+		}
 		client.finishRequest(payload.Data)
 	}
+	// 超出长度限制时解析器会结束 连接不能再使用
+	client.broken.Set(true)
 	return nil
 }
+
+// isIOError 区分连接断开和协议错误
+func isIOError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok || strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -1,9 +1,15 @@
 package connection
 
 import (
+	"bufio"
+	"go-redis/interface/resp"
+	"go-redis/lib/stats"
 	"go-redis/lib/sync/wait"
+	"go-redis/resp/reply"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +18,9 @@ import (
 type Connection struct {
 	conn net.Conn
 
+	// writer 缓冲回复 管线化的命令处理完一批再一起发送 由 Read 在等待输入之前刷新
+	writer *bufio.Writer
+
 	// 关闭服务前 进行处理
 	waitingReply wait.Wait
 
@@ -20,6 +29,47 @@ type Connection struct {
 
 	// selected db
 	selectedDB int
+
+	// 集群迁移槽位时客户端发送了 ASKING
+	asking bool
+
+	// 集群中客户端发送了 READONLY 只读指令可以由副本执行
+	readOnly bool
+
+	// HELLO 协商的协议版本 0 表示默认的 RESP2
+	protocol int
+
+	// AUTH 通过的 ACL 用户 为空时使用 default 用户 default 需要密码时还没有认证
+	user string
+
+	// 内部使用的伪连接 没有对应的客户端
+	internal bool
+
+	// idleTimeout 大于 0 时 等待请求超过这个时间 Read 返回超时错误 由 handler 关闭连接
+	idleTimeout time.Duration
+
+	// CLIENT LIST 展示的信息 其他连接的协程也会读取 由 statMu 保护
+	// selectedDB readOnly user protocol multiState queue 也由 statMu 保护
+	// 它们只由连接自己的协程修改 修改时加锁 自己的协程读取时不需要加锁
+	id        uint64
+	createdAt time.Time
+	statMu    sync.Mutex
+	name      string
+	lastCmd   string
+	lastTime  time.Time
+	qbuf      int  // 已经读入还没有解析的请求字节数
+	noEvict   bool // CLIENT NO-EVICT 目前没有淘汰机制 只做记录
+	// obl 缓冲区中还没有发送的回复字节数 每次写入缓冲区或发送后更新 原子操作读写
+	obl int64
+
+	// closeAfterReply CLIENT KILL 关闭了自己 回复发送之后由 handler 关闭连接
+	closeAfterReply bool
+
+	// MULTI 事务的状态
+	multiState bool
+	queue      [][][]byte
+	txErrors   []error
+	watching   map[string]*resp.WatchedKey
 }
 
 // RemoteAddr 看一下客户端的地址
@@ -34,14 +84,33 @@ func (c *Connection) Close() error {
 	return nil
 }
 
+const writerSize = 16 * 1024
+
 // NewConn creates Connection instance
 func NewConn(conn net.Conn) *Connection {
+	now := time.Now()
 	return &Connection{
-		conn: conn,
+		conn:      conn,
+		writer:    bufio.NewWriterSize(countingWriter{conn}, writerSize),
+		id:        nextID(),
+		createdAt: now,
+		lastTime:  now,
+	}
+}
+
+// NewInternalConn 服务端内部执行命令使用的连接 只用来记录选择的库 不需要认证
+func NewInternalConn() *Connection {
+	now := time.Now()
+	return &Connection{
+		internal:  true,
+		id:        nextID(),
+		createdAt: now,
+		lastTime:  now,
 	}
 }
 
 // Write sends response to client over tcp connection
+// 缓冲区中还有回复时先发送它们 保证顺序
 func (c *Connection) Write(b []byte) error {
 	if len(b) == 0 {
 		return nil
@@ -54,10 +123,82 @@ func (c *Connection) Write(b []byte) error {
 		c.mu.Unlock()
 	}()
 
-	_, err := c.conn.Write(b)
+	if c.writer != nil && c.writer.Buffered() > 0 {
+		err := c.writer.Flush()
+		atomic.StoreInt64(&c.obl, int64(c.writer.Buffered()))
+		if err != nil {
+			return err
+		}
+	}
+	n, err := c.conn.Write(b)
+	stats.NetOutputBytes.Add(int64(n))
+	return err
+}
+
+// countingWriter 统计发给客户端的字节数
+type countingWriter struct {
+	w io.Writer
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	stats.NetOutputBytes.Add(int64(n))
+	return n, err
+}
+
+// WriteReply 把回复写入缓冲区 不会立刻发送 由 Flush 或者下一次 Read 发送
+func (c *Connection) WriteReply(r resp.Reply) error {
+	if c.writer == nil {
+		return c.Write(reply.Marshal(r, c.GetProtocol()))
+	}
+	c.mu.Lock()
+	c.waitingReply.Add(1)
+	defer func() {
+		c.waitingReply.Done()
+		c.mu.Unlock()
+	}()
+	err := reply.WriteTo(c.writer, r, c.GetProtocol())
+	atomic.StoreInt64(&c.obl, int64(c.writer.Buffered()))
+	return err
+}
+
+// Flush 发送缓冲区中的回复
+func (c *Connection) Flush() error {
+	if c.writer == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.waitingReply.Add(1)
+	defer func() {
+		c.waitingReply.Done()
+		c.mu.Unlock()
+	}()
+	err := c.writer.Flush()
+	atomic.StoreInt64(&c.obl, int64(c.writer.Buffered()))
 	return err
 }
 
+// Read 从客户端读取请求 parser.Reader 只在已经缓冲的输入处理完之后才会调用
+// 这时客户端可能在等待回复 所以先把缓冲的回复发出去
+func (c *Connection) Read(p []byte) (int, error) {
+	if err := c.Flush(); err != nil {
+		return 0, err
+	}
+	if c.idleTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.conn.Read(p)
+	stats.NetInputBytes.Add(int64(n))
+	return n, err
+}
+
+// SetIdleTimeout 设置空闲超时 需要在开始读取之前调用
+func (c *Connection) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
 // GetDBIndex returns selected db
 func (c *Connection) GetDBIndex() int {
 	return c.selectedDB
@@ -65,5 +206,118 @@ func (c *Connection) GetDBIndex() int {
 
 // SelectDB selects a database
 func (c *Connection) SelectDB(dbNum int) {
+	c.statMu.Lock()
 	c.selectedDB = dbNum
+	c.statMu.Unlock()
+}
+
+// SetAsking marks the next command can access an importing slot
+func (c *Connection) SetAsking(asking bool) {
+	c.asking = asking
+}
+
+// IsAsking returns whether the client sent ASKING before this command
+func (c *Connection) IsAsking() bool {
+	return c.asking
+}
+
+// SetReadOnly 由 READONLY / READWRITE 设置
+func (c *Connection) SetReadOnly(readOnly bool) {
+	c.statMu.Lock()
+	c.readOnly = readOnly
+	c.statMu.Unlock()
+}
+
+// IsReadOnly returns whether the client allows reading from replicas
+func (c *Connection) IsReadOnly() bool {
+	return c.readOnly
+}
+
+// SetProtocol 由 HELLO 设置
+func (c *Connection) SetProtocol(protocol int) {
+	c.statMu.Lock()
+	c.protocol = protocol
+	c.statMu.Unlock()
+}
+
+// GetProtocol returns RESP version of the connection
+func (c *Connection) GetProtocol() int {
+	if c.protocol == 0 {
+		return reply.Resp2
+	}
+	return c.protocol
+}
+
+// SetUser stores the ACL user authenticated by AUTH
+func (c *Connection) SetUser(user string) {
+	c.statMu.Lock()
+	c.user = user
+	c.statMu.Unlock()
+}
+
+// GetUser returns the authenticated ACL user, empty before AUTH
+// CLIENT KILL USER 会在其他连接的协程中读取 所以加锁
+func (c *Connection) GetUser() string {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
+	return c.user
+}
+
+// IsInternal returns whether the connection is used by server itself
+func (c *Connection) IsInternal() bool {
+	return c.internal
+}
+
+// InMultiState returns whether the client is in MULTI
+func (c *Connection) InMultiState() bool {
+	return c.multiState
+}
+
+// SetMultiState 进入或退出 MULTI 退出时清空队列
+func (c *Connection) SetMultiState(state bool) {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
+	if !state {
+		c.watching = nil
+		c.queue = nil
+		c.txErrors = nil
+	}
+	c.multiState = state
+}
+
+// GetQueuedCmdLine returns queued commands of current transaction
+func (c *Connection) GetQueuedCmdLine() [][][]byte {
+	return c.queue
+}
+
+// EnqueueCmd enqueues command of current transaction
+func (c *Connection) EnqueueCmd(cmdLine [][]byte) {
+	c.statMu.Lock()
+	c.queue = append(c.queue, cmdLine)
+	c.statMu.Unlock()
+}
+
+// ClearQueuedCmds clears queued commands of current transaction
+func (c *Connection) ClearQueuedCmds() {
+	c.statMu.Lock()
+	c.queue = nil
+	c.statMu.Unlock()
+}
+
+// AddTxError stores syntax error within transaction
+func (c *Connection) AddTxError(err error) {
+	c.txErrors = append(c.txErrors, err)
+}
+
+// GetTxErrors returns syntax error within transaction
+func (c *Connection) GetTxErrors() []error {
+	return c.txErrors
+}
+
+// GetWatching returns watching keys and their versions
+func (c *Connection) GetWatching() map[string]*resp.WatchedKey {
+	if c.watching == nil {
+		c.watching = make(map[string]*resp.WatchedKey)
+	}
+	return c.watching
 }
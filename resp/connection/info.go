@@ -0,0 +1,137 @@
+package connection
+
+import (
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientID 自增的连接 id 从 1 开始 与 Redis 相同不会重复使用
+var clientID uint64
+
+func nextID() uint64 {
+	return atomic.AddUint64(&clientID, 1)
+}
+
+// GetID returns the unique id of the connection
+func (c *Connection) GetID() uint64 {
+	return c.id
+}
+
+// SetName 由 CLIENT SETNAME 或者 HELLO SETNAME 设置 空字符串表示清除
+func (c *Connection) SetName(name string) {
+	c.statMu.Lock()
+	c.name = name
+	c.statMu.Unlock()
+}
+
+// GetName returns the name set by CLIENT SETNAME
+func (c *Connection) GetName() string {
+	c.statMu.Lock()
+	defer c.statMu.Unlock()
+	return c.name
+}
+
+// SetNoEvict 由 CLIENT NO-EVICT 设置
+func (c *Connection) SetNoEvict(noEvict bool) {
+	c.statMu.Lock()
+	c.noEvict = noEvict
+	c.statMu.Unlock()
+}
+
+// RecordCommand 每条命令执行前由 handler 记录 cmd 是 client|list 这样的全名
+func (c *Connection) RecordCommand(cmd string, qbuf int) {
+	c.statMu.Lock()
+	c.lastCmd = cmd
+	c.lastTime = time.Now()
+	c.qbuf = qbuf
+	c.statMu.Unlock()
+}
+
+// CloseAfterReply 当前命令的回复发送之后关闭连接
+func (c *Connection) CloseAfterReply() {
+	c.closeAfterReply = true
+}
+
+// ShouldClose 是否需要在回复之后关闭
+func (c *Connection) ShouldClose() bool {
+	return c.closeAfterReply
+}
+
+// Addr 客户端的地址 内部的伪连接为空
+func (c *Connection) Addr() string {
+	if c.conn == nil || c.conn.RemoteAddr() == nil {
+		return ""
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// LocalAddr 客户端连接的服务端地址
+func (c *Connection) LocalAddr() string {
+	if c.conn == nil || c.conn.LocalAddr() == nil {
+		return ""
+	}
+	return c.conn.LocalAddr().String()
+}
+
+// Age 连接建立的时长
+func (c *Connection) Age() time.Duration {
+	return time.Since(c.createdAt)
+}
+
+// Info CLIENT LIST 和 CLIENT INFO 中的一行
+func (c *Connection) Info() string {
+	c.statMu.Lock()
+	name, lastCmd, lastTime, qbuf, noEvict := c.name, c.lastCmd, c.lastTime, c.qbuf, c.noEvict
+	multiState, queued, readOnly := c.multiState, len(c.queue), c.readOnly
+	dbIndex, user, protocol := c.selectedDB, c.user, c.protocol
+	c.statMu.Unlock()
+	// N 普通客户端 x 在 MULTI 中 r 开启了 READONLY e 开启了 NO-EVICT
+	flags := ""
+	if multiState {
+		flags += "x"
+	}
+	if readOnly {
+		flags += "r"
+	}
+	if noEvict {
+		flags += "e"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	multi := -1
+	if multiState {
+		multi = queued
+	}
+	if protocol == 0 {
+		protocol = reply.Resp2
+	}
+	if user == "" {
+		user = "default"
+	}
+	if lastCmd == "" {
+		lastCmd = "NULL"
+	}
+	fields := []string{
+		"id=" + strconv.FormatUint(c.id, 10),
+		"addr=" + c.Addr(),
+		"laddr=" + c.LocalAddr(),
+		"name=" + name,
+		"age=" + strconv.FormatInt(int64(c.Age()/time.Second), 10),
+		"idle=" + strconv.FormatInt(int64(time.Since(lastTime)/time.Second), 10),
+		"flags=" + flags,
+		"db=" + strconv.Itoa(dbIndex),
+		"sub=0",
+		"psub=0",
+		"multi=" + strconv.Itoa(multi),
+		"qbuf=" + strconv.Itoa(qbuf),
+		"obl=" + strconv.FormatInt(atomic.LoadInt64(&c.obl), 10),
+		"cmd=" + lastCmd,
+		"user=" + user,
+		"resp=" + strconv.Itoa(protocol),
+	}
+	return strings.Join(fields, " ")
+}
@@ -11,39 +11,52 @@ import (
 	database2 "go-redis/database"
 	"go-redis/interface/database"
 	"go-redis/lib/logger"
+	"go-redis/lib/stats"
 	"go-redis/lib/sync/atomic"
 	"go-redis/resp/connection"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
-	"io"
 	"net"
-	"strings"
 	"sync"
+	atomic2 "sync/atomic"
+	"time"
 )
 
 var (
 	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+	maxClientsReplyBytes = []byte("-ERR max number of clients reached\r\n")
 )
 
 // RespHandler implements tcp.Handler and serves as a redis handler
 type RespHandler struct {
 	activeConn sync.Map // *client -> placeholder
-	db         database.Database
-	closing    atomic.Boolean // refusing new client and new request
+	// clientCount 当前的客户端数量 超过 maxclients 时拒绝新连接
+	clientCount int32
+	db          database.Database
+	closing     atomic.Boolean // refusing new client and new request
 }
 
 // MakeHandler creates a RespHandler instance
 func MakeHandler() *RespHandler {
-	var db database.Database
-	//db = database2.NewStandaloneDatabase()
-	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
-		db = cluster.MakeClusterDatabase()
+	h := &RespHandler{}
+	// 配置了 self 和 peers 时以集群模式启动 只有 self 时需要 cluster-enabled 之后通过 CLUSTER MEET 加入其他节点
+	if config.IsCluster() {
+		clusterDB := cluster.MakeClusterDatabase()
+		clusterDB.SetClientLister(h.forEachClient)
+		h.db = clusterDB
 	} else {
-		database2.NewStandaloneDatabase()
-	}
-	return &RespHandler{
-		db: db,
+		standaloneDB := database2.NewStandaloneDatabase()
+		standaloneDB.SetClientLister(h.forEachClient)
+		h.db = standaloneDB
 	}
+	return h
+}
+
+// forEachClient 遍历所有连接 CLIENT LIST 和 CLIENT KILL 使用
+func (h *RespHandler) forEachClient(cb func(c *connection.Connection) bool) {
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		return cb(key.(*connection.Connection))
+	})
 }
 
 // closeClient 关闭一个客户端的连接
@@ -51,6 +64,7 @@ func (h *RespHandler) closeClient(client *connection.Connection) {
 	_ = client.Close()
 	h.db.AfterClientClose(client)
 	h.activeConn.Delete(client)
+	atomic2.AddInt32(&h.clientCount, -1)
 }
 
 // Handle receives and executes redis commands
@@ -58,49 +72,77 @@ func (h *RespHandler) Handle(ctx context.Context, conn net.Conn) {
 	if h.closing.Get() {
 		// closing handler refuse new connection
 		_ = conn.Close()
+		return
+	}
+	stats.ConnectionsReceived.Add(1)
+	maxClients := int32(config.MaxClients())
+	if count := atomic2.AddInt32(&h.clientCount, 1); maxClients > 0 && count > maxClients {
+		// 与 Redis 相同 先回复错误再关闭
+		atomic2.AddInt32(&h.clientCount, -1)
+		stats.RejectedConnections.Add(1)
+		_, _ = conn.Write(maxClientsReplyBytes)
+		_ = conn.Close()
+		logger.Info("max number of clients reached, refuse " + conn.RemoteAddr().String())
+		return
 	}
 
 	client := connection.NewConn(conn)
+	if timeout := config.Timeout(); timeout > 0 {
+		client.SetIdleTimeout(time.Duration(timeout) * time.Second)
+	}
 	h.activeConn.Store(client, 1)
 
-	ch := parser.ParseStream(conn)
-	// 监听管道 相当于死循环
-	for payload := range ch {
-		if payload.Err != nil {
-			// payload.Err == io.EOF 相当于用户端关闭
-			if payload.Err == io.EOF ||
-				payload.Err == io.ErrUnexpectedEOF ||
-				strings.Contains(payload.Err.Error(), "use of closed network connection") {
-				// connection closed
+	// 从 client 读取 输入读完需要等待时会先发送缓冲的回复
+	reader := parser.NewReader(client)
+	reader.SetMaxBulkLen(int64(config.ProtoMaxBulkLen()))
+	reader.SetMaxQueryLen(int64(config.ClientQueryBufferLimit()))
+	// 在当前协程中逐条读取命令 相当于死循环
+	for {
+		cmdLine, err := reader.ReadCommand()
+		if err != nil {
+			var errReply reply.ErrorReply
+			switch e := err.(type) {
+			case *reply.ProtocolErrReply:
+				errReply = e
+			case *parser.ProtocolError:
+				errReply = reply.MakeErrReply(e.Error())
+			}
+			if errReply != nil {
+				// 协议错误或者超出长度限制 之后的数据无法找到下一条命令的开头 与 Redis 相同 回复错误之后断开
+				_ = client.WriteReply(errReply)
+				_ = client.Flush()
 				h.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
+				logger.Info("close client " + client.RemoteAddr().String() + ": " + errReply.Error())
 				return
 			}
-			// 出现协议错误写回客户端即可
-			errReply := reply.MakeErrReply(payload.Err.Error())
-			err := client.Write(errReply.ToBytes())
-			if err != nil {
-				h.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
+			// io.EOF 相当于用户端关闭 其他 IO 错误同样关闭连接
+			h.closeClient(client)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logger.Info("close idle client: " + client.RemoteAddr().String())
 				return
 			}
-			continue
-		}
-		if payload.Data == nil {
-			logger.Error("empty payload")
-			continue
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return
 		}
-		r, ok := payload.Data.(*reply.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk reply")
-			continue
-		}
-		result := h.db.Exec(client, r.Args)
+		cmdName := database2.FullCommandName(cmdLine)
+		client.RecordCommand(cmdName, reader.Buffered())
+		result := h.db.Exec(client, cmdLine)
+		stats.CommandsProcessed.Add(1)
 		if result != nil {
-			_ = client.Write(result.ToBytes())
+			// 不用 IsErrorReply 避免为了判断把整个回复编码一次
+			if _, ok := result.(reply.ErrorReply); ok {
+				stats.ErrorReplies.Add(1)
+			}
+			_ = client.WriteReply(result)
 		} else {
 			_ = client.Write(unknownErrReplyBytes)
 		}
+		if client.ShouldClose() {
+			// CLIENT KILL 关闭了自己
+			_ = client.Flush()
+			h.closeClient(client)
+			return
+		}
 	}
 }
 
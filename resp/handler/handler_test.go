@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"go-redis/config"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve 在随机端口上用 RespHandler 处理连接 返回监听地址
+func serve(t *testing.T, h *RespHandler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go h.Handle(context.Background(), conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestCloseAfterProtocolError 协议错误和超出长度限制时 回复错误之后断开连接 后面的命令不再执行
+func TestCloseAfterProtocolError(t *testing.T) {
+	config.Properties.ProtoMaxBulkLen = 1024
+	config.Properties.ClientQueryBufferLimit = 2048
+	defer func() {
+		config.Properties.ProtoMaxBulkLen = 0
+		config.Properties.ClientQueryBufferLimit = 0
+	}()
+	h := MakeHandler()
+	defer h.Close()
+	addr := serve(t, h)
+
+	cases := []struct {
+		name  string
+		data  string
+		reply string
+	}{
+		{
+			name:  "bulk too large",
+			data:  "*2\r\n$3\r\nGET\r\n$1025\r\n",
+			reply: "-ERR Protocol error: 'invalid bulk length'",
+		},
+		{
+			name:  "multibulk too large",
+			data:  "*" + strconv.Itoa(2*1024*1024) + "\r\n",
+			reply: "-ERR Protocol error: 'invalid multibulk length'",
+		},
+		{
+			name:  "query buffer limit",
+			data:  "*5\r\n$3\r\nSET\r\n" + strings.Repeat("$1000\r\n"+strings.Repeat("x", 1000)+"\r\n", 4),
+			reply: "-ERR Protocol error: 'query buffer limit exceeded'",
+		},
+		{
+			name:  "too big inline",
+			data:  strings.Repeat("a", 80*1024),
+			reply: "-ERR Protocol error: 'too big inline request'",
+		},
+		{
+			name:  "invalid format",
+			data:  "*2\r\n$3\r\nGET\r\n#1\r\n",
+			reply: "-ERR Protocol error: expected '$', got '#'",
+		},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		// 错误之后的 PING 不会被执行
+		if _, err = conn.Write([]byte(c.data + "*1\r\n$4\r\nPING\r\n")); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if strings.TrimRight(line, "\r\n") != c.reply {
+			t.Errorf("%s: expect %q, got %q", c.name, c.reply, line)
+		}
+		// 还有没读完的数据时关闭连接 对端可能收到 RST 而不是 EOF
+		if rest, err := br.ReadString('\n'); err == nil {
+			t.Errorf("%s: expect connection closed, got %q", c.name, rest)
+		}
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"errors"
+	"strconv"
+)
+
+/*
+内联命令 与 redis-cli 和 Redis 的 sdssplitargs 规则相同
+参数以空白分隔 "..." 中支持 \n \r \t \b \a \\ \" 和 \xHH 转义 '...' 中只支持 \'
+引号结束后必须是空白或者行尾
+*/
+
+var errUnbalancedQuotes = errors.New("ERR Protocol error: unbalanced quotes in request")
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == '\v' || b == '\f'
+}
+
+// parseInline 把一行内联命令拆分为参数
+func parseInline(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					if line[i+1] == 'x' && i+3 < len(line) {
+						if v, err := strconv.ParseUint(string(line[i+2:i+4]), 16, 8); err == nil {
+							arg = append(arg, byte(v))
+							i += 4
+							continue
+						}
+					}
+					arg = append(arg, unescape(line[i+1]))
+					i += 2
+					continue
+				}
+				arg = append(arg, c)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i >= len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					arg = append(arg, '\'')
+					i += 2
+					continue
+				}
+				arg = append(arg, c)
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				arg = append(arg, line[i])
+				i++
+			}
+			args = append(args, arg)
+			continue
+		}
+		// 引号结束之后必须是空白
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, errUnbalancedQuotes
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
+
+// unescape 双引号中 \ 之后的字符
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
+}
@@ -2,11 +2,13 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"go-redis/interface/resp"
 	"go-redis/lib/logger"
 	"go-redis/resp/reply"
 	"io"
+	"math/big"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -26,6 +28,25 @@ type readState struct {
 	msgType           byte     // 用户信息类型
 	args              [][]byte // 用户传过来的数据
 	bulkLen           int64    //字节组的长度  预设 读取的长度
+	readingBody       bool     // 下一次读取的是 $ 声明了长度的数据本体
+
+	// 服务端的回复中数组可能嵌套数组或者包含数字 例如 SCAN CLUSTER SLOTS
+	// 这时每个成员保存为 Reply 最终返回 MultiRawReply
+	elems  []resp.Reply
+	nested bool
+
+	bulkType byte            // 数组中正在读取的字符串类型 $ = !
+	attr     *reply.MapReply // RESP3 的属性 附加到下一个成员上
+}
+
+// isAggregateType 数组 map set push 属性 后面跟着若干个成员
+func isAggregateType(b byte) bool {
+	return b == '*' || b == '%' || b == '~' || b == '>' || b == '|'
+}
+
+// isBulkType 声明了长度的字符串 普通字符串 带格式的文本 长错误
+func isBulkType(b byte) bool {
+	return b == '$' || b == '=' || b == '!'
 }
 
 // finished 解析是否完成
@@ -34,6 +55,58 @@ func (s *readState) finished() bool {
 	return s.expectedArgsCount > 0 && len(s.args) == s.expectedArgsCount
 }
 
+// appendArg 记录数组的一个成员 前面有属性时把属性附加到这个成员上
+func (s *readState) appendArg(arg []byte, elem resp.Reply) {
+	if s.attr != nil {
+		elem = reply.MakeAttributeReply(s.attr, elem)
+		s.attr = nil
+		s.nested = true
+	}
+	s.args = append(s.args, arg)
+	s.elems = append(s.elems, elem)
+}
+
+// attach 内层聚合类型完成后作为外层的一个成员 属性则暂存 附加到外层的下一个成员上
+func (s *readState) attach(isAttr bool, result resp.Reply) {
+	if isAttr {
+		s.attr = result.(*reply.MapReply)
+		return
+	}
+	s.nested = true
+	s.appendArg(nil, result)
+}
+
+// result 解析完成后生成对应的 Reply
+func (s *readState) result() resp.Reply {
+	switch s.msgType {
+	case '$', '=', '!':
+		return makeBulkElem(s.msgType, s.args[0])
+	case '%', '|':
+		return reply.MakeMapReplyFromPairs(s.elems...)
+	case '~':
+		return reply.MakeSetReply(s.elems)
+	case '>':
+		return reply.MakePushReply(s.elems)
+	}
+	if s.nested {
+		return reply.MakeMultiRawReply(s.elems)
+	}
+	return reply.MakeMultiBulkReply(s.args)
+}
+
+// makeBulkElem 根据类型把字符串本体转为 Reply  =txt:... 格式不对时当作普通字符串
+func makeBulkElem(bulkType byte, body []byte) resp.Reply {
+	switch bulkType {
+	case '=':
+		if len(body) >= 4 && body[3] == ':' {
+			return reply.MakeVerbatimReply(string(body[:3]), body[4:])
+		}
+	case '!':
+		return reply.MakeErrReply(string(body))
+	}
+	return reply.MakeBulkReply(body)
+}
+
 // ParseStream 对外接口 让解析并发进行 TCP 调用 ParseStream
 func ParseStream(reader io.Reader) <-chan *Payload {
 	// 通过管道交付 不用卡在这
@@ -43,7 +116,28 @@ func ParseStream(reader io.Reader) <-chan *Payload {
 	return ch
 }
 
-// io.Reader 读取客户端的字节流 解析器
+// ParseBytes 解析一段完整的字节 返回其中所有的 Reply
+func ParseBytes(data []byte) ([]resp.Reply, error) {
+	ch := ParseStream(bytes.NewReader(data))
+	var results []resp.Reply
+	for payload := range ch {
+		if payload.Err != nil {
+			if payload.Err == io.EOF {
+				break
+			}
+			// 把剩下的读完 让解析协程退出
+			go func() {
+				for range ch {
+				}
+			}()
+			return nil, payload.Err
+		}
+		results = append(results, payload.Data)
+	}
+	return results, nil
+}
+
+// io.Reader 读取对方的字节流 解析器 服务端读取请求使用 Reader
 func parse0(reader io.Reader, ch chan<- *Payload) {
 	defer func() {
 		// 处理下 recover 中的 error
@@ -53,8 +147,31 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 	}()
 	bufReader := bufio.NewReader(reader)
 	var state readState
+	var stack []readState    // 嵌套数组时保存外层数组的状态
+	var attr *reply.MapReply // 最外层的属性 附加到下一个回复上
 	var err error
 	var msg []byte
+	// fatal 超出长度限制 之后的数据无法再找到下一条消息的开头 发送错误后结束解析
+	fatal := func(err error) bool {
+		protoErr, ok := err.(*reply.ProtocolErrReply)
+		if !ok {
+			return false
+		}
+		ch <- &Payload{
+			Err: protoErr,
+		}
+		close(ch)
+		return true
+	}
+	emit := func(data resp.Reply) {
+		if attr != nil {
+			data = reply.MakeAttributeReply(attr, data)
+			attr = nil
+		}
+		ch <- &Payload{
+			Data: data,
+		}
+	}
 	// 只要连接之后 会处于这个死循环中 断开之后才会退出
 	for {
 		// read line
@@ -73,13 +190,15 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 				Err: err,
 			}
 			state = readState{}
+			stack = nil
+			attr = nil
 			continue
 		}
 
 		// 最大的判断是从 是否开启多行模式 作为分支
 		if !state.readingMultiLine {
 			// receive new response
-			if msg[0] == '*' {
+			if isAggregateType(msg[0]) {
 				// parseMultiBulkHeader 中会将状态置为多行模式
 				err = parseMultiBulkHeader(msg, &state)
 				if err != nil {
@@ -87,66 +206,106 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 						Err: errors.New("protocol error: " + string(msg)),
 					}
 					state = readState{} // reset state
+					attr = nil
 					continue
 				}
-				if state.expectedArgsCount == 0 {
+				if state.expectedArgsCount <= 0 {
 					// 是给 Redis 底层返回一个信息 这里不是给 用户返回
-					ch <- &Payload{
-						Data: &reply.EmptyMultiBulkReply{},
+					if state.msgType == '|' {
+						attr = emptyOrNullMultiBulk(&state).(*reply.MapReply)
+					} else {
+						emit(emptyOrNullMultiBulk(&state))
 					}
 					state = readState{} // reset state
 					continue
 				}
-			} else if msg[0] == '$' { // bulk reply
+			} else if isBulkType(msg[0]) { // bulk reply
 				err = parseBulkHeader(msg, &state)
+				if fatal(err) {
+					return
+				}
 				if err != nil {
 					ch <- &Payload{
 						Err: errors.New("protocol error: " + string(msg)),
 					}
 					state = readState{} // reset state
+					attr = nil
 					continue
 				}
 				if state.bulkLen == -1 { // null bulk reply
-					ch <- &Payload{
-						Data: &reply.NullBulkReply{},
-					}
+					emit(&reply.NullBulkReply{})
 					state = readState{} // 重置位一个新的状态进行服务
 					continue
 				}
 			} else {
 				// single line reply
 				result, err := parseSingleLineReply(msg)
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
+				if err != nil {
+					ch <- &Payload{
+						Err: err,
+					}
+					attr = nil
+				} else {
+					emit(result)
 				}
 				state = readState{} // reset state
 				continue
 			}
 		} else {
-			// 多行模式使用 readBody
-			err = readBody(msg, &state)
-			if err != nil {
-				ch <- &Payload{
-					Err: errors.New("protocol error: " + string(msg)),
+			if !state.readingBody && isAggregateType(msg[0]) {
+				// 数组中嵌套数组 先保存外层的状态
+				stack = append(stack, state)
+				state = readState{}
+				err = parseMultiBulkHeader(msg, &state)
+				if err != nil {
+					ch <- &Payload{
+						Err: errors.New("protocol error: " + string(msg)),
+					}
+					state = readState{}
+					stack = nil
+					attr = nil
+					continue
 				}
-				state = readState{} // reset state
-				continue
-			}
-			// if sending finished
-			if state.finished() {
-				// 定义一个 Reply 如果解析完成塞进管道
-				var result resp.Reply
-				if state.msgType == '*' {
-					result = reply.MakeMultiBulkReply(state.args)
-				} else if state.msgType == '$' {
-					result = reply.MakeBulkReply(state.args[0])
+				if state.expectedArgsCount <= 0 {
+					isAttr := state.msgType == '|'
+					empty := emptyOrNullMultiBulk(&state)
+					state = stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					state.attach(isAttr, empty)
 				}
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
+			} else {
+				// 多行模式使用 readBody
+				err = readBody(msg, &state)
+				if fatal(err) {
+					return
+				}
+				if err != nil {
+					ch <- &Payload{
+						Err: errors.New("protocol error: " + string(msg)),
+					}
+					state = readState{} // reset state
+					stack = nil
+					attr = nil
+					continue
 				}
-				state = readState{}
+			}
+			// if sending finished 内层数组完成后作为外层数组的一个成员
+			// 属性完成后不是回复 暂存起来附加到下一个回复上
+			for state.finished() {
+				result := state.result()
+				isAttr := state.msgType == '|'
+				if len(stack) == 0 {
+					if isAttr {
+						attr = result.(*reply.MapReply)
+					} else {
+						emit(result)
+					}
+					state = readState{}
+					break
+				}
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				state.attach(isAttr, result)
 			}
 		}
 	}
@@ -164,12 +323,12 @@ func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
 	*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n
 	 */
 
-	if state.bulkLen == 0 { // read normal line
+	if !state.readingBody { // read normal line
 		msg, err = bufReader.ReadBytes('\n')
 		if err != nil {
 			return nil, true, err
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
+		if len(msg) < 2 || msg[len(msg)-2] != '\r' {
 			return nil, false, errors.New("protocol error: " + string(msg))
 		}
 	} else { // read bulk line (binary safe)
@@ -183,35 +342,66 @@ func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
 			msg[len(msg)-1] != '\n' {
 			return nil, false, errors.New("protocol error: " + string(msg))
 		}
-		state.bulkLen = 0
 	}
 	return msg, false, nil
 }
 
 // parseMultiBulkHeader  多个字符串的头  *3 把数组解析出来 并且相应的改变状态
+// RESP3 的 %n 和 |n 是 n 个键值对 后面有 2n 个成员
 func parseMultiBulkHeader(msg []byte, state *readState) error {
 	var err error
-	var expectedLine uint64
+	var expectedLine int64
 	// msg[1:len(msg)-2] 这样处理 300 这种多位数字
-	expectedLine, err = strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
+	expectedLine, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 32)
 	if err != nil {
 		return errors.New("protocol error: " + string(msg))
 	}
-	if expectedLine == 0 {
-		state.expectedArgsCount = 0
+	if msg[0] == '%' || msg[0] == '|' {
+		expectedLine *= 2
+	}
+	if expectedLine == 0 || (expectedLine == -1 && msg[0] == '*') {
+		// *-1 是空数组 例如 WATCH 的 key 被修改后 EXEC 的回复
+		state.msgType = msg[0]
+		state.expectedArgsCount = int(expectedLine)
 		return nil
 	} else if expectedLine > 0 {
 		// *3 说明后面 set k v  3个结构
 		state.msgType = msg[0]
 		state.readingMultiLine = true
 		state.expectedArgsCount = int(expectedLine)
-		state.args = make([][]byte, 0, expectedLine)
+		// 长度由对方声明 预先分配的容量有上限 防止声明很大却不发送数据
+		state.args = make([][]byte, 0, minInt(expectedLine, preallocLimit))
 		return nil
 	} else {
 		return errors.New("protocol error: " + string(msg))
 	}
 }
 
+const preallocLimit = 1024
+
+func minInt(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// emptyOrNullMultiBulk *0 和 *-1 等不需要再读后面的内容
+func emptyOrNullMultiBulk(state *readState) resp.Reply {
+	if state.expectedArgsCount < 0 {
+		return &reply.NullMultiBulkReply{}
+	}
+	switch state.msgType {
+	case '%', '|':
+		return reply.MakeMapReply(nil, nil)
+	case '~':
+		return reply.MakeSetReply(nil)
+	case '>':
+		return reply.MakePushReply(nil)
+	}
+	return &reply.EmptyMultiBulkReply{}
+}
+
 // parseBulkHeader 单个字符串的头  $n \r\n  "  " \r\n  PING
 // 初始化解析时调用的方法 如果开始是 * 后来是 $ 就不走这个方法
 func parseBulkHeader(msg []byte, state *readState) error {
@@ -220,11 +410,15 @@ func parseBulkHeader(msg []byte, state *readState) error {
 	if err != nil {
 		return errors.New("protocol error: " + string(msg))
 	}
-	if state.bulkLen == -1 { // null bulk
+	if state.bulkLen == -1 && msg[0] == '$' { // null bulk
 		return nil
-	} else if state.bulkLen > 0 {
+	} else if state.bulkLen > DefaultMaxBulkLen {
+		return errBulkTooLarge
+	} else if state.bulkLen >= 0 { // $0 是空字符串 后面还有一个 \r\n
 		state.msgType = msg[0]
+		state.bulkType = msg[0]
 		state.readingMultiLine = true
+		state.readingBody = true
 		state.expectedArgsCount = 1
 		state.args = make([][]byte, 0, 1)
 		return nil
@@ -251,6 +445,28 @@ func parseSingleLineReply(msg []byte) (resp.Reply, error) {
 			return nil, errors.New("protocol error: " + string(msg))
 		}
 		result = reply.MakeIntReply(val)
+	case '_': // RESP3 null
+		if len(str) != 1 {
+			return nil, errors.New("protocol error: " + string(msg))
+		}
+		result = reply.MakeNullReply()
+	case ',': // RESP3 double inf -inf nan 也可以解析
+		val, err := strconv.ParseFloat(str[1:], 64)
+		if err != nil {
+			return nil, errors.New("protocol error: " + string(msg))
+		}
+		result = reply.MakeDoubleReply(val)
+	case '#': // RESP3 boolean
+		if str != "#t" && str != "#f" {
+			return nil, errors.New("protocol error: " + string(msg))
+		}
+		result = reply.MakeBooleanReply(str == "#t")
+	case '(': // RESP3 big number
+		val, ok := new(big.Int).SetString(str[1:], 10)
+		if !ok {
+			return nil, errors.New("protocol error: " + string(msg))
+		}
+		result = reply.MakeBigNumberReply(val)
 	default:
 		// parse as text protocol
 		strs := strings.Split(str, " ")
@@ -265,21 +481,50 @@ func parseSingleLineReply(msg []byte) (resp.Reply, error) {
 
 // readBody 开头被上面几种方法解决完 该方法解决后面的主体部分
 // 可能出现情况   * 干掉后剩下 $ 	或者剩下 PING (不是 $ 的情况)
+// 服务端的回复中数组成员还可能是 :1 +OK -ERR 这类单行回复
 func readBody(msg []byte, state *readState) error {
 	line := msg[0 : len(msg)-2]
 	var err error
-	if line[0] == '$' {
+	if state.readingBody {
+		// $ 声明了长度的数据本体 即使以 $ 开头也是数据
+		state.readingBody = false
+		state.bulkLen = 0
+		elem := makeBulkElem(state.bulkType, line)
+		if state.bulkType != '$' {
+			state.nested = true
+		}
+		state.appendArg(line, elem)
+		return nil
+	}
+	if len(line) == 0 {
+		return errors.New("protocol error: " + string(msg))
+	}
+	switch line[0] {
+	case '$', '=', '!':
 		// bulk reply
 		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
-		if err != nil {
+		if err != nil || state.bulkLen < -1 || (state.bulkLen == -1 && line[0] != '$') {
 			return errors.New("protocol error: " + string(msg))
 		}
-		if state.bulkLen <= 0 { //  $0\r\n
-			state.args = append(state.args, []byte{})
+		if state.bulkLen > DefaultMaxBulkLen {
+			return errBulkTooLarge
+		}
+		if state.bulkLen == -1 { // $-1 数组中的 nil
 			state.bulkLen = 0
+			state.appendArg(nil, reply.MakeNullBulkReply())
+			return nil
 		}
-	} else {
-		state.args = append(state.args, line)
+		state.bulkType = line[0]
+		state.readingBody = true
+	case '+', '-', ':', '_', ',', '#', '(':
+		elem, err := parseSingleLineReply(msg)
+		if err != nil {
+			return err
+		}
+		state.nested = true
+		state.appendArg(line, elem)
+	default:
+		state.appendArg(line, reply.MakeBulkReply(line))
 	}
 	return nil
 }
@@ -0,0 +1,251 @@
+package parser
+
+import (
+	"bufio"
+	"go-redis/resp/reply"
+	"io"
+)
+
+/*
+Reader 拉取式的请求解析器 由调用方的协程直接读取
+ParseStream 每个连接一个解析协程 每条命令经过一次无缓冲的管道 管线化的请求很多时开销明显
+Reader 直接从 bufio 的缓冲区中解析 *n 和 $n 这样的头部行 不为每一行分配内存 只为参数本体分配
+只解析请求 RESP 数组或者内联命令 客户端读取回复仍然使用 ParseStream
+
+长度由客户端声明 超过限制时返回 *reply.ProtocolErrReply 格式错误时返回 *ProtocolError 调用方都要回复错误后断开连接
+  proto-max-bulk-len         单个参数的最大长度
+  client-query-buffer-limit  一条命令所有参数加上协议头的最大长度
+*/
+
+const (
+	defaultReaderSize = 16 * 1024
+	// DefaultMaxBulkLen 单个参数的最大长度 与 Redis 的 proto-max-bulk-len 默认值相同
+	DefaultMaxBulkLen = 512 * 1024 * 1024
+	// DefaultMaxQueryLen 一条命令的最大长度 与 Redis 的 client-query-buffer-limit 默认值相同
+	DefaultMaxQueryLen = 1024 * 1024 * 1024
+	maxMultiBulkLen    = 1024 * 1024
+	maxInlineSize      = 64 * 1024
+	preallocBulkLimit  = 1024 * 1024
+	// preallocArgsLimit 参数个数由客户端声明 预先分配的容量有上限 超过时随着参数到达逐步扩容
+	preallocArgsLimit = 1024
+)
+
+// 超出限制的错误 之后的数据无法再解析 需要断开连接
+var (
+	errBulkTooLarge      = &reply.ProtocolErrReply{Msg: "invalid bulk length"}
+	errMultiBulkTooLarge = &reply.ProtocolErrReply{Msg: "invalid multibulk length"}
+	errTooBigInline      = &reply.ProtocolErrReply{Msg: "too big inline request"}
+	errQueryTooLarge     = &reply.ProtocolErrReply{Msg: "query buffer limit exceeded"}
+)
+
+// ProtocolError 请求不符合协议 调用方回复错误后断开连接
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.msg
+}
+
+func makeProtocolError(msg string) *ProtocolError {
+	return &ProtocolError{
+		msg: "ERR Protocol error: " + msg,
+	}
+}
+
+// Reader 从连接或者 AOF 文件中逐条读取命令
+type Reader struct {
+	br          *bufio.Reader
+	maxBulkLen  int64
+	maxQueryLen int64
+	queryLen    int64 // 当前命令已经读取的长度
+	noInline    bool  // 只接受 RESP 数组 其他内容都是格式错误
+}
+
+// NewReader creates a Reader
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		br:          bufio.NewReaderSize(reader, defaultReaderSize),
+		maxBulkLen:  DefaultMaxBulkLen,
+		maxQueryLen: DefaultMaxQueryLen,
+	}
+}
+
+// SetMaxBulkLen 修改单个参数的最大长度 不大于 0 时忽略
+func (r *Reader) SetMaxBulkLen(maxBulkLen int64) {
+	if maxBulkLen > 0 {
+		r.maxBulkLen = maxBulkLen
+	}
+}
+
+// SetMaxQueryLen 修改一条命令的最大长度 不大于 0 时忽略
+func (r *Reader) SetMaxQueryLen(maxQueryLen int64) {
+	if maxQueryLen > 0 {
+		r.maxQueryLen = maxQueryLen
+	}
+}
+
+// DisableInline 不再接受内联命令 AOF 文件中只有 RESP 数组 损坏的内容不能当作命令执行
+func (r *Reader) DisableInline() {
+	r.noInline = true
+}
+
+// Buffered 已经读入缓冲区还没有解析的字节数
+func (r *Reader) Buffered() int {
+	return r.br.Buffered()
+}
+
+// ReadCommand 读取下一条命令 空行和 *0 会被跳过
+// 返回的 error 是 IO 错误 *ProtocolError 或者超出限制时的 *reply.ProtocolErrReply
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line[0] != '*' && r.noInline {
+			return nil, makeProtocolError("expected '*', got '" + string(line[0]) + "'")
+		}
+		if line[0] != '*' {
+			// 内联命令 parseInline 会拷贝参数 不会引用缓冲区
+			args, err := parseInline(line)
+			if err != nil {
+				return nil, &ProtocolError{msg: err.Error()}
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+		if !hasCRLF(line) {
+			return nil, makeProtocolError("invalid multibulk length")
+		}
+		count, ok := parseLen(line[1 : len(line)-2])
+		if !ok {
+			return nil, makeProtocolError("invalid multibulk length")
+		}
+		if count > maxMultiBulkLen {
+			return nil, errMultiBulkTooLarge
+		}
+		if count <= 0 {
+			continue
+		}
+		r.queryLen = int64(len(line))
+		args := make([][]byte, 0, minInt(count, preallocArgsLimit))
+		for i := int64(0); i < count; i++ {
+			arg, err := r.readBulk()
+			if err == io.EOF {
+				// 命令没有读完整
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+// readBulk 读取 $n\r\n 和 n 个字节的本体
+func (r *Reader) readBulk() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line[0] != '$' {
+		return nil, makeProtocolError("expected '$', got '" + string(line[0]) + "'")
+	}
+	if !hasCRLF(line) {
+		return nil, makeProtocolError("invalid bulk length")
+	}
+	bulkLen, ok := parseLen(line[1 : len(line)-2])
+	if !ok || bulkLen < 0 {
+		return nil, makeProtocolError("invalid bulk length")
+	}
+	if bulkLen > r.maxBulkLen {
+		return nil, errBulkTooLarge
+	}
+	r.queryLen += int64(len(line)) + bulkLen + 2
+	if r.queryLen > r.maxQueryLen {
+		return nil, errQueryTooLarge
+	}
+	var body []byte
+	if bulkLen+2 <= preallocBulkLimit {
+		body = make([]byte, bulkLen+2)
+		if _, err = io.ReadFull(r.br, body); err != nil {
+			return nil, err
+		}
+	} else {
+		// 很长的参数随着数据到达逐步扩容 声明了长度却不发送数据时不会占用内存
+		body, err = io.ReadAll(io.LimitReader(r.br, bulkLen+2))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) != bulkLen+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	if body[bulkLen] != '\r' || body[bulkLen+1] != '\n' {
+		return nil, makeProtocolError("invalid bulk format")
+	}
+	return body[:bulkLen:bulkLen], nil
+}
+
+// readLine 读取以 \n 结尾的一行 返回的切片引用 bufio 的缓冲区 下一次读取前有效
+// 超过缓冲区的内联命令拷贝出来拼接 最长 maxInlineSize
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		buf := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			if len(buf) > maxInlineSize {
+				return nil, errTooBigInline
+			}
+			line, err = r.br.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		line = buf
+	}
+	if err == io.EOF && len(line) > 0 {
+		// 最后一行没有写完整
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+func hasCRLF(line []byte) bool {
+	return len(line) >= 3 && line[len(line)-2] == '\r'
+}
+
+// parseLen 解析头部中的长度 不经过 string 转换
+func parseLen(b []byte) (int64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	negative := false
+	if b[0] == '-' {
+		negative = true
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+		if n > 1<<40 {
+			return 0, false
+		}
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
@@ -0,0 +1,209 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	data := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$0\r\n\r\n" +
+		"\r\n*0\r\n" + // 空行和 *0 被跳过
+		"set b \"hello world\"\r\n" // 内联命令
+	r := NewReader(strings.NewReader(data))
+	expected := [][][]byte{
+		{[]byte("SET"), []byte("a"), {}},
+		{[]byte("set"), []byte("b"), []byte("hello world")},
+	}
+	for _, want := range expected {
+		args, err := r.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, want) {
+			t.Fatalf("expect %q, got %q", want, args)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
+
+// TestReadCommandLimits 客户端声明的长度超出限制时 在读取本体之前就返回错误
+func TestReadCommandLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		maxBulk  int64
+		maxQuery int64
+		err      error
+	}{
+		{
+			name: "bulk over default proto-max-bulk-len",
+			data: "*2\r\n$3\r\nGET\r\n$" + strconv.Itoa(DefaultMaxBulkLen+1) + "\r\n",
+			err:  errBulkTooLarge,
+		},
+		{
+			name:    "bulk over proto-max-bulk-len",
+			data:    "*2\r\n$3\r\nGET\r\n$11\r\n",
+			maxBulk: 10,
+			err:     errBulkTooLarge,
+		},
+		{
+			name: "multibulk count",
+			data: "*" + strconv.Itoa(maxMultiBulkLen+1) + "\r\n",
+			err:  errMultiBulkTooLarge,
+		},
+		{
+			name:     "query over client-query-buffer-limit",
+			data:     "*3\r\n$3\r\nSET\r\n$40\r\n" + strings.Repeat("k", 40) + "\r\n$40\r\n",
+			maxQuery: 64,
+			err:      errQueryTooLarge,
+		},
+		{
+			name: "inline without newline",
+			data: strings.Repeat("a", maxInlineSize+defaultReaderSize),
+			err:  errTooBigInline,
+		},
+	}
+	for _, c := range cases {
+		r := NewReader(strings.NewReader(c.data))
+		r.SetMaxBulkLen(c.maxBulk)
+		r.SetMaxQueryLen(c.maxQuery)
+		if _, err := r.ReadCommand(); err != c.err {
+			t.Errorf("%s: expect %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestReadCommandProtocolError(t *testing.T) {
+	for _, data := range []string{
+		"*2\r\n$3\r\nGET\r\n#1\r\n",
+		"*x\r\n",
+		"*1\r\n$-2\r\n",
+		"*1\r\n$3\r\nGETXX\r\n",
+		"set \"a\r\n",
+	} {
+		_, err := NewReader(strings.NewReader(data)).ReadCommand()
+		if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%q: expect protocol error, got %v", data, err)
+		}
+	}
+}
+
+// TestReadCommandNoInline 关闭内联命令之后 不是 RESP 数组的内容都是格式错误
+func TestReadCommandNoInline(t *testing.T) {
+	for _, data := range []string{
+		"set a 1\r\n",
+		"\r\n*1\r\n$4\r\nPING\r\n",
+		"$3\r\nGET\r\n",
+	} {
+		r := NewReader(strings.NewReader(data))
+		r.DisableInline()
+		if _, err := r.ReadCommand(); err == nil {
+			t.Errorf("%q: expect protocol error, got nil", data)
+		} else if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%q: expect protocol error, got %v", data, err)
+		}
+	}
+}
+
+// TestReadCommandLargeCount 声明了很多参数却没有发送时 不会按声明的个数分配内存
+func TestReadCommandLargeCount(t *testing.T) {
+	count := maxMultiBulkLen
+	r := NewReader(strings.NewReader("*" + strconv.Itoa(count) + "\r\n$4\r\nPING\r\n"))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := r.ReadCommand()
+	runtime.ReadMemStats(&after)
+	// 按声明的个数分配需要 count 个切片头 每个 24 字节
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= uint64(count)*24 {
+		t.Errorf("expect bounded preallocation, allocated %d bytes", allocated)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expect unexpected EOF, got %v", err)
+	}
+
+	// 参数多于预分配的容量时照常读取
+	var buf bytes.Buffer
+	n := preallocArgsLimit * 3
+	buf.WriteString("*" + strconv.Itoa(n) + "\r\n")
+	for i := 0; i < n; i++ {
+		arg := strconv.Itoa(i)
+		buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	args, err := NewReader(&buf).ReadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != n || string(args[n-1]) != strconv.Itoa(n-1) {
+		t.Fatalf("expect %d args, got %d", n, len(args))
+	}
+}
+
+// pipelinedRequests 一次发送的多条命令 模拟 redis-benchmark -P 的管线化请求
+func pipelinedRequests(n int) []byte {
+	var buf bytes.Buffer
+	value := bytes.Repeat([]byte("v"), 64)
+	for i := 0; i < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if i%2 == 0 {
+			buf.WriteString("*3\r\n$3\r\nSET\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n$64\r\n")
+			buf.Write(value)
+			buf.WriteString("\r\n")
+		} else {
+			buf.WriteString("*2\r\n$3\r\nGET\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+const benchPipeline = 1000
+
+func BenchmarkReader(b *testing.B) {
+	data := pipelinedRequests(benchPipeline)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewReader(bytes.NewReader(data))
+		for n := 0; ; n++ {
+			_, err := r.ReadCommand()
+			if err == io.EOF {
+				if n != benchPipeline {
+					b.Fatalf("expect %d commands, got %d", benchPipeline, n)
+				}
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseStream(b *testing.B) {
+	data := pipelinedRequests(benchPipeline)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		for payload := range ParseStream(bytes.NewReader(data)) {
+			if payload.Err == io.EOF {
+				break
+			}
+			if payload.Err != nil {
+				b.Fatal(payload.Err)
+			}
+			n++
+		}
+		if n != benchPipeline {
+			b.Fatalf("expect %d commands, got %d", benchPipeline, n)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
+	nullBulkReplyBytes = []byte("$-1\r\n")
 	CRLF               = "\r\n"
 )
 
@@ -20,7 +20,8 @@ type BulkReply struct {
 
 // ToBytes 许多这种地方要用引用类型 *BulkReply
 func (b *BulkReply) ToBytes() []byte {
-	if len(b.Arg) == 0 {
+	// nil 表示不存在 空切片是空字符串 $0
+	if b.Arg == nil {
 		return nullBulkReplyBytes
 	}
 	return []byte("$" + strconv.Itoa(len(b.Arg)) + CRLF + string(b.Arg) + CRLF)
@@ -118,3 +119,23 @@ func IsErrorReply(reply resp.Reply) bool {
 	// 输入 Reply 接口 判断转成字节后第一个成员是不是 “-”
 	return reply.ToBytes()[0] == '-'
 }
+
+// MultiRawReply 嵌套数组 每个成员本身就是一个 Reply 例如 CLUSTER SLOTS
+type MultiRawReply struct {
+	Replies []resp.Reply
+}
+
+func MakeMultiRawReply(replies []resp.Reply) *MultiRawReply {
+	return &MultiRawReply{
+		Replies: replies,
+	}
+}
+
+func (r *MultiRawReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Replies)) + CRLF)
+	for _, re := range r.Replies {
+		buf.Write(re.ToBytes())
+	}
+	return buf.Bytes()
+}
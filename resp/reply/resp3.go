@@ -0,0 +1,332 @@
+package reply
+
+import (
+	"bytes"
+	"go-redis/interface/resp"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+/*
+RESP3 新增的回复类型 客户端通过 HELLO 3 切换协议
+ToBytes 与其他回复一样是 RESP2 的编码 只有 Marshal(r, Resp3) 才会写出 RESP3 的类型
+写回客户端时使用 Marshal 按连接的协议编码
+RESP2 的客户端收到的是兼容的类型 map 和 set 变成数组 double 和 big number 变成字符串 boolean 变成 0 1 null 变成 $-1
+*/
+
+const (
+	Resp2 = 2
+	Resp3 = 3
+)
+
+// ProtocolReply 在 RESP2 和 RESP3 下编码不同的回复
+type ProtocolReply interface {
+	resp.Reply
+	ToBytesWithProtocol(protocol int) []byte
+}
+
+var nullBytes = []byte("_\r\n")
+
+// Marshal 按协议版本编码回复 0 按 RESP2 处理
+func Marshal(r resp.Reply, protocol int) []byte {
+	if p, ok := r.(ProtocolReply); ok {
+		return p.ToBytesWithProtocol(protocol)
+	}
+	if protocol != Resp3 {
+		return r.ToBytes()
+	}
+	// RESP2 中的两种 null 在 RESP3 中都是 _
+	switch v := r.(type) {
+	case *NullBulkReply, *NullMultiBulkReply:
+		return nullBytes
+	case *BulkReply:
+		if v.Arg == nil {
+			return nullBytes
+		}
+	}
+	return r.ToBytes()
+}
+
+// writeAggregate 写入聚合类型的头和成员
+func writeAggregate(buf *bytes.Buffer, prefix byte, n int, members []resp.Reply, protocol int) {
+	buf.WriteByte(prefix)
+	buf.WriteString(strconv.Itoa(n) + CRLF)
+	for _, member := range members {
+		buf.Write(Marshal(member, protocol))
+	}
+}
+
+// MapReply %n 键值对 RESP2 下是 2n 个成员的数组
+type MapReply struct {
+	Keys   []resp.Reply
+	Values []resp.Reply
+}
+
+func MakeMapReply(keys []resp.Reply, values []resp.Reply) *MapReply {
+	return &MapReply{
+		Keys:   keys,
+		Values: values,
+	}
+}
+
+// MakeMapReplyFromPairs 由 key value key value ... 的顺序生成
+func MakeMapReplyFromPairs(pairs ...resp.Reply) *MapReply {
+	r := &MapReply{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		r.Keys = append(r.Keys, pairs[i])
+		r.Values = append(r.Values, pairs[i+1])
+	}
+	return r
+}
+
+func (r *MapReply) pairs() []resp.Reply {
+	pairs := make([]resp.Reply, 0, len(r.Keys)*2)
+	for i := range r.Keys {
+		pairs = append(pairs, r.Keys[i], r.Values[i])
+	}
+	return pairs
+}
+
+func (r *MapReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *MapReply) ToBytesWithProtocol(protocol int) []byte {
+	var buf bytes.Buffer
+	if protocol == Resp3 {
+		writeAggregate(&buf, '%', len(r.Keys), r.pairs(), protocol)
+	} else {
+		writeAggregate(&buf, '*', len(r.Keys)*2, r.pairs(), protocol)
+	}
+	return buf.Bytes()
+}
+
+// SetReply ~n 无序不重复的集合 RESP2 下是数组
+type SetReply struct {
+	Members []resp.Reply
+}
+
+func MakeSetReply(members []resp.Reply) *SetReply {
+	return &SetReply{
+		Members: members,
+	}
+}
+
+func (r *SetReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *SetReply) ToBytesWithProtocol(protocol int) []byte {
+	var buf bytes.Buffer
+	prefix := byte('~')
+	if protocol != Resp3 {
+		prefix = '*'
+	}
+	writeAggregate(&buf, prefix, len(r.Members), r.Members, protocol)
+	return buf.Bytes()
+}
+
+// PushReply >n 服务端主动推送的消息 例如订阅的消息 RESP2 下是数组
+type PushReply struct {
+	Members []resp.Reply
+}
+
+func MakePushReply(members []resp.Reply) *PushReply {
+	return &PushReply{
+		Members: members,
+	}
+}
+
+func (r *PushReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *PushReply) ToBytesWithProtocol(protocol int) []byte {
+	var buf bytes.Buffer
+	prefix := byte('>')
+	if protocol != Resp3 {
+		prefix = '*'
+	}
+	writeAggregate(&buf, prefix, len(r.Members), r.Members, protocol)
+	return buf.Bytes()
+}
+
+// AttributeReply |n 附加在回复前面的属性 RESP2 下丢弃属性只保留回复
+type AttributeReply struct {
+	Attributes *MapReply
+	Data       resp.Reply
+}
+
+func MakeAttributeReply(attributes *MapReply, data resp.Reply) *AttributeReply {
+	return &AttributeReply{
+		Attributes: attributes,
+		Data:       data,
+	}
+}
+
+func (r *AttributeReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *AttributeReply) ToBytesWithProtocol(protocol int) []byte {
+	if protocol != Resp3 {
+		return Marshal(r.Data, protocol)
+	}
+	var buf bytes.Buffer
+	writeAggregate(&buf, '|', len(r.Attributes.Keys), r.Attributes.pairs(), protocol)
+	buf.Write(Marshal(r.Data, protocol))
+	return buf.Bytes()
+}
+
+// DoubleReply ,1.5 浮点数 RESP2 下是字符串
+type DoubleReply struct {
+	Value float64
+}
+
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{
+		Value: value,
+	}
+}
+
+// formatDouble 与 Redis 相同 无穷大写作 inf -inf
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (r *DoubleReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *DoubleReply) ToBytesWithProtocol(protocol int) []byte {
+	str := formatDouble(r.Value)
+	if protocol != Resp3 {
+		return MakeBulkReply([]byte(str)).ToBytes()
+	}
+	return []byte("," + str + CRLF)
+}
+
+// BooleanReply #t #f RESP2 下是 :1 :0
+type BooleanReply struct {
+	Value bool
+}
+
+func MakeBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{
+		Value: value,
+	}
+}
+
+func (r *BooleanReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *BooleanReply) ToBytesWithProtocol(protocol int) []byte {
+	if protocol != Resp3 {
+		if r.Value {
+			return []byte(":1" + CRLF)
+		}
+		return []byte(":0" + CRLF)
+	}
+	if r.Value {
+		return []byte("#t" + CRLF)
+	}
+	return []byte("#f" + CRLF)
+}
+
+// BigNumberReply (123... 超出 int64 的整数 RESP2 下是字符串
+type BigNumberReply struct {
+	Value *big.Int
+}
+
+func MakeBigNumberReply(value *big.Int) *BigNumberReply {
+	return &BigNumberReply{
+		Value: value,
+	}
+}
+
+func (r *BigNumberReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *BigNumberReply) ToBytesWithProtocol(protocol int) []byte {
+	if protocol != Resp3 {
+		return MakeBulkReply([]byte(r.Value.String())).ToBytes()
+	}
+	return []byte("(" + r.Value.String() + CRLF)
+}
+
+// VerbatimReply =n\r\ntxt:... 带格式的文本 格式固定三个字符 RESP2 下是不带格式的字符串
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+func MakeVerbatimReply(format string, text []byte) *VerbatimReply {
+	return &VerbatimReply{
+		Format: format,
+		Text:   text,
+	}
+}
+
+func (r *VerbatimReply) ToBytes() []byte {
+	return r.ToBytesWithProtocol(Resp2)
+}
+
+func (r *VerbatimReply) ToBytesWithProtocol(protocol int) []byte {
+	if protocol != Resp3 {
+		return MakeBulkReply(r.Text).ToBytes()
+	}
+	return []byte("=" + strconv.Itoa(len(r.Text)+4) + CRLF + r.Format + ":" + string(r.Text) + CRLF)
+}
+
+// NullReply _ RESP3 统一的空值 RESP2 下是 $-1
+type NullReply struct{}
+
+func MakeNullReply() *NullReply {
+	return &NullReply{}
+}
+
+func (r *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (r *NullReply) ToBytesWithProtocol(protocol int) []byte {
+	if protocol != Resp3 {
+		return nullBulkBytes
+	}
+	return nullBytes
+}
+
+// ToBytesWithProtocol 成员可能是 RESP3 的类型 需要按协议编码
+func (r *MultiRawReply) ToBytesWithProtocol(protocol int) []byte {
+	var buf bytes.Buffer
+	writeAggregate(&buf, '*', len(r.Replies), r.Replies, protocol)
+	return buf.Bytes()
+}
+
+// ToBytesWithProtocol RESP3 下数组中的 nil 写作 _
+func (r *MultiBulkReply) ToBytesWithProtocol(protocol int) []byte {
+	if protocol != Resp3 {
+		return r.ToBytes()
+	}
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Args)) + CRLF)
+	for _, arg := range r.Args {
+		if arg == nil {
+			buf.Write(nullBytes)
+		} else {
+			buf.WriteString("$" + strconv.Itoa(len(arg)) + CRLF + string(arg) + CRLF)
+		}
+	}
+	return buf.Bytes()
+}
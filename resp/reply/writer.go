@@ -0,0 +1,110 @@
+package reply
+
+import (
+	"go-redis/interface/resp"
+	"io"
+	"strconv"
+)
+
+// BufWriter 回复写入的目标 bufio.Writer 和 bytes.Buffer 都满足
+type BufWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// WriteTo 按协议把回复直接写入 w 常用的类型不经过 ToBytes 生成中间的切片
+// 其他类型退回到 Marshal
+func WriteTo(w BufWriter, r resp.Reply, protocol int) error {
+	switch v := r.(type) {
+	case *OkReply:
+		_, err := w.Write(okBytes)
+		return err
+	case *QueuedReply:
+		_, err := w.Write(queuedBytes)
+		return err
+	case *PongReply:
+		_, err := w.Write(pongbytes)
+		return err
+	case *StatusReply:
+		return writeLine(w, '+', v.Status)
+	case *StandardErrReply:
+		return writeLine(w, '-', v.Status)
+	case *IntReply:
+		return writeLine(w, ':', strconv.FormatInt(v.Code, 10))
+	case *BulkReply:
+		return writeBulk(w, v.Arg, protocol)
+	case *NullBulkReply:
+		return writeBulk(w, nil, protocol)
+	case *MultiBulkReply:
+		if err := writeLine(w, '*', strconv.Itoa(len(v.Args))); err != nil {
+			return err
+		}
+		for _, arg := range v.Args {
+			if err := writeBulk(w, arg, protocol); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *MultiRawReply:
+		return writeMembers(w, '*', len(v.Replies), v.Replies, protocol)
+	case *SetReply:
+		if protocol == Resp3 {
+			return writeMembers(w, '~', len(v.Members), v.Members, protocol)
+		}
+		return writeMembers(w, '*', len(v.Members), v.Members, protocol)
+	case *MapReply:
+		if protocol == Resp3 {
+			return writeMembers(w, '%', len(v.Keys), v.pairs(), protocol)
+		}
+		return writeMembers(w, '*', len(v.Keys)*2, v.pairs(), protocol)
+	}
+	_, err := w.Write(Marshal(r, protocol))
+	return err
+}
+
+// writeLine 写入 +OK\r\n :1\r\n 这样的单行
+func writeLine(w BufWriter, prefix byte, line string) error {
+	if err := w.WriteByte(prefix); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(line); err != nil {
+		return err
+	}
+	_, err := w.WriteString(CRLF)
+	return err
+}
+
+// writeBulk nil 是空值 RESP2 写作 $-1 RESP3 写作 _
+func writeBulk(w BufWriter, arg []byte, protocol int) error {
+	if arg == nil {
+		var err error
+		if protocol == Resp3 {
+			_, err = w.Write(nullBytes)
+		} else {
+			_, err = w.Write(nullBulkBytes)
+		}
+		return err
+	}
+	if err := writeLine(w, '$', strconv.Itoa(len(arg))); err != nil {
+		return err
+	}
+	if _, err := w.Write(arg); err != nil {
+		return err
+	}
+	_, err := w.WriteString(CRLF)
+	return err
+}
+
+// writeMembers 聚合类型的头和每个成员
+func writeMembers(w BufWriter, prefix byte, n int, members []resp.Reply, protocol int) error {
+	if err := writeLine(w, prefix, strconv.Itoa(n)); err != nil {
+		return err
+	}
+	for _, member := range members {
+		if err := WriteTo(w, member, protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
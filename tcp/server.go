@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"go-redis/interface/tcp"
 	"go-redis/lib/logger"
 	"net"
@@ -9,6 +11,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
 /*
@@ -17,12 +20,19 @@ Config
 */
 
 type Config struct {
-	Address string // 监听地址
+	Address    string      // 明文的监听地址 为空时不监听
+	TLSAddress string      // TLS 的监听地址 为空时不监听
+	TLSConfig  *tls.Config // TLS 使用的证书和客户端校验方式
+	UnixSocket string      // Unix 域套接字的路径 为空时不监听
+	UnixPerm   os.FileMode // Unix 域套接字文件的权限 为 0 时不修改
+	// KeepAlive 接受的 TCP 连接保活探测的间隔 0 使用 Go 的默认值 小于 0 关闭保活
+	KeepAlive time.Duration
 }
 
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 	closeChan := make(chan struct{})
-	sigChan := make(chan os.Signal)
+	// signal.Notify 不会阻塞发送 通道需要有缓冲 否则信号可能丢失
+	sigChan := make(chan os.Signal, 1)
 	// Notify 系统传的信号告知 sigChan
 	// 可以查下 系统挂起 杀掉 一般就是这几个信号
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -34,53 +44,117 @@ func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 		}
 	}()
 
-	// listener 相当于 listen 状态的 socket
-	listener, err := net.Listen("tcp", cfg.Address)
-	if err != nil {
-		return err
+	// listener 相当于 listen 状态的 socket 明文和 TLS 各一个 由同一个 handler 处理
+	var listeners []net.Listener
+	listenConfig := &net.ListenConfig{KeepAlive: cfg.KeepAlive}
+	if cfg.Address != "" {
+		listener, err := listenConfig.Listen(context.Background(), "tcp", cfg.Address)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if cfg.TLSAddress != "" {
+		listener, err := listenConfig.Listen(context.Background(), "tcp", cfg.TLSAddress)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, tls.NewListener(listener, cfg.TLSConfig))
+	}
+	if cfg.UnixSocket != "" {
+		listener, err := listenUnix(cfg.UnixSocket, cfg.UnixPerm)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, listener)
+		// 关闭 listener 时会删除套接字文件 这里再确认一次
+		defer func() {
+			_ = os.Remove(cfg.UnixSocket)
+		}()
+	}
+	if len(listeners) == 0 {
+		return errors.New("no address to listen")
 	}
 	// listener 监听新连接
 	logger.Info("start listen")
-	ListenAndServe(listener, handler, closeChan)
+	ListenAndServe(listeners, handler, closeChan)
 	return nil
 }
 
-func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+// listenUnix 上次没有正常退出时套接字文件还在 先删除再监听
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
+func ListenAndServe(listeners []net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
 
 	// 如果程序退出 用户关闭窗口或者 kill 走不到 下面逻辑 需要 chan 感知退出
 	go func() {
 		// 如果 chan 为空 则一直读不出阻塞 有信号的话往下执行
 		<-closeChan
 		logger.Info("shutting down")
-		_ = listener.Close()
+		closeListeners(listeners)
 		_ = handler.Close()
 	}()
 
 	defer func() {
 		// 可以将返回值 error 扔掉
-		_ = listener.Close()
+		closeListeners(listeners)
 		_ = handler.Close()
 	}()
 	ctx := context.Background()
 	// 保证 连接失败 break 之前所有的连接退出
 	var waitDone sync.WaitGroup
-	for true {
-		// 接收新连接出问题 就从死循环跳出去
-		conn, err := listener.Accept()
-		if err != nil {
-			break
-		}
-		logger.Info("accepted link")
-		// 一个协程一个连接
-		waitDone.Add(1)
-		go func() {
-			defer func() {
-				waitDone.Done()
-			}()
-			handler.Handle(ctx, conn)
-			//	waitDone.Done() 如果 handler 中 panic 则无法执行
-		}()
+	var acceptDone sync.WaitGroup
+	for _, listener := range listeners {
+		acceptDone.Add(1)
+		go func(listener net.Listener) {
+			defer acceptDone.Done()
+			for {
+				// 接收新连接出问题 就从死循环跳出去 其他端口也一起停止
+				conn, err := listener.Accept()
+				if err != nil {
+					closeListeners(listeners)
+					return
+				}
+				logger.Info("accepted link")
+				// 一个协程一个连接
+				waitDone.Add(1)
+				go func() {
+					defer func() {
+						waitDone.Done()
+					}()
+					handler.Handle(ctx, conn)
+					//	waitDone.Done() 如果 handler 中 panic 则无法执行
+				}()
+			}
+		}(listener)
 	}
+	acceptDone.Wait()
 	// break 退出 for 时等待
 	waitDone.Wait()
 }